@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// jwksMaxAge is the age of the fetched keys, the proxy rotates its keys on a schedule
+	jwksMaxAge = time.Minute
+	// jwksMinInterval limits the fetches of the unknown kids of forged cookies
+	jwksMinInterval = 10 * time.Second
+)
+
+// jwksCache holds the public keys of the JWKS endpoint of the reverseproxy by kid.
+type jwksCache struct {
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+	client  *http.Client
+}
+
+var sessionKeys = &jwksCache{}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unknown key type %s", k.Kty)
+}
+
+// httpClient trusts the jwks_ca_file besides the system roots, the proxy can have its own cert.
+func (c *jwksCache) httpClient() (*http.Client, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if Config.JWKSCAFile != "" {
+		pem, err := os.ReadFile(Config.JWKSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in the jwks_ca_file")
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	c.client = client
+	return client, nil
+}
+
+// fetch reads the keys of the JWKS endpoint, it is called with the mutex held.
+func (c *jwksCache) fetch() error {
+	if Config.JWKSUrl == "" {
+		return errors.New("jwks_url is not set")
+	}
+	client, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(Config.JWKSUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks status %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]any)
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	c.keys, c.fetched = keys, time.Now()
+	return nil
+}
+
+// Keyfunc returns the public key of the kid of the token for jwt.Parse, the keys are fetched
+// again after jwksMaxAge and for an unknown kid, a new key of a rotation.
+func (c *jwksCache) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	age := time.Since(c.fetched)
+	if _, known := c.keys[kid]; age > jwksMaxAge || (!known && age > jwksMinInterval) {
+		if err := c.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
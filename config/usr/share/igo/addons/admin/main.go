@@ -21,12 +21,27 @@ func debugHeader(username string) string {
 	return fmt.Sprintf("[%s] ", username)
 }
 
+// defaultJWKSUrl is the JWKS endpoint of the reverseproxy of the same host.
+func defaultJWKSUrl() string {
+	port := os.Getenv("ENV_PARAM_REVERSEPROXY_PORT")
+	if port == "" {
+		port = "10111"
+	}
+	schema := "http"
+	if os.Getenv("ENV_PARAM_REVERSEPROXY_SERVER_CERT") != "" {
+		schema = "https"
+	}
+	return schema + "://localhost:" + port + "/.well-known/jwks.json"
+}
+
 func init() {
 	flag.CommandLine.Init("env_param_admin_addon", flag.ExitOnError)
 
 	flag.IntVar(&Config.Port, "port", 10113, "Port(10113)")
 	flag.StringVar(&Config.TemplateRootPath, "template_root_path", "", "")
 	flag.StringVar(&Config.DomainPath, "domain_path", "", "")
+	flag.StringVar(&Config.JWKSUrl, "jwks_url", defaultJWKSUrl(), "JWKS endpoint of the reverseproxy, the session cookies are verified with its keys")
+	flag.StringVar(&Config.JWKSCAFile, "jwks_ca_file", os.Getenv("ENV_PARAM_REVERSEPROXY_SERVER_CERT"), "Certificate which is trusted besides the system roots for the jwks_url")
 
 	if value, ok := os.LookupEnv("PORT_ADMIN"); ok {
 		if portInt, err := strconv.Atoi(value); err == nil {
@@ -58,6 +73,11 @@ func main() {
 		case "/issh_login_data":
 			if cookieName := os.Getenv("ENV_PARAM_REVERSEPROXY_COOKIE_NAME"); cookieName != "" {
 				if cookie, err := c.Cookie(cookieName); err == nil {
+					if err := checkSession(cookie); err != nil {
+						log.Println("[ERROR] issh_login_data session >", err)
+						c.Status(http.StatusUnauthorized)
+						return
+					}
 					data := UserLoginData{
 						Cookie: cookieName + "=" + cookie,
 						Domain: Config.DomainPath + "/ssh",
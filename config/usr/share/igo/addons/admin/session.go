@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const defaultSessionsPath = "/var/lib/igo/reverseproxy/sessions.json"
+
+// checkSession verifies the cookie with the keys of the JWKS endpoint of the reverseproxy, it
+// returns an error if the session is unknown or revoked in the session registry of the proxy.
+func checkSession(cookie string) error {
+	claims := jwt.MapClaims{}
+	parser := jwt.Parser{ValidMethods: []string{"RS256", "ES256", "ES384", "ES512"}}
+	if _, err := parser.ParseWithClaims(cookie, claims, sessionKeys.Keyfunc); err != nil {
+		return err
+	}
+	id, _ := claims["jti"].(string)
+	path := os.Getenv("ENV_PARAM_REVERSEPROXY_SESSIONS_PATH")
+	if path == "" {
+		path = defaultSessionsPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sessions := make(map[string]struct {
+		Revoked time.Time `json:"revoked"`
+	})
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return err
+	}
+	if session, ok := sessions[id]; !ok {
+		return errors.New("the session does not exist")
+	} else if !session.Revoked.IsZero() {
+		return errors.New("the session is revoked")
+	}
+	return nil
+}
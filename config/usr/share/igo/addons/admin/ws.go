@@ -13,6 +13,9 @@ type RuntimeConfig struct {
 	Port             int
 	TemplateRootPath string
 	DomainPath       string
+	// JWKSUrl is the JWKS endpoint of the reverseproxy, the session cookies are verified with it
+	JWKSUrl    string
+	JWKSCAFile string
 }
 
 func serveWebsocket(remoteUrl string, c *gin.Context) {
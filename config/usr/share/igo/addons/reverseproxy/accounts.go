@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ui3o/codebox/reverseproxy/simple"
+)
+
+const totpIssuer = "codebox"
+
+func newAccountStore() *simple.AccountStore {
+	return &simple.AccountStore{
+		Path:            Config.AccountsPath,
+		MaxFailedLogins: Config.MaxFailedLogins,
+		LockoutDuration: time.Duration(Config.LockoutDuration) * time.Second,
+		// the cli does not log in, the limit is for the proxy
+		MaxFailedLoginsPerAddr: Config.MaxFailedLoginsPerAddr,
+	}
+}
+
+// readPassword reads the password without echo from a terminal, or the first line of the stdin.
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", errors.New("no password on the stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	reader := bufio.NewReader(os.Stdin)
+	read := func(prompt string) string {
+		fmt.Fprint(os.Stderr, prompt)
+		stty("-echo")
+		line, _ := reader.ReadString('\n')
+		stty("echo")
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimRight(line, "\r\n")
+	}
+	password := read("Password: ")
+	if read("Password again: ") != password {
+		return "", errors.New("the passwords do not match")
+	}
+	return password, nil
+}
+
+// passwordHash returns the imported hash or the hash of the password read from the user.
+func passwordHash(imported string) (string, error) {
+	if len(imported) > 0 {
+		if !simple.IsPasswordHash(imported) {
+			return "", errors.New("the hash must be an argon2id or a bcrypt hash")
+		}
+		return imported, nil
+	}
+	password, err := readPassword()
+	if err != nil {
+		return "", err
+	}
+	if len(password) < 8 {
+		return "", errors.New("the password must have at least 8 characters")
+	}
+	return simple.HashPassword(password)
+}
+
+func printTOTP(name, secret string) {
+	fmt.Println("TOTP secret:", secret)
+	fmt.Println("TOTP uri:   ", simple.TOTPURI(totpIssuer, name, secret))
+}
+
+func accountUsage() {
+	fmt.Println("Usage: reverseproxy account list")
+	fmt.Println("       reverseproxy account add <name> [--email <email>] [--domain <domain>] [--totp] [--hash <hash>]")
+	fmt.Println("       reverseproxy account passwd <name> [--hash <hash>]")
+	fmt.Println("       reverseproxy account totp <name> [--disable]")
+	fmt.Println("       reverseproxy account [unlock|remove] <name>")
+	fmt.Println("The remove revokes the sessions of the account.")
+	fmt.Println("The password is read from the terminal or the first line of the stdin.")
+}
+
+// accountCommand manages the local accounts of the simple login, it returns the exit code.
+func accountCommand(args []string) int {
+	if len(args) == 0 {
+		accountUsage()
+		return 1
+	}
+	fs := flag.NewFlagSet("account "+args[0], flag.ContinueOnError)
+	email := fs.String("email", "", "")
+	domain := fs.String("domain", "", "")
+	withTOTP := fs.Bool("totp", false, "")
+	disable := fs.Bool("disable", false, "")
+	hash := fs.String("hash", "", "")
+	// the name can be before or after the flags
+	name := ""
+	if err := fs.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 {
+		name = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return 1
+		}
+	}
+	if fs.NArg() > 0 || (name == "" && args[0] != "list") {
+		accountUsage()
+		return 1
+	}
+
+	store := newAccountStore()
+	var err error
+	switch args[0] {
+	case "list":
+		var accounts []simple.Account
+		if accounts, err = store.List(); err == nil {
+			fmt.Printf("%-20s %-30s %-15s %-5s %-6s %s\n", "Name", "Email", "Domain", "TOTP", "Failed", "Locked until")
+			fmt.Println(strings.Repeat("-", 100))
+			for _, a := range accounts {
+				locked := "-"
+				if time.Now().Before(a.LockedUntil) {
+					locked = a.LockedUntil.Local().Format("2006-01-02 15:04:05")
+				}
+				fmt.Printf("%-20s %-30s %-15s %-5t %-6d %s\n", a.Name, a.Email, a.Domain, a.TOTPSecret != "", a.FailedLogins, locked)
+			}
+		}
+	case "add":
+		account := simple.Account{Name: name, Email: *email, Domain: *domain}
+		if account.PasswordHash, err = passwordHash(*hash); err == nil {
+			if *withTOTP {
+				account.TOTPSecret = simple.NewTOTPSecret()
+			}
+			if err = store.Add(account); err == nil {
+				fmt.Println("Account", strings.ToLower(name), "is added")
+				if *withTOTP {
+					printTOTP(strings.ToLower(name), account.TOTPSecret)
+				}
+			}
+		}
+	case "passwd":
+		var newHash string
+		if newHash, err = passwordHash(*hash); err == nil {
+			err = store.Modify(name, func(a *simple.Account) { a.PasswordHash = newHash })
+		}
+	case "totp":
+		secret := ""
+		if !*disable {
+			secret = simple.NewTOTPSecret()
+		}
+		if err = store.Modify(name, func(a *simple.Account) { a.TOTPSecret, a.TOTPCounter = secret, 0 }); err == nil && !*disable {
+			printTOTP(strings.ToLower(name), secret)
+		}
+	case "unlock":
+		err = store.Modify(name, func(a *simple.Account) { a.FailedLogins, a.LockedUntil = 0, time.Time{} })
+	case "remove":
+		if err = store.Remove(name); err == nil {
+			_, err = newSessionRegistry().RevokeUser(name)
+		}
+	default:
+		accountUsage()
+		return 1
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gin-gonic/gin"
+	"github.com/ui3o/codebox/reverseproxy/oidc"
+	"github.com/ui3o/codebox/reverseproxy/saml"
+	"github.com/ui3o/codebox/reverseproxy/simple"
+)
+
+// AuthProvider logs in the anonymous users and reads the session of the logged in ones.
+type AuthProvider interface {
+	// IsCallback returns true for the requests of the login flow of the provider
+	IsCallback(c *gin.Context) bool
+	// StartLogin sends the anonymous user to the login
+	StartLogin(c *gin.Context, user *simple.JWTUser)
+	// HandleCallback finishes the login and creates the session
+	HandleCallback(c *gin.Context, user *simple.JWTUser)
+	// ReadSession fills the user from the session of the request
+	ReadSession(c *gin.Context, user *simple.JWTUser) error
+	// Logout deletes the session, it returns the url the user is sent to after it
+	Logout(c *gin.Context, user *simple.JWTUser) string
+}
+
+func newAuthProvider() AuthProvider {
+	var provider AuthProvider = simpleAuth{newAccountStore()}
+	if Config.UseSAMLAuth {
+		provider = samlAuth{}
+	} else if Config.UseOIDCAuth {
+		provider = oidcAuth{oidc.NewProvider(*Config.OIDC)}
+	}
+	// the login runs on the redirect url, this proxy only reads the sessions
+	if Config.UseRedirectAuth {
+		provider = redirectAuth{provider}
+	}
+	return provider
+}
+
+// isOwnUrl returns true for the urls of the host of the proxy and of the hosts under its
+// cookie domain, the login only redirects to them.
+func isOwnUrl(raw string, host string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+	target, own := strings.ToLower(u.Hostname()), strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(own); err == nil {
+		own = h
+	}
+	if target != "" && target == own {
+		return true
+	}
+	domain := cookieDomain(own)
+	return strings.HasPrefix(domain, ".") && strings.HasSuffix(target, domain)
+}
+
+// returnUrl is the url the user is sent to after the login, it is the parameter of a
+// redirected login or the requested url. The parameter is used only for the own hosts.
+func returnUrl(c *gin.Context) string {
+	if strings.HasPrefix(c.Request.RequestURI, RuntimeVar.RedirectParameterWithPrefix) {
+		escapedQuery := strings.Replace(c.Request.RequestURI, RuntimeVar.RedirectParameterWithPrefix, "", 1)
+		if query, err := url.QueryUnescape(escapedQuery); err == nil && isOwnUrl(query, c.Request.Host) {
+			return query
+		}
+	}
+	schema := "http"
+	if c.Request.TLS != nil {
+		schema = "https"
+	}
+	return schema + "://" + c.Request.Host + c.Request.RequestURI
+}
+
+// readSessionCookie reads the session cookie of the simple and the oidc login.
+func readSessionCookie(c *gin.Context, user *simple.JWTUser) error {
+	cookie, err := c.Cookie(Config.CookieName)
+	if err != nil {
+		return err
+	}
+	u, err := simple.Decode(cookie)
+	if err != nil {
+		return err
+	}
+	user.ID = u.ID
+	user.Name = u.Name
+	user.Domain = u.Domain
+	user.Email = u.Email
+	return nil
+}
+
+// createSession registers the session of the simple and the oidc login and sets its cookie.
+func createSession(c *gin.Context, user *simple.JWTUser, identity simple.JWTUser, provider string) error {
+	session, err := Sessions.Create(identity.Name, provider, time.Now().Add(simple.SessionMaxAge))
+	if err != nil {
+		return err
+	}
+	identity.ID = session.ID
+	cookie, err := simple.Encode(identity)
+	if err != nil {
+		return err
+	}
+	createCookie(c, user, Config.CookieName, cookie)
+	return nil
+}
+
+type redirectAuth struct {
+	AuthProvider
+}
+
+func (a redirectAuth) IsCallback(c *gin.Context) bool {
+	return false
+}
+
+func (a redirectAuth) StartLogin(c *gin.Context, user *simple.JWTUser) {
+	log.Println("[NONE] readUser Config.UseRedirectAuth start")
+	startAuthRedirect(c)
+}
+
+// simpleAuth logs in the local accounts with a password and an optional TOTP code.
+type simpleAuth struct {
+	accounts *simple.AccountStore
+}
+
+type simpleLoginRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code"`
+}
+
+func (a simpleAuth) IsCallback(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/saml/")
+}
+
+func (a simpleAuth) StartLogin(c *gin.Context, user *simple.JWTUser) {
+	log.Println(debugHeader(user.Name), "load auth.html")
+	c.HTML(200, "auth.html", gin.H{
+		"title": "Login",
+	})
+}
+
+func (a simpleAuth) HandleCallback(c *gin.Context, user *simple.JWTUser) {
+	var req simpleLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Println(debugHeader(user.Name), "Catch ShouldBindJSON err >", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account, err := a.accounts.Authenticate(c.ClientIP(), req.Name, req.Password, req.Code)
+	if err != nil {
+		log.Println(debugHeader(req.Name), "simple login failed from", c.ClientIP(), ">", err)
+		status := http.StatusUnauthorized
+		if err == simple.ErrRateLimited {
+			status = http.StatusTooManyRequests
+		}
+		c.JSON(status, gin.H{"status": "failed", "error": err.Error()})
+		return
+	}
+	if err := createSession(c, user, simple.JWTUser{Name: account.Name, Domain: account.Domain, Email: account.Email}, "simple"); err != nil {
+		log.Println(debugHeader(account.Name), "simple session err >", err)
+		c.JSON(500, gin.H{"status": "failed"})
+		return
+	}
+	c.JSON(200, gin.H{"status": "success"})
+}
+
+func (a simpleAuth) ReadSession(c *gin.Context, user *simple.JWTUser) error {
+	return readSessionCookie(c, user)
+}
+
+func (a simpleAuth) Logout(c *gin.Context, user *simple.JWTUser) string {
+	deleteCookie(c, user, Config.CookieName)
+	return "/"
+}
+
+// samlAuth logs in with the crewjam samlsp middleware, the session is its jwt cookie.
+type samlAuth struct{}
+
+func (a samlAuth) IsCallback(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/saml/")
+}
+
+func (a samlAuth) StartLogin(c *gin.Context, user *simple.JWTUser) {
+	_, err := SAMLSP.Session.GetSession(c.Request)
+	log.Println(debugHeader(user.Name), "SAMLSP err >", err)
+	if err == samlsp.ErrNoSession {
+		if strings.HasPrefix(c.Request.RequestURI, RuntimeVar.RedirectParameterWithPrefix) {
+			log.Println(debugHeader(user.Name), "SAMLSP HandleStartAuthFlow")
+			SAMLSP.HandleStartAuthFlow(c.Writer, c.Request)
+		} else {
+			startAuthRedirect(c)
+		}
+	}
+}
+
+func (a samlAuth) HandleCallback(c *gin.Context, user *simple.JWTUser) {
+	log.Println(debugHeader(user.Name), "SAMLSP handle /saml/")
+	SAMLSP.ServeHTTP(c.Writer, c.Request)
+}
+
+func (a samlAuth) ReadSession(c *gin.Context, user *simple.JWTUser) error {
+	log.Println("[NONE] readUser Config.UseSAMLAuth start")
+	session, err := SAMLSP.Session.GetSession(c.Request)
+	if err != nil {
+		return err
+	}
+	cookieSession, ok := session.(saml.JWTSessionClaims)
+	if !ok {
+		return errors.New("JWTSessionClaims cast error")
+	}
+	u := strings.Split(cookieSession.StandardClaims.Subject, "\\")
+	user.ID = cookieSession.StandardClaims.Id
+	user.Name = strings.ToLower(saml.Pop(&u))
+	user.Domain = strings.ToLower(saml.Pop(&u))
+	user.Email = strings.ToLower(cookieSession.Attributes.Get("emailaddress"))
+	return nil
+}
+
+func (a samlAuth) Logout(c *gin.Context, user *simple.JWTUser) string {
+	if err := SAMLSP.Session.DeleteSession(c.Writer, c.Request); err != nil {
+		log.Println(debugHeader(user.Name), "SAMLSP DeleteSession err >", err)
+	}
+	return "/"
+}
+
+// oidcAuth logs in with the authorization code flow and PKCE, the session is the cookie of
+// the simple login after the id token is verified.
+type oidcAuth struct {
+	provider *oidc.Provider
+}
+
+func (a oidcAuth) IsCallback(c *gin.Context) bool {
+	return c.Request.URL.Path == a.provider.CallbackPath()
+}
+
+// oidcStateCookie binds the state of a login to the browser which started it, the callback
+// of another browser is rejected.
+func oidcStateCookie() string {
+	return Config.CookieName + "-oidc-state"
+}
+
+func (a oidcAuth) StartLogin(c *gin.Context, user *simple.JWTUser) {
+	authUrl, state, err := a.provider.AuthCodeURL(c.Request.Context(), returnUrl(c))
+	if err != nil {
+		log.Println(debugHeader(user.Name), "OIDC can not start the login >", err)
+		c.String(http.StatusBadGateway, "The identity provider is not available.")
+		return
+	}
+	log.Println(debugHeader(user.Name), "OIDC start the login")
+	// the callback can be on another host of the cookie domain, lax sends it on the redirect of the IdP
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie(), state, int(oidc.LoginTimeout.Seconds()), "/", cookieDomain(user.Host), c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, authUrl)
+}
+
+func (a oidcAuth) HandleCallback(c *gin.Context, user *simple.JWTUser) {
+	state, _ := c.Cookie(oidcStateCookie())
+	deleteCookie(c, user, oidcStateCookie())
+	if idpErr := c.Query("error"); idpErr != "" {
+		log.Println(debugHeader(user.Name), "OIDC login failed >", idpErr, c.Query("error_description"))
+		c.String(http.StatusUnauthorized, "Login failed: "+idpErr)
+		return
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		log.Println(debugHeader(user.Name), "OIDC callback without the state cookie of the login")
+		c.String(http.StatusUnauthorized, "Login failed.")
+		return
+	}
+	identity, returnTo, err := a.provider.Exchange(c.Request.Context(), state, c.Query("code"))
+	if err != nil {
+		log.Println(debugHeader(user.Name), "OIDC callback err >", err)
+		c.String(http.StatusUnauthorized, "Login failed.")
+		return
+	}
+	if err := createSession(c, user, simple.JWTUser{Name: identity.Name, Domain: identity.Domain, Email: identity.Email}, "oidc"); err != nil {
+		log.Println(debugHeader(identity.Name), "OIDC session err >", err)
+		c.String(http.StatusInternalServerError, "Login failed.")
+		return
+	}
+	if !isOwnUrl(returnTo, c.Request.Host) {
+		returnTo = "/"
+	}
+	log.Println(debugHeader(identity.Name), "OIDC login done, redirect to:", returnTo)
+	c.Redirect(http.StatusFound, returnTo)
+}
+
+func (a oidcAuth) ReadSession(c *gin.Context, user *simple.JWTUser) error {
+	return readSessionCookie(c, user)
+}
+
+func (a oidcAuth) Logout(c *gin.Context, user *simple.JWTUser) string {
+	deleteCookie(c, user, Config.CookieName)
+	if endSession := a.provider.EndSessionURL(c.Request.Context(), ""); endSession != "" {
+		return endSession
+	}
+	return "/"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ui3o/codebox/reverseproxy/keys"
+	"github.com/ui3o/codebox/reverseproxy/simple"
+)
+
+// keyManagerInit loads the signing keys of the sessions, the simple, the oidc and the saml
+// sessions are signed by them.
+func keyManagerInit() {
+	grace := time.Duration(Config.KeyGracePeriod) * time.Second
+	KeyManager = keys.NewManager(Config.KeysDir, time.Duration(Config.KeyRotationInterval)*time.Second, grace)
+	if err := KeyManager.Refresh(); err != nil {
+		log.Fatal("[INIT] Failed to load the session keys from ", Config.KeysDir, ": ", err)
+	}
+	KeyManager.Start()
+	if Config.KeyRotationInterval > 0 && (grace < time.Duration(Config.CookieAge)*time.Second ||
+		(Config.UseSAMLAuth && grace < time.Duration(Config.SAML.SessionMaxAge)*time.Second)) {
+		log.Println("[INIT] key_grace_period is shorter than the session age, the sessions end at the rotation")
+	}
+	simple.SetKeyManager(KeyManager)
+	Config.SAML.Keys = KeyManager
+}
+
+// serveJWKS publishes the public keys, the other addons verify the session cookies with them.
+func serveJWKS(c *gin.Context) {
+	jwks, err := KeyManager.JWKS()
+	if err != nil {
+		log.Println("[KEYS] JWKS err >", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "max-age=60")
+	c.Data(http.StatusOK, "application/json", jwks)
+}
+
+func keysUsage() {
+	fmt.Println("Usage: reverseproxy keys list")
+	fmt.Println("       reverseproxy keys rotate")
+}
+
+// keysCommand lists the session keys or rotates them now, like a new first line of the key file
+// before the key manager, it returns the exit code. The running proxies sign with the new key
+// after their next refresh.
+func keysCommand(args []string) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 1
+	}
+	m := keys.NewManager(Config.KeysDir, time.Duration(Config.KeyRotationInterval)*time.Second, time.Duration(Config.KeyGracePeriod)*time.Second)
+	var err error
+	switch args[0] {
+	case "list":
+		err = m.Refresh()
+	case "rotate":
+		err = m.Rotate()
+	default:
+		keysUsage()
+		return 1
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	fmt.Printf("%-28s %-6s %-19s %s\n", "Id", "Alg", "Created", "Expires")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, key := range m.Keys() {
+		expires := "-"
+		if !key.Expires.IsZero() {
+			expires = key.Expires.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-28s %-6s %-19s %s\n", key.ID, key.Method.Alg(), key.Created.Local().Format("2006-01-02 15:04:05"), expires)
+	}
+	return 0
+}
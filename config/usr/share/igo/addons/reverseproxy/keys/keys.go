@@ -0,0 +1,340 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// createdHeader is the pem header of the creation time, the file time is used without it
+	createdHeader = "Created"
+	// refreshInterval is the period of the reload of the keys dir, the other proxies can rotate too
+	refreshInterval = time.Minute
+)
+
+// Key is a signing key of the sessions, the kid is its file name without the .pem.
+type Key struct {
+	ID      string
+	Signer  crypto.Signer
+	Method  jwt.SigningMethod
+	Created time.Time
+	// Expires is the end of the grace window after a newer key took over, zero while it signs
+	Expires time.Time
+	path    string
+}
+
+// Manager signs with the newest key of the dir and accepts the previous keys for the grace
+// window after the next key was created. With a rotation interval it generates a new key if the
+// newest one is older and removes the keys after their grace window.
+type Manager struct {
+	Dir            string
+	RotateInterval time.Duration
+	Grace          time.Duration
+	Now            func() time.Time
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+func NewManager(dir string, rotateInterval, grace time.Duration) *Manager {
+	return &Manager{Dir: dir, RotateInterval: rotateInterval, Grace: grace}
+}
+
+func (m *Manager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+func signingMethod(signer crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	}
+	return nil, errors.New("only rsa and ecdsa keys are supported")
+}
+
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block")
+	}
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("not a signing key")
+	}
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem"), Signer: signer, path: path}
+	if key.Method, err = signingMethod(signer); err != nil {
+		return nil, err
+	}
+	if key.Created, err = time.Parse(time.RFC3339, block.Headers[createdHeader]); err != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		key.Created = info.ModTime()
+	}
+	return key, nil
+}
+
+// generate writes a new ES256 key to the dir.
+func (m *Manager) generate(now time.Time) (*Key, error) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	// the pem header has the time in seconds
+	now = now.UTC().Truncate(time.Second)
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	id := now.Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+	block := &pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{createdHeader: now.Format(time.RFC3339)}, Bytes: der}
+	tmp, err := os.CreateTemp(m.Dir, ".key-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := pem.Encode(tmp, block); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(m.Dir, id+".pem")
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return &Key{ID: id, Signer: signer, Method: jwt.SigningMethodES256, Created: now, path: path}, nil
+}
+
+// Refresh loads the keys of the dir, it generates the first key and the rotated ones. The dir is
+// locked, the proxies which share it do not rotate at the same time.
+func (m *Manager) Refresh() error {
+	return m.refresh(false)
+}
+
+// Rotate generates a new signing key before the rotation interval, the previous key is accepted
+// for the grace window. The other proxies of the dir sign with it after their next refresh.
+func (m *Manager) Rotate() error {
+	return m.refresh(true)
+}
+
+func (m *Manager) refresh(rotate bool) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(m.Dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	paths, err := filepath.Glob(filepath.Join(m.Dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	var keys []*Key
+	for _, path := range paths {
+		if key, err := readKey(path); err == nil {
+			keys = append(keys, key)
+		} else {
+			log.Println("[KEYS] Skip", path, ">", err)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.After(keys[j].Created) })
+	now := m.now()
+	if rotate || len(keys) == 0 || (m.RotateInterval > 0 && now.Sub(keys[0].Created) >= m.RotateInterval) {
+		created := now
+		if len(keys) > 0 && !created.Truncate(time.Second).After(keys[0].Created) {
+			// the newest key is found by its creation in seconds, a rotation in its second follows it
+			created = keys[0].Created.Add(time.Second)
+		}
+		key, err := m.generate(created)
+		if err != nil {
+			return fmt.Errorf("can not generate a key: %w", err)
+		}
+		log.Println("[KEYS] New signing key", key.ID)
+		keys = append([]*Key{key}, keys...)
+	}
+	valid := keys[:1]
+	for i := 1; i < len(keys); i++ {
+		if expires := keys[i-1].Created.Add(m.Grace); now.Before(expires) {
+			keys[i].Expires = expires
+			valid = append(valid, keys[i])
+		} else if m.RotateInterval > 0 {
+			log.Println("[KEYS] Remove the expired key", keys[i].ID)
+			os.Remove(keys[i].path)
+		}
+	}
+	m.mu.Lock()
+	m.keys = valid
+	m.mu.Unlock()
+	return nil
+}
+
+// Start refreshes the keys in the background.
+func (m *Manager) Start() {
+	go func() {
+		for {
+			time.Sleep(refreshInterval)
+			if err := m.Refresh(); err != nil {
+				log.Println("[KEYS] Refresh failed, the old keys are kept >", err)
+			}
+		}
+	}()
+}
+
+// Sign signs the claims with the newest key, the kid header names the key.
+func (m *Manager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return "", errors.New("no signing key is loaded")
+	}
+	key := m.keys[0]
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Signer)
+}
+
+// Keyfunc returns the public key of the kid of the token for jwt.Parse.
+func (m *Manager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.keys {
+		if key.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("the key %s is not for %s", kid, token.Method.Alg())
+		}
+		if !key.Expires.IsZero() && !m.now().Before(key.Expires) {
+			return nil, fmt.Errorf("the key %s is expired", kid)
+		}
+		return key.Signer.Public(), nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// Methods are the algorithms of the loaded keys for jwt.Parser.ValidMethods.
+func (m *Manager) Methods() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var methods []string
+	for _, key := range m.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+// Keys returns the loaded keys, the signing key is the first.
+func (m *Manager) Keys() []Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func encodeInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// JWKS returns the public keys as a json web key set, the other addons verify the sessions with it.
+func (m *Manager) JWKS() ([]byte, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: []jsonWebKey{}}
+	for _, key := range m.Keys() {
+		jwk := jsonWebKey{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Signer.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeInt(public.N, 0)
+			jwk.E = encodeInt(big.NewInt(int64(public.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = encodeInt(public.X, size)
+			jwk.Y = encodeInt(public.Y, size)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return json.Marshal(set)
+}
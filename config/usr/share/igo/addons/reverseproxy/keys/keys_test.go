@@ -0,0 +1,156 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newTestManager(t *testing.T, now *time.Time) *Manager {
+	m := NewManager(t.TempDir(), time.Hour, 2*time.Hour)
+	m.Now = func() time.Time { return *now }
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func verify(m *Manager, token string) error {
+	parser := jwt.Parser{ValidMethods: m.Methods()}
+	_, err := parser.ParseWithClaims(token, &jwt.RegisteredClaims{}, m.Keyfunc)
+	return err
+}
+
+func TestRotation(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	m := newTestManager(t, &now)
+	first := m.Keys()
+	if len(first) != 1 {
+		t.Fatalf("the first key should be generated, got %d keys", len(first))
+	}
+	token, err := m.Sign(jwt.RegisteredClaims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, &jwt.RegisteredClaims{})
+	if parsed.Header["kid"] != first[0].ID || parsed.Method.Alg() != "ES256" {
+		t.Errorf("the token should be ES256 with the kid %s, got %v", first[0].ID, parsed.Header)
+	}
+
+	now = now.Add(30 * time.Minute)
+	m.Refresh()
+	if keys := m.Keys(); len(keys) != 1 || keys[0].ID != first[0].ID {
+		t.Error("the key should not rotate before the interval")
+	}
+
+	now = now.Add(time.Hour)
+	m.Refresh()
+	keys := m.Keys()
+	if len(keys) != 2 || keys[1].ID != first[0].ID || !keys[1].Expires.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("the new key should sign and the old one should be in its grace window, got %+v", keys)
+	}
+	if err := verify(m, token); err != nil {
+		t.Error("the token of the previous key should be accepted:", err)
+	}
+	if newToken, _ := m.Sign(jwt.RegisteredClaims{}); verify(m, newToken) != nil {
+		t.Error("the token of the new key should be accepted")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := verify(m, token); err == nil {
+		t.Error("the token of the previous key should be rejected after the grace window")
+	}
+	m.Refresh()
+	if _, err := os.Stat(filepath.Join(m.Dir, first[0].ID+".pem")); !os.IsNotExist(err) {
+		t.Error("the expired key file should be removed")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	now := time.Now()
+	m := newTestManager(t, &now)
+	token, _ := m.Sign(jwt.RegisteredClaims{})
+	if err := m.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	keys := m.Keys()
+	if len(keys) != 2 || !keys[1].Expires.Equal(keys[0].Created.Add(2*time.Hour)) {
+		t.Fatalf("the rotation should sign with a new key before the interval, got %+v", keys)
+	}
+	m.Refresh()
+	if reloaded := m.Keys(); len(reloaded) != 2 || reloaded[0].ID != keys[0].ID {
+		t.Error("the rotated key should sign after the reload of the dir")
+	}
+	if err := verify(m, token); err != nil {
+		t.Error("the token of the previous key should be accepted:", err)
+	}
+}
+
+func TestSharedDir(t *testing.T) {
+	now := time.Now()
+	m := newTestManager(t, &now)
+	other := NewManager(m.Dir, time.Hour, 2*time.Hour)
+	other.Now = m.Now
+	if err := other.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := m.Sign(jwt.RegisteredClaims{})
+	if err := verify(other, token); err != nil {
+		t.Error("the proxies of the same dir should share the keys:", err)
+	}
+	if len(other.Keys()) != 1 {
+		t.Error("the second proxy should not generate a key")
+	}
+}
+
+func TestLoadedKeyAndJWKS(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := os.WriteFile(filepath.Join(dir, "operator.pem"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("no key"), 0600)
+	m := NewManager(dir, 0, time.Hour)
+	m.Now = func() time.Time { return now }
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	keys := m.Keys()
+	if len(keys) != 1 || keys[0].ID != "operator" || keys[0].Method.Alg() != "RS256" {
+		t.Fatalf("the operator key should sign, got %+v", keys)
+	}
+	token, _ := m.Sign(jwt.RegisteredClaims{})
+	if err := verify(m, token); err != nil {
+		t.Error(err)
+	}
+
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	data, err = m.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0]["kid"] != "operator" || set.Keys[0]["kty"] != "RSA" || set.Keys[0]["e"] != "AQAB" {
+		t.Errorf("unexpected jwks %s", data)
+	}
+	if _, ok := set.Keys[0]["d"]; ok {
+		t.Error("the jwks should not have the private key")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 
 	"strings"
@@ -14,22 +15,28 @@ import (
 	"github.com/crewjam/saml/samlsp"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/ui3o/codebox/reverseproxy/keys"
+	"github.com/ui3o/codebox/reverseproxy/oidc"
+	"github.com/ui3o/codebox/reverseproxy/routes"
 	"github.com/ui3o/codebox/reverseproxy/saml"
-	"github.com/ui3o/codebox/reverseproxy/simple"
+	"github.com/ui3o/codebox/reverseproxy/sessions"
 	"go.senan.xyz/flagconf"
 )
 
 var (
-	SAMLSP             *samlsp.Middleware
-	CreateUserChannel  = make(chan *gin.Context)
-	AllRestEndpoint    = make(map[string]*AllRestEndpointDefinition)
-	AllGlobalEndpoints = make(map[string]*RestEndpointDefinition)
-	AllRoutesRegexp    = make(map[string]*RouteMatch)
-	CustomNameRegexp   = regexp.MustCompile(`(^[\-a-zA-Z]*)([0-9]+)(\..*)`)
-	Config             = RuntimeConfig{
+	SAMLSP            *samlsp.Middleware
+	KeyManager        *keys.Manager
+	Sessions          *sessions.Registry
+	CreateUserChannel = make(chan *gin.Context)
+	Routes            = routes.NewRegistry()
+	AllRoutesRegexp   = make(map[string]*RouteMatch)
+	CustomNameRegexp  = regexp.MustCompile(`(^[\-a-zA-Z]*)([0-9]+)(\..*)`)
+	Config            = RuntimeConfig{
 		SAML: &saml.SAMLConf,
+		OIDC: &oidc.OIDCConf,
 	}
 	RuntimeVar = RuntimeVars{}
+	Auth       AuthProvider
 )
 
 type StringSet []string
@@ -58,6 +65,8 @@ const REQ_HEADER_PROXY_USER_NAME = "req-header-proxy-user-name"
 const REQ_HEADER_PROXY_USER_EMAIL = "req-header-proxy-user-email"
 const REQ_HEADER_ROUTE_ID = "req-header-route-id"
 const REQ_HEADER_PORT_NUMBER = "req-header-port-number"
+const JWKS_PATH = "/.well-known/jwks.json"
+const LOGOUT_PATH = "/logout"
 
 func debugHeader(username string) string {
 	return fmt.Sprintf("[%s] ", username)
@@ -68,6 +77,7 @@ func init() {
 
 	flag.BoolVar(&Config.UseSAMLAuth, "saml", false, "Use saml auth(default is dummy)")
 	flag.BoolVar(&Config.UseRedirectAuth, "use_redirect_auth", false, "Use redirect auth")
+	flag.BoolVar(&Config.UseOIDCAuth, "oidc", false, "Use OpenID Connect auth")
 	flag.BoolVar(&Config.ReplaceSubdomainToCookie, "replace_subdomain_to_cookie", false, "Use saml auth(default is dummy)")
 
 	flag.IntVar(&Config.Port, "port", 10111, "Port(10111)")
@@ -94,6 +104,15 @@ func init() {
 	flag.StringVar(&Config.CDNRootPath, "cdn_root_path", "./", "")
 	flag.StringVar(&Config.UserWhitelistConfigPath, "user_whitelist_config_path", "./whitelist.json", "")
 
+	flag.StringVar(&Config.AccountsPath, "accounts_path", "./accounts.json", "Local accounts of the simple auth, see: reverseproxy account")
+	flag.IntVar(&Config.MaxFailedLogins, "max_failed_logins", 5, "Failed logins before the account is locked, 0 never locks")
+	flag.IntVar(&Config.LockoutDuration, "lockout_duration", 900, "Lock of the account in sec after the failed logins")
+	flag.IntVar(&Config.MaxFailedLoginsPerAddr, "max_failed_logins_per_addr", 20, "Failed logins of a client address before its logins are rejected for the lockout duration, 0 never limits")
+	flag.StringVar(&Config.SessionsPath, "sessions_path", "/var/lib/igo/reverseproxy/sessions.json", "Registry of the sessions, the proxies and the admin addon share it, only the owner can write its dir, see: reverseproxy sessions")
+	flag.StringVar(&Config.KeysDir, "keys_dir", "./session_keys", "Signing keys of the sessions as pem files, the proxies which share the sessions share the dir")
+	flag.IntVar(&Config.KeyRotationInterval, "key_rotation_interval", 7*24*3600, "A new signing key is generated after it in sec, 0 never rotates")
+	flag.IntVar(&Config.KeyGracePeriod, "key_grace_period", 24*3600, "The previous key is accepted in sec after the rotation, longer than the session age")
+
 	flag.StringVar(&Config.SAML.IdpMetadataURL, "saml_idpmetadataurl", "", "")
 	flag.StringVar(&Config.SAML.EntityID, "saml_entityid", "", "")
 	flag.StringVar(&Config.SAML.CookieName, "saml_cookiename", "", "")
@@ -102,9 +121,29 @@ func init() {
 	flag.StringVar(&Config.SAML.KeyFile, "saml_keyfile", "", "")
 	flag.StringVar(&Config.SAML.Domain, "saml_domain", "", "")
 	flag.StringVar(&Config.SAML.AuthnNameIDFormat, "saml_authnnameidformat", "", "")
+	flag.IntVar(&Config.SAML.SessionMaxAge, "saml_session_max_age", 8*3600, "saml session age in sec")
+
+	flag.StringVar(&Config.OIDC.Issuer, "oidc_issuer", "", "Issuer url, the metadata is read from its .well-known/openid-configuration")
+	flag.StringVar(&Config.OIDC.ClientID, "oidc_client_id", "", "")
+	flag.StringVar(&Config.OIDC.ClientSecret, "oidc_client_secret", "", "Empty for a public client, the PKCE protects the code")
+	flag.StringVar(&Config.OIDC.RedirectURL, "oidc_redirect_url", "", "Callback url registered at the IdP, e.g. https://auth.example.com/oidc/callback")
+	flag.StringVar(&Config.OIDC.Scopes, "oidc_scopes", "openid profile email", "")
+	flag.StringVar(&Config.OIDC.UsernameClaim, "oidc_username_claim", "preferred_username", "")
+	flag.Func("oidc_allowed_domains", "Comma separated domains of the DOMAIN\\name and name@domain usernames which can log in", func(v string) error {
+		for _, domain := range strings.Split(v, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				Config.OIDC.AllowedDomains = append(Config.OIDC.AllowedDomains, domain)
+			}
+		}
+		return nil
+	})
 
 	flag.Parse()
 	flagconf.ParseEnv()
+	// the commands like account do not start the proxy
+	if flag.NArg() > 0 {
+		return
+	}
 
 	if len(namedPortList) > 0 {
 		Config.NamedPortList = namedPortList
@@ -130,6 +169,9 @@ func init() {
 
 	log.Println("[INIT] TemplateRootPath", Config.TemplateRootPath)
 
+	keyManagerInit()
+	Sessions = newSessionRegistry()
+	Config.SAML.Sessions = Sessions
 	if Config.UseSAMLAuth {
 		if saml, err := saml.InitSAML(); err == nil {
 			SAMLSP = saml
@@ -137,6 +179,8 @@ func init() {
 			log.Println("[INIT] Error Init SAMLSP is >", err)
 		}
 	}
+	Auth = newAuthProvider()
+	routeEventLoggerInit()
 	userCreatorInit()
 	userContainerRemoverInit()
 	userWhitelistWatcherInit()
@@ -153,6 +197,20 @@ func startAuthRedirect(c *gin.Context) {
 }
 
 func main() {
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "account":
+			os.Exit(accountCommand(flag.Args()[1:]))
+		case "sessions":
+			os.Exit(sessionsCommand(flag.Args()[1:]))
+		case "revoke":
+			os.Exit(revokeCommand(flag.Args()[1:]))
+		case "keys":
+			os.Exit(keysCommand(flag.Args()[1:]))
+		}
+		fmt.Println("Unknown command:", flag.Arg(0))
+		os.Exit(1)
+	}
 	for _, portName := range Config.NamedPortList {
 		portName = strings.TrimSpace(portName)
 		AllRoutesRegexp[portName] = &RouteMatch{
@@ -187,6 +245,14 @@ func main() {
 			poster(c)
 			return
 		}
+		if c.Request.URL.Path == JWKS_PATH {
+			serveJWKS(c)
+			return
+		}
+		if c.Request.URL.Path == LOGOUT_PATH {
+			logout(c)
+			return
+		}
 
 		accept := c.Request.Header.Get("Accept")
 		documentRequest := false
@@ -201,55 +267,10 @@ func main() {
 
 		if user := readUser(c); !user.IsValid {
 			log.Println(debugHeader(user.Name), "Handle anonymous user")
-			if Config.UseRedirectAuth {
-				log.Println("[NONE] readUser Config.UseRedirectAuth start")
-				startAuthRedirect(c)
-			} else if Config.UseSAMLAuth {
-				if strings.HasPrefix(c.Request.URL.Path, "/saml/") {
-					log.Println(debugHeader(user.Name), "SAMLSP handle /saml/")
-					SAMLSP.ServeHTTP(c.Writer, c.Request)
-				} else {
-					_, err := SAMLSP.Session.GetSession(c.Request)
-					log.Println(debugHeader(user.Name), "SAMLSP err >", err)
-					if err == samlsp.ErrNoSession {
-						if strings.HasPrefix(c.Request.RequestURI, RuntimeVar.RedirectParameterWithPrefix) {
-							log.Println(debugHeader(user.Name), "SAMLSP HandleStartAuthFlow")
-							SAMLSP.HandleStartAuthFlow(c.Writer, c.Request)
-						} else {
-							startAuthRedirect(c)
-						}
-					}
-				}
+			if Auth.IsCallback(c) {
+				Auth.HandleCallback(c, user)
 			} else {
-				if strings.HasPrefix(c.Request.URL.Path, "/saml/") {
-					var req simple.JWTUser
-					if err := c.ShouldBindJSON(&req); err != nil {
-						log.Println(debugHeader(user.Name), "Catch ShouldBindJSON err >", err)
-						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-						return
-					}
-					cookie, err := simple.Encode(req)
-					if err == nil {
-						createCookie(c, user, Config.CookieName, cookie)
-						c.JSON(200,
-							gin.H{
-								"status": "success",
-							})
-						return
-					} else {
-						c.JSON(500,
-							gin.H{
-								"status": "failed",
-							})
-						return
-					}
-				} else {
-					log.Println(debugHeader(user.Name), "load auth.html")
-					c.HTML(200, "auth.html", gin.H{
-						"title": "Welcome to Gin",
-					})
-					return
-				}
+				Auth.StartLogin(c, user)
 			}
 		} else {
 			if len(Config.UserWhiteList[user.Name]) > 0 {
@@ -260,6 +281,10 @@ func main() {
 					if err != nil {
 						log.Println(debugHeader(user.Name), "can not QueryUnescape the", Config.RedirectParameter)
 					}
+					if !isOwnUrl(query, c.Request.Host) {
+						log.Println(debugHeader(user.Name), "redirect to a foreign host is denied:", query)
+						query = "/"
+					}
 					log.Println(debugHeader(user.Name), "start redirect to:", query)
 					c.Redirect(http.StatusFound, query)
 				} else {
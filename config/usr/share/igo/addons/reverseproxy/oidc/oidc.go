@@ -0,0 +1,445 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// LoginTimeout is the time the user has to finish the login at the IdP
+	LoginTimeout = 10 * time.Minute
+	// maxPendingLogins limits the memory the anonymous requests can allocate
+	maxPendingLogins = 10000
+	// keysRefreshInterval is the minimum time between two fetches of the jwks for an unknown kid
+	keysRefreshInterval = time.Minute
+)
+
+var (
+	OIDCConf = OIDCConfig{}
+)
+
+type OIDCConfig struct {
+	// Issuer is the url of the IdP, the metadata is read from its .well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string `json:"-"`
+	// RedirectURL is the callback of the proxy registered at the IdP
+	RedirectURL   string
+	Scopes        string
+	UsernameClaim string
+	// AllowedDomains are the domains of the DOMAIN\name and name@domain usernames which can
+	// log in, the name alone is the user. A username with another domain is rejected, so the
+	// users of two domains can not log in as the same user.
+	AllowedDomains []string
+}
+
+// Identity is the user of a verified id token.
+type Identity struct {
+	Subject string
+	Name    string
+	Domain  string
+	Email   string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	returnTo string
+	expires  time.Time
+}
+
+// Provider runs the authorization code flow with PKCE against the IdP of the issuer.
+type Provider struct {
+	Conf   OIDCConfig
+	Client *http.Client
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	pending     map[string]pendingLogin
+}
+
+func NewProvider(conf OIDCConfig) *Provider {
+	if conf.Scopes == "" {
+		conf.Scopes = "openid profile email"
+	}
+	if conf.UsernameClaim == "" {
+		conf.UsernameClaim = "preferred_username"
+	}
+	return &Provider{
+		Conf:    conf,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]pendingLogin),
+	}
+}
+
+// CallbackPath is the path of the redirect url, the proxy finishes the login on it.
+func (p *Provider) CallbackPath() string {
+	if u, err := url.Parse(p.Conf.RedirectURL); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/oidc/callback"
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p *Provider) getJSON(ctx context.Context, uri string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover reads the metadata of the issuer on the first use, the IdP can be down when the proxy starts.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	issuer := strings.TrimSuffix(p.Conf.Issuer, "/")
+	meta = &metadata{}
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("the metadata is for the issuer %q, not %q", meta.Issuer, p.Conf.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JwksURI == "" {
+		return nil, errors.New("the metadata has no authorization, token or jwks endpoint")
+	}
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+	return meta, nil
+}
+
+// AuthCodeURL starts a login, the user is sent to returnTo after the callback. The state has
+// to be bound to the browser, the callback is accepted only from the browser which started
+// the login.
+func (p *Provider) AuthCodeURL(ctx context.Context, returnTo string) (string, string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, login := randomString(), pendingLogin{
+		verifier: randomString(),
+		nonce:    randomString(),
+		returnTo: returnTo,
+		expires:  time.Now().Add(LoginTimeout),
+	}
+	p.mu.Lock()
+	if len(p.pending) >= maxPendingLogins {
+		for s, l := range p.pending {
+			if time.Now().After(l.expires) {
+				delete(p.pending, s)
+			}
+		}
+	}
+	if len(p.pending) >= maxPendingLogins {
+		p.mu.Unlock()
+		return "", "", errors.New("too many pending logins")
+	}
+	p.pending[state] = login
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Conf.ClientID)
+	v.Set("redirect_uri", p.Conf.RedirectURL)
+	v.Set("scope", p.Conf.Scopes)
+	v.Set("state", state)
+	v.Set("nonce", login.nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), state, nil
+}
+
+// Exchange finishes the login of the state, it returns the user of the verified id token
+// and the url the login was started for.
+func (p *Provider) Exchange(ctx context.Context, state, code string) (Identity, string, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return Identity{}, "", errors.New("unknown or expired login state")
+	}
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Conf.RedirectURL)
+	form.Set("code_verifier", login.verifier)
+	form.Set("client_id", p.Conf.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.Conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Conf.ClientID), url.QueryEscape(p.Conf.ClientSecret))
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return Identity{}, "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return Identity{}, "", fmt.Errorf("can not read the token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return Identity{}, "", fmt.Errorf("token request failed: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	claims, err := p.verifyIDToken(ctx, meta, token.IDToken, login.nonce)
+	if err != nil {
+		return Identity{}, "", err
+	}
+	identity, err := p.identity(claims)
+	if err != nil {
+		return Identity{}, "", err
+	}
+	return identity, login.returnTo, nil
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, meta *metadata, raw string, nonce string) (jwt.MapClaims, error) {
+	parser := jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, meta, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if !claims.VerifyIssuer(meta.Issuer, true) {
+		return nil, fmt.Errorf("the id token is not issued by %s", meta.Issuer)
+	}
+	if !claims.VerifyAudience(p.Conf.ClientID, true) {
+		return nil, fmt.Errorf("the id token is not issued for %s", p.Conf.ClientID)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("the id token has no expiry")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("the nonce of the id token does not match")
+	}
+	return claims, nil
+}
+
+// publicKey returns the key of the kid, the jwks is fetched again for an unknown kid
+// because the IdP can rotate its keys.
+func (p *Provider) publicKey(ctx context.Context, meta *metadata, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	refresh := !ok && time.Since(p.keysFetched) > keysRefreshInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !refresh {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	keys, err := p.fetchKeys(ctx, meta.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.keys, p.keysFetched = keys, time.Now()
+	p.mu.Unlock()
+	if key, ok = keys[kid]; !ok && kid == "" && len(keys) == 1 {
+		// a token without kid is valid if the IdP has only one key
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, uri string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, uri, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// identity maps the claims to the user, a DOMAIN\name or name@domain username is split like
+// the subject of a SAML session. The domain has to be allowed.
+func (p *Provider) identity(claims jwt.MapClaims) (Identity, error) {
+	id := Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	username, _ := claims[p.Conf.UsernameClaim].(string)
+	if username == "" {
+		username = id.Subject
+	}
+	if domain, name, ok := strings.Cut(username, "\\"); ok {
+		id.Domain, id.Name = domain, name
+	} else if name, domain, ok := strings.Cut(username, "@"); ok {
+		id.Domain, id.Name = domain, name
+	} else {
+		id.Name = username
+	}
+	id.Name, id.Domain, id.Email = strings.ToLower(id.Name), strings.ToLower(id.Domain), strings.ToLower(id.Email)
+	if id.Name == "" {
+		return Identity{}, errors.New("the id token has no username")
+	}
+	if id.Domain != "" && !p.isAllowedDomain(id.Domain) {
+		return Identity{}, fmt.Errorf("the domain %q of %s is not allowed", id.Domain, username)
+	}
+	return id, nil
+}
+
+func (p *Provider) isAllowedDomain(domain string) bool {
+	for _, allowed := range p.Conf.AllowedDomains {
+		if strings.EqualFold(strings.TrimSpace(allowed), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// EndSessionURL returns the logout url of the IdP, it is empty if the IdP does not have one.
+func (p *Provider) EndSessionURL(ctx context.Context, postLogoutRedirect string) string {
+	meta, err := p.discover(ctx)
+	if err != nil || meta.EndSessionEndpoint == "" {
+		return ""
+	}
+	v := url.Values{}
+	v.Set("client_id", p.Conf.ClientID)
+	if postLogoutRedirect != "" {
+		v.Set("post_logout_redirect_uri", postLogoutRedirect)
+	}
+	sep := "?"
+	if strings.Contains(meta.EndSessionEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.EndSessionEndpoint + sep + v.Encode()
+}
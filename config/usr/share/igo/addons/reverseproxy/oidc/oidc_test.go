@@ -0,0 +1,164 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mockIdP issues an id token for the code of the last authorization if the PKCE verifier matches.
+type mockIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+			"end_session_endpoint":   idp.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":                idp.server.URL,
+			"aud":                "proxy",
+			"sub":                "u-1",
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"nonce":              idp.nonce,
+			"preferred_username": "CORP\\Alice",
+			"email":              "Alice@Example.com",
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		signed, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize is the login of the user at the IdP, it returns the state of the callback.
+func (idp *mockIdP) authorize(t *testing.T, authUrl string) string {
+	u, err := url.Parse(authUrl)
+	if err != nil || !strings.HasPrefix(authUrl, idp.server.URL+"/authorize?") {
+		t.Fatal("unexpected authorization url:", authUrl)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "proxy" || q.Get("redirect_uri") != "https://auth.example.com/oidc/callback" {
+		t.Fatal("unexpected authorization request:", q)
+	}
+	idp.challenge, idp.nonce = q.Get("code_challenge"), q.Get("nonce")
+	return q.Get("state")
+}
+
+func newTestProvider(idp *mockIdP) *Provider {
+	return NewProvider(OIDCConfig{Issuer: idp.server.URL, ClientID: "proxy", RedirectURL: "https://auth.example.com/oidc/callback",
+		AllowedDomains: []string{"CORP"}})
+}
+
+func TestLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+	if p.CallbackPath() != "/oidc/callback" {
+		t.Error("unexpected callback path:", p.CallbackPath())
+	}
+	authUrl, state, err := p.AuthCodeURL(context.Background(), "https://code.example.com/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idp.authorize(t, authUrl) != state {
+		t.Error("the state of the authorization url should be returned")
+	}
+	identity, returnTo, err := p.Exchange(context.Background(), state, "the-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != (Identity{Subject: "u-1", Name: "alice", Domain: "corp", Email: "alice@example.com"}) || returnTo != "https://code.example.com/x" {
+		t.Error("unexpected login:", identity, returnTo)
+	}
+	if _, _, err := p.Exchange(context.Background(), state, "the-code"); err == nil {
+		t.Error("a state can be used only once")
+	}
+	if !strings.HasPrefix(p.EndSessionURL(context.Background(), ""), idp.server.URL+"/logout?") {
+		t.Error("the end session url of the metadata should be used")
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+	for name, claims := range map[string]jwt.MapClaims{
+		"wrong audience": {"aud": "other"},
+		"wrong issuer":   {"iss": "https://evil.example.com"},
+		"wrong nonce":    {"nonce": "replayed"},
+		"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+		"other domain":   {"preferred_username": "alice@evil.example.com"},
+		"no username":    {"preferred_username": "@corp", "sub": ""},
+	} {
+		idp.claims = claims
+		authUrl, _, err := p.AuthCodeURL(context.Background(), "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := idp.authorize(t, authUrl)
+		if _, _, err := p.Exchange(context.Background(), state, "the-code"); err == nil {
+			t.Error("the id token should be rejected:", name)
+		}
+	}
+
+	idp.claims = nil
+	authUrl, _, _ := p.AuthCodeURL(context.Background(), "/")
+	state := idp.authorize(t, authUrl)
+	// the verifier of another login does not match the challenge
+	other, _, _ := p.AuthCodeURL(context.Background(), "/")
+	idp.authorize(t, other)
+	if _, _, err := p.Exchange(context.Background(), state, "the-code"); err == nil {
+		t.Error("the code should be rejected without the verifier of its challenge")
+	}
+	if _, _, err := p.Exchange(context.Background(), "unknown", "the-code"); err == nil {
+		t.Error("an unknown state should be rejected")
+	}
+}
@@ -2,18 +2,18 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"regexp"
 
-	"net/url"
 	"strings"
 
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/ui3o/codebox/reverseproxy/oidc"
+	"github.com/ui3o/codebox/reverseproxy/routes"
 	"github.com/ui3o/codebox/reverseproxy/saml"
 	"github.com/ui3o/codebox/reverseproxy/simple"
 )
@@ -24,10 +24,6 @@ const (
 	userCreationWaiter = "userCreationWaiter"
 )
 
-type AllRestEndpointDefinition struct {
-	Endpoints map[string]*RestEndpointDefinition
-	Hostname  string
-}
 type RuntimeConfig struct {
 	CookieName                  string
 	CookieAge                   int
@@ -44,12 +40,22 @@ type RuntimeConfig struct {
 	ReplaceSubdomainToCookie    bool
 	UseSAMLAuth                 bool
 	UseRedirectAuth             bool
+	UseOIDCAuth                 bool
 	RedirectParameter           string
 	RedirectUrl                 string
 	UserWhitelistConfigPath     string
 	UserWhiteList               map[string]string
+	AccountsPath                string
+	MaxFailedLogins             int
+	LockoutDuration             int
+	MaxFailedLoginsPerAddr      int
+	SessionsPath                string
+	KeysDir                     string
+	KeyRotationInterval         int
+	KeyGracePeriod              int
 	CDNRootPath                 string
 	SAML                        *saml.SAMLConfig
+	OIDC                        *oidc.OIDCConfig
 }
 
 type RouteMatch struct {
@@ -59,11 +65,8 @@ type RouteMatch struct {
 	PreHandler func(ep *RestEndpointDefinition, c *gin.Context)
 }
 
-type RestEndpointDefinition struct {
-	RouteId  string
-	UserName string
-	Remotes  map[string]*url.URL
-}
+// RestEndpointDefinition is a route of the registry, the request owns it.
+type RestEndpointDefinition routes.Endpoint
 
 type availableRemote struct {
 	current string
@@ -288,20 +291,6 @@ func (p *RestEndpointDefinition) tryNextProxyBackend(user *simple.JWTUser, curre
 	return false
 }
 
-func (p *RestEndpointDefinition) UnRegister(username string) {
-	delete(p.Remotes, username)
-}
-
-func (p *RestEndpointDefinition) Register(hostname, port, username string) {
-	uri := fmt.Sprintf("http://%s:%s", hostname, port)
-	if url, err := url.Parse(uri); err != nil {
-		panic(err)
-	} else {
-		p.Remotes[username] = url
-	}
-
-}
-
 func (p *RestEndpointDefinition) StartServeProxy(user *simple.JWTUser, c *gin.Context) {
 	ar := availableRemote{all: make(map[string]bool)}
 	index := 0
@@ -319,9 +308,9 @@ func (p *RestEndpointDefinition) StartServeProxy(user *simple.JWTUser, c *gin.Co
 }
 
 func HandleRequest(user *simple.JWTUser, c *gin.Context) {
-	if err := checkUserRouteId(c); err == nil {
+	if ep, err := checkUserRouteId(c); err == nil {
 		log.Println(debugHeader(user.Name), "handle logged in user and route", user.RouteId)
-		AllRestEndpoint[user.Name].Endpoints[user.RouteId].StartServeProxy(user, c)
+		ep.StartServeProxy(user, c)
 	} else {
 		c.Error(err)
 		c.Writer.WriteHeader(http.StatusInternalServerError)
@@ -329,9 +318,7 @@ func HandleRequest(user *simple.JWTUser, c *gin.Context) {
 	}
 }
 
-func createCookie(c *gin.Context, user *simple.JWTUser, cookieName, cookieData string) {
-	host := user.Host
-	log.Println(debugHeader(user.Name), "c.SetCookie >", cookieName)
+func cookieDomain(host string) string {
 	if conditions := strings.Split(host, ":"); len(conditions) > 0 {
 		host = conditions[0]
 	}
@@ -343,7 +330,17 @@ func createCookie(c *gin.Context, user *simple.JWTUser, cookieName, cookieData s
 		domain = "." + strings.Join(conditions, ".")
 		// parentDomain = strings.Join(conditions, ".")
 	}
-	c.SetCookie(cookieName, cookieData, Config.CookieAge, "/", domain, false, true)
+	return domain
+}
+
+func createCookie(c *gin.Context, user *simple.JWTUser, cookieName, cookieData string) {
+	log.Println(debugHeader(user.Name), "c.SetCookie >", cookieName)
+	c.SetCookie(cookieName, cookieData, Config.CookieAge, "/", cookieDomain(user.Host), false, true)
+}
+
+func deleteCookie(c *gin.Context, user *simple.JWTUser, cookieName string) {
+	log.Println(debugHeader(user.Name), "c.SetCookie delete >", cookieName)
+	c.SetCookie(cookieName, "", -1, "/", cookieDomain(user.Host), false, true)
 }
 
 func findRoute(user *simple.JWTUser, c *gin.Context) {
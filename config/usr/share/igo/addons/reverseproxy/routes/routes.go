@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	Added   = "added"
+	Removed = "removed"
+
+	globalPortFirst = 9000
+	globalPortLast  = 9999
+)
+
+// Endpoint is a route of a user, the Remotes are the backends by user name. It is built for
+// the lookup, the caller owns it.
+type Endpoint struct {
+	RouteId  string
+	UserName string
+	Remotes  map[string]*url.URL
+}
+
+// Event is a change of the registry.
+type Event struct {
+	Type     string
+	UserName string
+	RouteId  string
+	Remote   *url.URL
+}
+
+type route struct {
+	remote *url.URL
+	gen    uint64
+}
+
+type userRoutes struct {
+	hostname string
+	routes   map[string]route
+}
+
+// snapshot is never changed after it is published, the lookups read it without a lock.
+type snapshot struct {
+	users map[string]*userRoutes
+}
+
+// Registry has the routes of the running user containers. The writers copy the changed parts
+// and publish a new snapshot, the lookups of the requests do not wait for them.
+type Registry struct {
+	mu      sync.Mutex
+	gen     uint64
+	current atomic.Pointer[snapshot]
+	subs    map[chan Event]struct{}
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{subs: make(map[chan Event]struct{})}
+	r.current.Store(&snapshot{users: make(map[string]*userRoutes)})
+	return r
+}
+
+// IsGlobalRoute returns true for the global ports, they are served by the containers of all users.
+func IsGlobalRoute(routeId string) bool {
+	port, err := strconv.Atoi(routeId)
+	return err == nil && port >= globalPortFirst && port <= globalPortLast
+}
+
+func remoteURL(hostname, port string) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("http://%s:%s", hostname, port))
+}
+
+// Endpoint returns the route of the user or nil if the user has no such route. A global port
+// is routed to the containers of all users while the user has a running route.
+func (r *Registry) Endpoint(userName, routeId string) *Endpoint {
+	s := r.current.Load()
+	user := s.users[userName]
+	if user == nil {
+		return nil
+	}
+	if local, ok := user.routes[routeId]; ok {
+		return &Endpoint{RouteId: routeId, UserName: userName, Remotes: map[string]*url.URL{userName: local.remote}}
+	}
+	if !IsGlobalRoute(routeId) {
+		return nil
+	}
+	ep := &Endpoint{RouteId: routeId, UserName: userName, Remotes: make(map[string]*url.URL)}
+	for name, other := range s.users {
+		if remote, err := remoteURL(other.hostname, routeId); err == nil {
+			ep.Remotes[name] = remote
+		}
+	}
+	return ep
+}
+
+// Users returns the users with a running route.
+func (r *Registry) Users() []string {
+	s := r.current.Load()
+	users := make([]string, 0, len(s.users))
+	for name := range s.users {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Add registers the route of the container of the user, a route of the same id is replaced. It
+// returns the generation of the route for Remove.
+func (r *Registry) Add(userName, hostname, routeId, port string) (uint64, error) {
+	remote, err := remoteURL(hostname, port)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gen++
+	old := r.current.Load()
+	user := &userRoutes{hostname: hostname, routes: make(map[string]route)}
+	if prev := old.users[userName]; prev != nil {
+		for id, rt := range prev.routes {
+			user.routes[id] = rt
+		}
+	}
+	user.routes[routeId] = route{remote: remote, gen: r.gen}
+	r.publish(old, userName, user, Event{Type: Added, UserName: userName, RouteId: routeId, Remote: remote})
+	return r.gen, nil
+}
+
+// Remove removes the route if it has still the generation of the Add, a watcher of an old
+// container does not remove the route of the new one. The user is removed with the last route.
+func (r *Registry) Remove(userName, routeId string, gen uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.current.Load()
+	prev := old.users[userName]
+	if prev == nil || prev.routes[routeId].gen != gen {
+		return false
+	}
+	var user *userRoutes
+	if len(prev.routes) > 1 {
+		user = &userRoutes{hostname: prev.hostname, routes: make(map[string]route)}
+		for id, rt := range prev.routes {
+			if id != routeId {
+				user.routes[id] = rt
+			}
+		}
+	}
+	r.publish(old, userName, user, Event{Type: Removed, UserName: userName, RouteId: routeId, Remote: prev.routes[routeId].remote})
+	return true
+}
+
+// publish stores the snapshot with the changed user, a nil user is removed. It runs under the
+// lock, the subscribers get the events in order.
+func (r *Registry) publish(old *snapshot, userName string, user *userRoutes, e Event) {
+	s := &snapshot{users: make(map[string]*userRoutes, len(old.users)+1)}
+	for name, u := range old.users {
+		s.users[name] = u
+	}
+	if user != nil {
+		s.users[userName] = user
+	} else {
+		delete(s.users, userName)
+	}
+	r.current.Store(s)
+	for ch := range r.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the channel of the changes, a slow subscriber misses the events.
+func (r *Registry) Subscribe() chan Event {
+	ch := make(chan Event, 64)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs[ch] = struct{}{}
+	return ch
+}
+
+func (r *Registry) Unsubscribe(ch chan Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subs, ch)
+}
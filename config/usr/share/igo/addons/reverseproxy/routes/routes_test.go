@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestEndpoint(t *testing.T) {
+	r := NewRegistry()
+	events := r.Subscribe()
+	aliceGen, err := r.Add("alice", "alice-host", "CODE", "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Add("bob", "bob-host", "9100", "9100")
+
+	ep := r.Endpoint("alice", "CODE")
+	if ep == nil || len(ep.Remotes) != 1 || ep.Remotes["alice"].Host != "alice-host:8080" {
+		t.Fatalf("unexpected local endpoint %+v", ep)
+	}
+	if r.Endpoint("alice", "ADMIN") != nil || r.Endpoint("carol", "CODE") != nil {
+		t.Error("an unknown route or user should not have an endpoint")
+	}
+	global := r.Endpoint("alice", "9200")
+	if global == nil || len(global.Remotes) != 2 || global.Remotes["bob"].Host != "bob-host:9200" {
+		t.Fatalf("the global port should be served by all users, got %+v", global)
+	}
+	if local := r.Endpoint("bob", "9100"); len(local.Remotes) != 1 {
+		t.Error("the own route of a global port should be local")
+	}
+	// the caller owns the endpoint
+	global.Remotes["mallory"] = nil
+	if _, ok := r.Endpoint("alice", "9200").Remotes["mallory"]; ok {
+		t.Error("a change of an endpoint should not change the registry")
+	}
+
+	newGen, _ := r.Add("alice", "alice-host", "CODE", "8081")
+	if r.Remove("alice", "CODE", aliceGen) {
+		t.Error("the watcher of the old container should not remove the new route")
+	}
+	if !r.Remove("alice", "CODE", newGen) || r.Endpoint("alice", "9200") != nil {
+		t.Error("the user should be removed with the last route")
+	}
+	if users := r.Users(); len(users) != 1 || users[0] != "bob" {
+		t.Errorf("unexpected users %v", users)
+	}
+
+	var got []string
+	for len(events) > 0 {
+		e := <-events
+		got = append(got, e.Type+" "+e.UserName+" "+e.RouteId+" "+e.Remote.Host)
+	}
+	want := []string{"added alice CODE alice-host:8080", "added bob 9100 bob-host:9100",
+		"added alice CODE alice-host:8081", "removed alice CODE alice-host:8081"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected events\n got %v\nwant %v", got, want)
+	}
+	r.Unsubscribe(events)
+}
+
+// TestConcurrent runs the logins, the container exits and the lookups of the requests at the
+// same time, run it with -race.
+func TestConcurrent(t *testing.T) {
+	r := NewRegistry()
+	events := r.Subscribe()
+	done := make(chan struct{})
+	var received sync.WaitGroup
+	received.Add(1)
+	go func() {
+		defer received.Done()
+		for {
+			select {
+			case <-events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for u := 0; u < 8; u++ {
+		name, host := fmt.Sprintf("user%d", u), fmt.Sprintf("host%d", u)
+		wg.Add(2)
+		// the logins start the routes and the containers exit
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				routeId := []string{"CODE", "ADMIN", "9001"}[i%3]
+				gen, err := r.Add(name, host, routeId, "8080")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if i%2 == 0 && !r.Remove(name, routeId, gen) {
+					t.Error("the route should be removed by its own watcher")
+				}
+			}
+		}()
+		// the requests look up the routes
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				for _, routeId := range []string{"CODE", "9001", "9500"} {
+					if ep := r.Endpoint(name, routeId); ep != nil {
+						for user, remote := range ep.Remotes {
+							if remote == nil || user == "" {
+								t.Error("the endpoint has a broken remote")
+							}
+						}
+					}
+				}
+				r.Users()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	received.Wait()
+	if users := r.Users(); len(users) != 8 {
+		t.Errorf("every user should have a route, got %v", users)
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
+	"github.com/ui3o/codebox/reverseproxy/keys"
+	"github.com/ui3o/codebox/reverseproxy/sessions"
 )
 
 var (
@@ -26,6 +29,10 @@ type SAMLConfig struct {
 	KeyFile           string
 	Domain            string
 	AuthnNameIDFormat string
+	// SessionMaxAge is the age of the session cookie in sec, 0 is 8 hours
+	SessionMaxAge int
+	Keys          *keys.Manager      `json:"-"`
+	Sessions      *sessions.Registry `json:"-"`
 }
 
 func InitSAML() (*samlsp.Middleware, error) {
@@ -64,7 +71,7 @@ func InitSAML() (*samlsp.Middleware, error) {
 	}
 	if mw, err := samlsp.New(opt); err == nil {
 		mw.ServiceProvider.AuthnNameIDFormat = saml.NameIDFormat(SAMLConf.AuthnNameIDFormat)
-		mw.Session = DefaultSessionProvider(opt, SAMLConf.Domain)
+		mw.Session = DefaultSessionProvider(opt, SAMLConf.Domain, time.Duration(SAMLConf.SessionMaxAge)*time.Second, SAMLConf.Keys, SAMLConf.Sessions)
 		return mw, nil
 	} else {
 		log.Println("samlsp.New err ", err)
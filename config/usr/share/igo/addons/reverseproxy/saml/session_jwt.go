@@ -13,6 +13,8 @@ import (
 
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
+	"github.com/ui3o/codebox/reverseproxy/keys"
+	"github.com/ui3o/codebox/reverseproxy/sessions"
 )
 
 var defaultJWTSigningMethod = jwt.SigningMethodRS256
@@ -30,6 +32,10 @@ type JWTSessionCodec struct {
 	Issuer        string
 	MaxAge        time.Duration
 	Key           crypto.Signer
+	// Keys sign the sessions instead of the Key, the rotated keys are accepted for the grace window
+	Keys *keys.Manager
+	// Sessions registers the new sessions, the revoked ones are not decoded
+	Sessions *sessions.Registry
 }
 
 type JWTUser struct {
@@ -84,6 +90,15 @@ func (c JWTSessionCodec) New(assertion *saml.Assertion) (samlsp.Session, error)
 			authnStatement.SessionIndex)
 	}
 
+	if c.Sessions != nil {
+		u := strings.Split(claims.Subject, "\\")
+		session, err := c.Sessions.Create(Pop(&u), "saml", now.Add(c.MaxAge))
+		if err != nil {
+			return nil, err
+		}
+		claims.Id = session.ID
+	}
+
 	return claims, nil
 }
 
@@ -93,6 +108,9 @@ func (c JWTSessionCodec) New(assertion *saml.Assertion) (samlsp.Session, error)
 // function will panic.
 func (c JWTSessionCodec) Encode(s samlsp.Session) (string, error) {
 	claims := s.(JWTSessionClaims) // this will panic if you pass the wrong kind of session
+	if c.Keys != nil {
+		return c.Keys.Sign(claims)
+	}
 
 	token := jwt.NewWithClaims(c.SigningMethod, claims)
 	signedString, err := token.SignedString(c.Key)
@@ -109,10 +127,15 @@ func (c JWTSessionCodec) Decode(signed string) (samlsp.Session, error) {
 	parser := jwt.Parser{
 		ValidMethods: []string{c.SigningMethod.Alg()},
 	}
-	claims := JWTSessionClaims{}
-	_, err := parser.ParseWithClaims(signed, &claims, func(*jwt.Token) (interface{}, error) {
+	keyfunc := func(*jwt.Token) (interface{}, error) {
 		return c.Key.Public(), nil
-	})
+	}
+	if c.Keys != nil {
+		parser.ValidMethods = c.Keys.Methods()
+		keyfunc = c.Keys.Keyfunc
+	}
+	claims := JWTSessionClaims{}
+	_, err := parser.ParseWithClaims(signed, &claims, keyfunc)
 	// TODO(ross): check for errors due to bad time and return ErrNoSession
 	if err != nil {
 		return nil, err
@@ -126,6 +149,12 @@ func (c JWTSessionCodec) Decode(signed string) (samlsp.Session, error) {
 	if !claims.SAMLSession {
 		return nil, errors.New("expected saml-session")
 	}
+	if c.Sessions != nil {
+		u := strings.Split(claims.Subject, "\\")
+		if err := c.Sessions.Check(claims.Id, Pop(&u)); err != nil {
+			return nil, err
+		}
+	}
 	return claims, nil
 }
 
@@ -201,13 +230,16 @@ func UserFromRequest(r *http.Request) JWTUser {
 
 }
 
-func DefaultSessionProvider(opts samlsp.Options, domain string) samlsp.CookieSessionProvider {
+func DefaultSessionProvider(opts samlsp.Options, domain string, maxAge time.Duration, keys *keys.Manager, sessions *sessions.Registry) samlsp.CookieSessionProvider {
 	cookieName := opts.CookieName
+	if maxAge <= 0 {
+		maxAge = defaultSessionMaxAge
+	}
 
 	return samlsp.CookieSessionProvider{
 		Name:     cookieName,
 		Domain:   domain,
-		MaxAge:   defaultSessionMaxAge,
+		MaxAge:   maxAge,
 		HTTPOnly: true,
 		Secure:   opts.URL.Scheme == "https",
 		SameSite: opts.CookieSameSite,
@@ -215,8 +247,10 @@ func DefaultSessionProvider(opts samlsp.Options, domain string) samlsp.CookieSes
 			SigningMethod: defaultJWTSigningMethod,
 			Audience:      opts.URL.String(),
 			Issuer:        opts.URL.String(),
-			MaxAge:        defaultSessionMaxAge,
+			MaxAge:        maxAge,
 			Key:           opts.Key,
+			Keys:          keys,
+			Sessions:      sessions,
 		},
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ui3o/codebox/reverseproxy/sessions"
+)
+
+func newSessionRegistry() *sessions.Registry {
+	return &sessions.Registry{Path: Config.SessionsPath}
+}
+
+// logout revokes the session and deletes its cookie, the user is sent to the logout of the provider.
+func logout(c *gin.Context) {
+	user := readUser(c)
+	if user.IsValid {
+		if err := Sessions.Revoke(user.ID); err != nil {
+			log.Println(debugHeader(user.Name), "logout can not revoke the session >", err)
+		} else {
+			log.Println(debugHeader(user.Name), "logout revoked the session", user.ID)
+		}
+	}
+	c.Redirect(http.StatusFound, Auth.Logout(c, user))
+}
+
+func sessionsUsage() {
+	fmt.Println("Usage: reverseproxy sessions [<name>]")
+	fmt.Println("       reverseproxy revoke user <name>")
+	fmt.Println("       reverseproxy revoke session <id>")
+}
+
+// sessionsCommand lists the sessions of the user or all sessions, it returns the exit code.
+func sessionsCommand(args []string) int {
+	if len(args) > 1 {
+		sessionsUsage()
+		return 1
+	}
+	name := ""
+	if len(args) == 1 {
+		name = args[0]
+	}
+	list, err := newSessionRegistry().List(name)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	fmt.Printf("%-32s %-20s %-8s %-19s %-19s %s\n", "Id", "Name", "Provider", "Created", "Expires", "Revoked")
+	fmt.Println(strings.Repeat("-", 120))
+	for _, s := range list {
+		revoked := "-"
+		if s.IsRevoked() {
+			revoked = s.Revoked.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-32s %-20s %-8s %-19s %-19s %s\n", s.ID, s.Name, s.Provider,
+			s.Created.Local().Format("2006-01-02 15:04:05"), s.Expires.Local().Format("2006-01-02 15:04:05"), revoked)
+	}
+	return 0
+}
+
+// revokeCommand revokes a session or all sessions of a user, it returns the exit code.
+func revokeCommand(args []string) int {
+	if len(args) != 2 {
+		sessionsUsage()
+		return 1
+	}
+	registry := newSessionRegistry()
+	switch args[0] {
+	case "user":
+		count, err := registry.RevokeUser(args[1])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		fmt.Println("Revoked sessions of", strings.ToLower(args[1])+":", count)
+	case "session":
+		if err := registry.Revoke(args[1]); err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		fmt.Println("Session", args[1], "is revoked")
+	default:
+		sessionsUsage()
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNoSession = errors.New("the session does not exist")
+	ErrRevoked   = errors.New("the session is revoked")
+)
+
+// Session is a login, the session cookie has its id as the jti claim.
+type Session struct {
+	ID       string    `json:"-"`
+	Name     string    `json:"name"`
+	Provider string    `json:"provider"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Revoked  time.Time `json:"revoked"`
+}
+
+// IsRevoked returns true if the session was revoked or it was ended by a logout.
+func (s Session) IsRevoked() bool {
+	return !s.Revoked.IsZero()
+}
+
+// Registry keeps the sessions in a json file by id. The writes run under a file lock, the
+// proxies, the admin cli and the admin addon share the file. The expired sessions are removed
+// at the next write.
+type Registry struct {
+	Path string
+	Now  func() time.Time
+
+	mu      sync.Mutex
+	cache   map[string]*Session
+	modTime time.Time
+	size    int64
+}
+
+func (r *Registry) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *Registry) load() (map[string]*Session, error) {
+	sessions := make(map[string]*Session)
+	data, err := os.ReadFile(r.Path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("can not parse %s: %w", r.Path, err)
+	}
+	for id, session := range sessions {
+		session.ID = id
+	}
+	return sessions, nil
+}
+
+func (r *Registry) save(sessions map[string]*Session) error {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.Path), ".sessions-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// the admin addon reads it, there is no secret in it and only the owner can write the dir
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.Path)
+}
+
+// checkDir checks that only the proxy can write the dir of the file, the other users can not
+// replace the file or plant a symlink as the lock.
+func (r *Registry) checkDir() error {
+	dir := filepath.Dir(r.Path)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("the dir %s of the sessions must be a dir which only the owner can write", dir)
+	}
+	return nil
+}
+
+// update runs fn on the sessions under the file lock, they are written back if fn changed them.
+func (r *Registry) update(fn func(sessions map[string]*Session) (bool, error)) error {
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return err
+	}
+	if err := r.checkDir(); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(r.Path+".lock", os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	sessions, err := r.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(sessions)
+	if changed {
+		now := r.now()
+		for id, session := range sessions {
+			if now.After(session.Expires) {
+				delete(sessions, id)
+			}
+		}
+		if saveErr := r.save(sessions); saveErr != nil {
+			return saveErr
+		}
+	}
+	return err
+}
+
+// Create registers a new session of the user.
+func (r *Registry) Create(name, provider string, expires time.Time) (Session, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Session{}, err
+	}
+	session := Session{
+		ID:       hex.EncodeToString(id),
+		Name:     strings.ToLower(name),
+		Provider: provider,
+		Created:  r.now(),
+		Expires:  expires,
+	}
+	err := r.update(func(sessions map[string]*Session) (bool, error) {
+		sessions[session.ID] = &session
+		return true, nil
+	})
+	return session, err
+}
+
+// Revoke ends the session, its cookie is not accepted any more.
+func (r *Registry) Revoke(id string) error {
+	return r.update(func(sessions map[string]*Session) (bool, error) {
+		session := sessions[id]
+		if session == nil {
+			return false, ErrNoSession
+		}
+		if !session.IsRevoked() {
+			session.Revoked = r.now()
+		}
+		return true, nil
+	})
+}
+
+// RevokeUser ends all sessions of the user, it returns the count of the revoked sessions.
+func (r *Registry) RevokeUser(name string) (int, error) {
+	count := 0
+	err := r.update(func(sessions map[string]*Session) (bool, error) {
+		now := r.now()
+		for _, session := range sessions {
+			if session.Name == strings.ToLower(name) && !session.IsRevoked() {
+				session.Revoked = now
+				count++
+			}
+		}
+		return count > 0, nil
+	})
+	return count, err
+}
+
+// List returns the sessions of the user or all sessions if the name is empty, by creation time.
+func (r *Registry) List(name string) ([]Session, error) {
+	var list []Session
+	err := r.update(func(sessions map[string]*Session) (bool, error) {
+		for _, session := range sessions {
+			if name == "" || session.Name == strings.ToLower(name) {
+				list = append(list, *session)
+			}
+		}
+		return false, nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, err
+}
+
+// Check returns an error if the session of the user is unknown or revoked. It reads the file
+// again only if it changed, it runs for every request.
+func (r *Registry) Check(id, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil {
+		r.cache, r.modTime, r.size = nil, time.Time{}, 0
+	} else if r.cache == nil || !info.ModTime().Equal(r.modTime) || info.Size() != r.size {
+		if err := r.checkDir(); err != nil {
+			return err
+		}
+		sessions, err := r.load()
+		if err != nil {
+			return err
+		}
+		r.cache, r.modTime, r.size = sessions, info.ModTime(), info.Size()
+	}
+	session := r.cache[id]
+	if session == nil || session.Name != strings.ToLower(name) {
+		return ErrNoSession
+	}
+	if session.IsRevoked() {
+		return ErrRevoked
+	}
+	return nil
+}
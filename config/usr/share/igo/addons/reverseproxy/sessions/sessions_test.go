@@ -0,0 +1,73 @@
+package sessions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevoke(t *testing.T) {
+	now := time.Now()
+	r := &Registry{Path: filepath.Join(t.TempDir(), "sessions.json"), Now: func() time.Time { return now }}
+	laptop, err := r.Create("Alice", "simple", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	phone, _ := r.Create("alice", "oidc", now.Add(time.Hour))
+	bob, _ := r.Create("bob", "saml", now.Add(time.Hour))
+	if err := r.Check(laptop.ID, "alice"); err != nil {
+		t.Error("the new session should be active:", err)
+	}
+	if r.Check(laptop.ID, "bob") != ErrNoSession || r.Check("unknown", "alice") != ErrNoSession || r.Check("", "alice") != ErrNoSession {
+		t.Error("a session of an other user or an unknown session should be rejected")
+	}
+
+	if err := r.Revoke(laptop.ID); err != nil {
+		t.Fatal(err)
+	}
+	if r.Check(laptop.ID, "alice") != ErrRevoked || r.Check(phone.ID, "alice") != nil {
+		t.Error("only the revoked session should be rejected")
+	}
+	if r.Revoke("unknown") != ErrNoSession {
+		t.Error("the revoke of an unknown session should fail")
+	}
+
+	// an other process sees the revocations of the shared file
+	other := &Registry{Path: r.Path, Now: r.Now}
+	if count, err := other.RevokeUser("ALICE"); err != nil || count != 1 {
+		t.Errorf("the active session of alice should be revoked, got %d %v", count, err)
+	}
+	if r.Check(phone.ID, "alice") != ErrRevoked || r.Check(bob.ID, "bob") != nil {
+		t.Error("the sessions of alice should be rejected and bob should be active")
+	}
+	if list, _ := r.List("alice"); len(list) != 2 || list[0].ID != laptop.ID || list[0].Provider != "simple" {
+		t.Errorf("unexpected sessions of alice %+v", list)
+	}
+
+	// the expired sessions are removed at the next write
+	now = now.Add(2 * time.Hour)
+	r.Create("carol", "simple", now.Add(time.Hour))
+	if list, _ := r.List(""); len(list) != 1 || list[0].Name != "carol" {
+		t.Errorf("the expired sessions should be removed, got %+v", list)
+	}
+}
+
+func TestSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	r := &Registry{Path: filepath.Join(dir, "sessions.json")}
+	os.Chmod(dir, 0777)
+	if _, err := r.Create("alice", "simple", time.Now().Add(time.Hour)); err == nil {
+		t.Error("a dir which the others can write should be rejected")
+	}
+	os.Chmod(dir, 0755)
+	target := filepath.Join(t.TempDir(), "target")
+	os.Symlink(target, r.Path+".lock")
+	if _, err := r.Create("alice", "simple", time.Now().Add(time.Hour)); err == nil {
+		t.Error("the symlink of the lock should not be followed")
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Error("the target of the symlink should not be created")
+	}
+}
@@ -0,0 +1,385 @@
+package simple
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+var (
+	ErrInvalidLogin  = errors.New("invalid name, password or code")
+	ErrLocked        = errors.New("the account is locked, try it later")
+	ErrRateLimited   = errors.New("too many failed logins, try it later")
+	ErrNoAccount     = errors.New("the account does not exist")
+	ErrAccountExists = errors.New("the account already exists")
+
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// Account is a local user of the simple login, the file of the AccountStore has them by name.
+type Account struct {
+	Name         string    `json:"-"`
+	Domain       string    `json:"domain,omitempty"`
+	Email        string    `json:"email,omitempty"`
+	PasswordHash string    `json:"passwordHash"`
+	TOTPSecret   string    `json:"totpSecret,omitempty"`
+	TOTPCounter  uint64    `json:"totpCounter,omitempty"`
+	FailedLogins int       `json:"failedLogins,omitempty"`
+	LockedUntil  time.Time `json:"lockedUntil"`
+}
+
+// maxLimitedAddrs limits the memory the failed logins of the addresses can allocate
+const maxLimitedAddrs = 10000
+
+// AccountStore keeps the accounts in a json file, every operation reads and writes it under
+// a file lock, so the admin cli can change it while the proxy runs.
+type AccountStore struct {
+	Path string
+	// MaxFailedLogins locks the account for the LockoutDuration, 0 never locks it
+	MaxFailedLogins int
+	LockoutDuration time.Duration
+	// MaxFailedLoginsPerAddr rejects the logins of a client address for the LockoutDuration
+	// after its failed logins, before it can lock the accounts of others. 0 never limits it.
+	MaxFailedLoginsPerAddr int
+	Now                    func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// HashPassword returns the argon2id hash of the password in the PHC string format.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks the password against an argon2id or a bcrypt hash.
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// IsPasswordHash returns true for the hashes VerifyPassword can check.
+func IsPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (s *AccountStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *AccountStore) load() (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("can not parse %s: %w", s.Path, err)
+	}
+	for name, account := range accounts {
+		account.Name = name
+	}
+	return accounts, nil
+}
+
+func (s *AccountStore) save(accounts map[string]*Account) error {
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".accounts-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// checkDir checks that only the proxy can write the dir of the accounts, the other users can
+// not replace the file or plant a symlink as the lock.
+func (s *AccountStore) checkDir() error {
+	dir := filepath.Dir(s.Path)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("the dir %s of the accounts must be a dir which only the owner can write", dir)
+	}
+	return nil
+}
+
+// update runs fn on the accounts under the file lock, they are written back if fn changed them.
+func (s *AccountStore) update(fn func(accounts map[string]*Account) (bool, error)) error {
+	if err := s.checkDir(); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(s.Path+".lock", os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	accounts, err := s.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(accounts)
+	if changed {
+		if saveErr := s.save(accounts); saveErr != nil {
+			return saveErr
+		}
+	}
+	return err
+}
+
+// Authenticate checks the password and the TOTP code of the account for the client address.
+// The failed logins are counted, the account is locked after MaxFailedLogins. The password is
+// hashed without the file lock, the other logins and the admin cli do not wait for it.
+func (s *AccountStore) Authenticate(addr, name, password, code string) (result Account, err error) {
+	reserved, allowed := s.reserveAddr(addr)
+	if !allowed {
+		return Account{}, ErrRateLimited
+	}
+	// the attempt counts as a failed login of the address while the password is hashed, the
+	// concurrent guesses of the address can not pass the limit
+	defer func() {
+		if err != ErrInvalidLogin {
+			s.releaseAddr(addr, reserved)
+		}
+	}()
+	name = strings.ToLower(name)
+	var hash string
+	var locked bool
+	err = s.update(func(accounts map[string]*Account) (bool, error) {
+		if account := accounts[name]; account != nil {
+			hash, locked = account.PasswordHash, s.now().Before(account.LockedUntil)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return Account{}, err
+	}
+	if hash == "" {
+		// the time of a login does not tell if the account exists
+		dummyHashOnce.Do(func() { dummyHash, _ = HashPassword("dummy") })
+		VerifyPassword(dummyHash, password)
+		return Account{}, ErrInvalidLogin
+	}
+	if locked {
+		return Account{}, ErrLocked
+	}
+	ok := VerifyPassword(hash, password)
+
+	err = s.update(func(accounts map[string]*Account) (bool, error) {
+		account := accounts[name]
+		// the account can be changed while the password is hashed, the old password is not valid
+		if account == nil || account.PasswordHash != hash {
+			return false, ErrInvalidLogin
+		}
+		now := s.now()
+		if now.Before(account.LockedUntil) {
+			return false, ErrLocked
+		}
+		if ok && account.TOTPSecret != "" {
+			var counter uint64
+			if counter, ok = verifyTOTP(account.TOTPSecret, code, now, account.TOTPCounter); ok {
+				account.TOTPCounter = counter
+			}
+		}
+		if !ok {
+			account.FailedLogins++
+			if s.MaxFailedLogins > 0 && account.FailedLogins >= s.MaxFailedLogins {
+				account.FailedLogins = 0
+				account.LockedUntil = now.Add(s.LockoutDuration)
+			}
+			return true, ErrInvalidLogin
+		}
+		account.FailedLogins = 0
+		account.LockedUntil = time.Time{}
+		result = *account
+		return true, nil
+	})
+	return result, err
+}
+
+// recentFailures returns the failed logins of the address in the last LockoutDuration, it is
+// called with the mutex held.
+func (s *AccountStore) recentFailures(addr string, now time.Time) []time.Time {
+	recent := s.failures[addr]
+	for len(recent) > 0 && now.Sub(recent[0]) >= s.LockoutDuration {
+		recent = recent[1:]
+	}
+	if len(recent) == 0 {
+		delete(s.failures, addr)
+		return nil
+	}
+	s.failures[addr] = recent
+	return recent
+}
+
+// reserveAddr counts a failed login of the address before the password is checked, it returns
+// false if the address has MaxFailedLoginsPerAddr already. The returned time releases it.
+func (s *AccountStore) reserveAddr(addr string) (time.Time, bool) {
+	if s.MaxFailedLoginsPerAddr <= 0 {
+		return time.Time{}, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.failures == nil {
+		s.failures = make(map[string][]time.Time)
+	}
+	if len(s.failures) >= maxLimitedAddrs {
+		for a := range s.failures {
+			s.recentFailures(a, now)
+		}
+	}
+	recent := s.recentFailures(addr, now)
+	if len(recent) >= s.MaxFailedLoginsPerAddr {
+		return time.Time{}, false
+	}
+	if len(s.failures) >= maxLimitedAddrs && recent == nil {
+		// the addresses which failed already are still limited
+		return time.Time{}, true
+	}
+	s.failures[addr] = append(recent, now)
+	return now, true
+}
+
+// releaseAddr removes the failed login reserveAddr counted, the login did not fail.
+func (s *AccountStore) releaseAddr(addr string, reserved time.Time) {
+	if reserved.IsZero() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := s.failures[addr]
+	for i := len(failures) - 1; i >= 0; i-- {
+		if failures[i].Equal(reserved) {
+			failures = append(failures[:i:i], failures[i+1:]...)
+			break
+		}
+	}
+	if len(failures) == 0 {
+		delete(s.failures, addr)
+	} else {
+		s.failures[addr] = failures
+	}
+}
+
+// Add creates the account, the password hash is set by the caller.
+func (s *AccountStore) Add(account Account) error {
+	return s.update(func(accounts map[string]*Account) (bool, error) {
+		account.Name = strings.ToLower(account.Name)
+		if accounts[account.Name] != nil {
+			return false, ErrAccountExists
+		}
+		accounts[account.Name] = &account
+		return true, nil
+	})
+}
+
+// Modify changes the account by fn.
+func (s *AccountStore) Modify(name string, fn func(account *Account)) error {
+	return s.update(func(accounts map[string]*Account) (bool, error) {
+		account := accounts[strings.ToLower(name)]
+		if account == nil {
+			return false, ErrNoAccount
+		}
+		fn(account)
+		return true, nil
+	})
+}
+
+func (s *AccountStore) Remove(name string) error {
+	return s.update(func(accounts map[string]*Account) (bool, error) {
+		if accounts[strings.ToLower(name)] == nil {
+			return false, ErrNoAccount
+		}
+		delete(accounts, strings.ToLower(name))
+		return true, nil
+	})
+}
+
+// List returns the accounts sorted by name.
+func (s *AccountStore) List() ([]Account, error) {
+	var list []Account
+	err := s.update(func(accounts map[string]*Account) (bool, error) {
+		for _, account := range accounts {
+			list = append(list, *account)
+		}
+		return false, nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, err
+}
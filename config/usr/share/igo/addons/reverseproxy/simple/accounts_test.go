@@ -0,0 +1,201 @@
+package simple
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ui3o/codebox/reverseproxy/keys"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestStore(t *testing.T, now *time.Time) *AccountStore {
+	return &AccountStore{
+		Path:            filepath.Join(t.TempDir(), "accounts.json"),
+		MaxFailedLogins: 3,
+		LockoutDuration: time.Minute,
+		Now:             func() time.Time { return *now },
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword(hash, "correct horse") || VerifyPassword(hash, "wrong horse") {
+		t.Error("the argon2id hash does not verify")
+	}
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("battery staple"), bcrypt.MinCost)
+	if !VerifyPassword(string(bcryptHash), "battery staple") || VerifyPassword(string(bcryptHash), "staple") {
+		t.Error("the bcrypt hash does not verify")
+	}
+	if VerifyPassword("plain", "plain") || IsPasswordHash("plain") {
+		t.Error("a plain password is not a hash")
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	now := time.Now()
+	store := newTestStore(t, &now)
+	hash, _ := HashPassword("secret123")
+	if err := store.Add(Account{Name: "Alice", Email: "alice@example.com", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(Account{Name: "alice", PasswordHash: hash}); err != ErrAccountExists {
+		t.Error("the names are case insensitive:", err)
+	}
+	if account, err := store.Authenticate("10.0.0.1", "ALICE", "secret123", ""); err != nil || account.Email != "alice@example.com" {
+		t.Fatal("login failed:", account, err)
+	}
+	if _, err := store.Authenticate("10.0.0.1", "bob", "secret123", ""); err != ErrInvalidLogin {
+		t.Error("an unknown account should fail like a wrong password:", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Authenticate("10.0.0.1", "alice", "wrong", ""); err != ErrInvalidLogin {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != ErrLocked {
+		t.Error("the account should be locked after 3 failed logins:", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != nil {
+		t.Error("the lock should expire:", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Authenticate("10.0.0.1", "alice", "wrong", "")
+	}
+	store.Modify("alice", func(a *Account) { a.FailedLogins, a.LockedUntil = 0, time.Time{} })
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != nil {
+		t.Error("the account should be unlocked:", err)
+	}
+}
+
+func TestAuthenticateRateLimit(t *testing.T) {
+	now := time.Now()
+	store := newTestStore(t, &now)
+	store.MaxFailedLogins, store.MaxFailedLoginsPerAddr = 0, 3
+	hash, _ := HashPassword("secret123")
+	store.Add(Account{Name: "alice", PasswordHash: hash})
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := store.Authenticate("10.0.0.1", name, "wrong", ""); err != ErrInvalidLogin {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != ErrRateLimited {
+		t.Error("the address should be limited after 3 failed logins of any account:", err)
+	}
+	if _, err := store.Authenticate("10.0.0.2", "alice", "secret123", ""); err != nil {
+		t.Error("the other addresses should not be limited:", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != nil {
+		t.Error("the limit should expire:", err)
+	}
+}
+
+func TestAuthenticateConcurrentRateLimit(t *testing.T) {
+	now := time.Now()
+	store := newTestStore(t, &now)
+	store.MaxFailedLogins, store.MaxFailedLoginsPerAddr = 0, 3
+	// the guesses have to be slow enough to overlap
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
+	store.Add(Account{Name: "alice", PasswordHash: string(hash)})
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Authenticate("10.0.0.1", "alice", "wrong", "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	invalid := 0
+	for err := range errs {
+		if err == ErrInvalidLogin {
+			invalid++
+		} else if err != ErrRateLimited {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if invalid > 3 {
+		t.Errorf("%d concurrent guesses were checked, the limit is 3", invalid)
+	}
+	if _, err := store.Authenticate("10.0.0.2", "alice", "secret123", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.failures["10.0.0.2"]) != 0 {
+		t.Error("a successful login should release the attempt:", store.failures["10.0.0.2"])
+	}
+}
+
+func TestSharedDir(t *testing.T) {
+	now := time.Now()
+	store := newTestStore(t, &now)
+	dir := filepath.Dir(store.Path)
+	os.Chmod(dir, 0777)
+	if err := store.Add(Account{Name: "alice"}); err == nil {
+		t.Error("a dir which the others can write should be rejected")
+	}
+	os.Chmod(dir, 0755)
+	target := filepath.Join(t.TempDir(), "target")
+	os.Symlink(target, store.Path+".lock")
+	if err := store.Add(Account{Name: "alice"}); err == nil {
+		t.Error("the symlink of the lock should not be followed")
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Error("the target of the symlink should not be created")
+	}
+}
+
+func TestAuthenticateTOTP(t *testing.T) {
+	now := time.Now()
+	store := newTestStore(t, &now)
+	hash, _ := HashPassword("secret123")
+	secret := NewTOTPSecret()
+	store.Add(Account{Name: "alice", PasswordHash: hash, TOTPSecret: secret})
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", ""); err != ErrInvalidLogin {
+		t.Error("the code is required:", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	code := totpCode(key, uint64(now.Unix())/totpPeriod)
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", code); err != nil {
+		t.Error("login with the code failed:", err)
+	}
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", code); err != ErrInvalidLogin {
+		t.Error("a code can be used only once:", err)
+	}
+	if _, err := store.Authenticate("10.0.0.1", "alice", "secret123", totpCode(key, uint64(now.Unix())/totpPeriod+1)); err != nil {
+		t.Error("the code of the next period should be accepted:", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	m := keys.NewManager(t.TempDir(), time.Hour, 2*time.Hour)
+	m.Now = func() time.Time { return now }
+	SetKeyManager(m)
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := Encode(JWTUser{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(90 * time.Minute)
+	m.Refresh()
+	if user, err := Decode(token); err != nil || user.Name != "alice" {
+		t.Error("the token of the previous key should be accepted:", err)
+	}
+	now = now.Add(2 * time.Hour)
+	m.Refresh()
+	if _, err := Decode(token); err == nil {
+		t.Error("the token of a key after its grace window should be rejected")
+	}
+}
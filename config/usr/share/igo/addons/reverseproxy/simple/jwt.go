@@ -1,16 +1,40 @@
 package simple
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/ui3o/codebox/reverseproxy/keys"
 )
 
-const (
-	secretKey = "b8f3e2c1a4d5e6f7g8h9i0j1k2l3m4n5o6p7q8r9s0t1u2v3w4x5y6z7"
+// SessionMaxAge is the expiry of the session cookies
+const SessionMaxAge = time.Hour
+
+var (
+	// keyManager signs the cookies, the rotated keys are accepted for its grace window
+	keyManager   *keys.Manager
+	keyManagerMu sync.RWMutex
 )
 
+// SetKeyManager sets the keys of the session cookies.
+func SetKeyManager(m *keys.Manager) {
+	keyManagerMu.Lock()
+	defer keyManagerMu.Unlock()
+	keyManager = m
+}
+
+func getKeyManager() (*keys.Manager, error) {
+	keyManagerMu.RLock()
+	defer keyManagerMu.RUnlock()
+	if keyManager == nil {
+		return nil, errors.New("no key manager is set")
+	}
+	return keyManager, nil
+}
+
 type JWTUser struct {
 	IsValid bool `json:"valid"`
 	// HasSecret bool   `json:"secret"`
@@ -28,37 +52,36 @@ func (c JWTUser) ToString() string {
 }
 
 func Encode(c JWTUser) (string, error) {
-	// Define your secret key
-	secretKey := []byte(secretKey)
+	m, err := getKeyManager()
+	if err != nil {
+		return "", err
+	}
 
-	// Create a new token object, specifying signing method and claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	// Sign with the current key, the kid header names it, the jti is the id of the session
+	now := time.Now()
+	return m.Sign(jwt.MapClaims{
 		"domain": c.Domain,
 		"name":   c.Name,
 		"email":  c.Email,
-		"exp":    time.Now().Add(time.Hour * 1).Unix(), // Expires in 1 hour
+		"jti":    c.ID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(SessionMaxAge).Unix(),
 	})
-
-	// Sign and get the complete encoded token as a string
-	signedString, err := token.SignedString(secretKey)
-	if err != nil {
-		panic(err)
-	}
-	return signedString, nil
 }
 
 func Decode(tokenString string) (*JWTUser, error) {
+	m, err := getKeyManager()
+	if err != nil {
+		return nil, err
+	}
+	parser := jwt.Parser{ValidMethods: m.Methods()}
 	claims := &JWTUser{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
-	})
-
+	token, err := parser.ParseWithClaims(tokenString, claims, m.Keyfunc)
 	if err != nil {
 		return nil, err
 	}
-
-	if token.Valid {
-		return claims, nil
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
 	}
-	return nil, fmt.Errorf("invalid token")
+	return claims, nil
 }
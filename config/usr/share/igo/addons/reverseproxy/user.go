@@ -8,13 +8,11 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
-	"strconv"
 	"time"
 
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/ui3o/codebox/reverseproxy/saml"
 	"github.com/ui3o/codebox/reverseproxy/simple"
 )
 
@@ -33,20 +31,13 @@ func checkPortIsOpened(userName, hostname, port string) error {
 	return errors.New("port is not available after retries")
 }
 
-func watchContainerRunning(userName, routeId string) {
+func watchContainerRunning(userName, routeId string, gen uint64) {
 	go func() {
 		cmd := exec.Command("pake", "listenContainerRunning", userName)
 		cmd.Dir = Config.TemplateRootPath + "pake"
 		cmd.Run()
-		log.Println(debugHeader(userName), "Remove ", routeId, " from AllRestEndpoint.Endpoint")
-		delete(AllRestEndpoint[userName].Endpoints, routeId)
-		hasLocalRoute := len(AllRestEndpoint[userName].Endpoints) > 1000
-		for i := 9000; i <= 9999; i++ {
-			globalName := strconv.Itoa(i)
-			AllGlobalEndpoints[globalName].UnRegister(userName)
-			if !hasLocalRoute {
-				delete(AllRestEndpoint[userName].Endpoints, globalName)
-			}
+		if Routes.Remove(userName, routeId, gen) {
+			log.Println(debugHeader(userName), "Remove ", routeId, " from Routes")
 		}
 	}()
 }
@@ -134,38 +125,13 @@ func userCreatorInit() {
 				port, exitCode = runPake(userName, "pake", "getPortForRouteID", userName, routeId)
 			}
 			if exitCode == 0 {
-				if AllRestEndpoint[userName] == nil {
-					AllRestEndpoint[userName] = &AllRestEndpointDefinition{}
-					AllRestEndpoint[userName].Endpoints = make(map[string]*RestEndpointDefinition)
-					AllRestEndpoint[userName].Hostname = hostname
-				}
-				for i := 9000; i <= 9999; i++ {
-					globalName := strconv.Itoa(i)
-					if AllGlobalEndpoints[globalName] == nil {
-						AllGlobalEndpoints[globalName] = &RestEndpointDefinition{
-							Remotes: make(map[string]*url.URL),
-						}
-					}
-					for uname := range AllRestEndpoint {
-						AllGlobalEndpoints[globalName].Register(AllRestEndpoint[uname].Hostname, strconv.Itoa(i), uname)
-					}
-					for uname := range AllRestEndpoint {
-						AllRestEndpoint[uname].Endpoints[globalName] = &RestEndpointDefinition{
-							RouteId:  globalName,
-							UserName: uname,
-							Remotes:  AllGlobalEndpoints[globalName].Remotes,
-						}
-					}
-				}
 				if err := checkPortIsOpened(userName, hostname, port); err == nil {
-					success = nil
-					watchContainerRunning(userName, routeId)
-					AllRestEndpoint[userName].Endpoints[routeId] = &RestEndpointDefinition{
-						RouteId:  routeId,
-						UserName: userName,
-						Remotes:  make(map[string]*url.URL),
+					if gen, err := Routes.Add(userName, hostname, routeId, port); err == nil {
+						success = nil
+						watchContainerRunning(userName, routeId, gen)
+					} else {
+						log.Println(debugHeader(userName), "Failed to add the route:", err)
 					}
-					AllRestEndpoint[userName].Endpoints[routeId].Register(hostname, port, userName)
 				}
 			}
 			if done, exists := c.Get(userCreationWaiter); exists {
@@ -178,10 +144,13 @@ func userCreatorInit() {
 	}()
 }
 
-func checkUserRouteId(c *gin.Context) error {
+// checkUserRouteId returns the endpoint of the route, the container of the user is started if
+// the route is not running.
+func checkUserRouteId(c *gin.Context) (*RestEndpointDefinition, error) {
 	userName := c.GetHeader(REQ_HEADER_PROXY_USER_NAME)
 	routeId := c.GetHeader(REQ_HEADER_ROUTE_ID)
-	if AllRestEndpoint[userName] == nil || AllRestEndpoint[userName].Endpoints[routeId] == nil {
+	ep := Routes.Endpoint(userName, routeId)
+	if ep == nil {
 		done := make(chan error, 1)
 		// Wrap the context to include a done channel
 		c.Set(userCreationWaiter, done)
@@ -189,19 +158,23 @@ func checkUserRouteId(c *gin.Context) error {
 		portOpenSuccess := <-done
 		if portOpenSuccess != nil {
 			log.Println(debugHeader(userName), "user creation and port check has error")
-			return portOpenSuccess
+			return nil, portOpenSuccess
 		} else {
 			log.Println(debugHeader(userName), "user creation and port check done successfully")
 		}
+		// the container can exit before the lookup
+		if ep = Routes.Endpoint(userName, routeId); ep == nil {
+			return nil, errors.New("this endpoint stopped after the start, please refresh the page")
+		}
 	}
 	accept := c.Request.Header.Get("Accept")
 	if strings.Contains(accept, "text/html") {
 		if htmlPage, exitCode := runPake(userName, "pake", "runUrlGuard", userName, routeId, c.Request.RequestURI); exitCode == 9 {
-			return errors.New(htmlPage)
+			return nil, errors.New(htmlPage)
 		}
 	}
 
-	return nil
+	return (*RestEndpointDefinition)(ep), nil
 }
 
 func readUser(c *gin.Context) *simple.JWTUser {
@@ -216,35 +189,13 @@ func readUser(c *gin.Context) *simple.JWTUser {
 	}
 	log.Println("[NONE] readUser for host(", user.Host, ")")
 
-	if Config.UseSAMLAuth {
-		log.Println("[NONE] readUser Config.UseSAMLAuth start")
-		if session, err := SAMLSP.Session.GetSession(c.Request); err == nil {
-			if cookieSession, ok := session.(saml.JWTSessionClaims); ok {
-				domainAndName := cookieSession.StandardClaims.Subject
-				u := strings.Split(domainAndName, "\\")
-				user.IsValid = true
-				user.Name = strings.ToLower(saml.Pop(&u))
-				user.Domain = strings.ToLower(saml.Pop(&u))
-				user.Email = strings.ToLower(cookieSession.Attributes.Get("emailaddress"))
-			} else {
-				log.Println("[NONE] readUser JWTSessionClaims cast error")
-			}
-		} else {
-			log.Println("[NONE] readUser session error: ", err)
-		}
+	if err := Auth.ReadSession(c, &user); err != nil {
+		log.Println("[NONE] readUser session error:", err)
+	} else if err := Sessions.Check(user.ID, user.Name); err != nil {
+		log.Println(debugHeader(user.Name), "readUser session", user.ID, "is not active:", err)
+		user.Name, user.Domain, user.Email = DEFAULT_USERNAME, "", ""
 	} else {
-		if cookie, err := c.Cookie(Config.CookieName); err == nil {
-			if u, err := simple.Decode(cookie); err == nil {
-				user.IsValid = true
-				user.Name = u.Name
-				user.Domain = u.Domain
-				user.Email = u.Email
-			} else {
-				log.Println("[NONE] readUser simple.Decode error:", err)
-			}
-		} else {
-			log.Println("[NONE] readUser cookie get error:", err)
-		}
+		user.IsValid = true
 	}
 
 	if user.IsValid {
@@ -277,15 +228,18 @@ func poster(c *gin.Context) {
 		c.String(400, "Invalid 'users' parameter")
 		return
 	}
-	runningContainers := []string{}
-	for userName, ep := range AllRestEndpoint {
-		if len(ep.Endpoints) > 0 {
-			runningContainers = append(runningContainers, userName)
-		}
-	}
 	if len(decodedUsers) == 0 {
-		decodedUsers = strings.Join(runningContainers, ",")
+		decodedUsers = strings.Join(Routes.Users(), ",")
 	}
 	runPake(decodedSender, "pake", "poster", decodedSender, decodedMsg, decodedUsers)
 	c.String(200, "Message posted")
 }
+
+func routeEventLoggerInit() {
+	events := Routes.Subscribe()
+	go func() {
+		for e := range events {
+			log.Println("[ROUTES]", e.Type, e.UserName, e.RouteId, e.Remote)
+		}
+	}()
+}
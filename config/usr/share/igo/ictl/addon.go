@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+// installInfoName is written to the addons installed by ictl, the addons of the image have none.
+const installInfoName = ".install.json"
+
+type installInfo struct {
+	Source      string    `json:"source"`
+	InstalledAt time.Time `json:"installedAt"`
+	Sha256      string    `json:"sha256"`
+}
+
+func readInstallInfo(dir string) *installInfo {
+	raw, err := os.ReadFile(filepath.Join(dir, installInfoName))
+	if err != nil {
+		return nil
+	}
+	info := &installInfo{}
+	if err := json.Unmarshal(raw, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// addonExecutable returns the executable of the addon, <name>.start or <name>.disabled.
+func addonExecutable(dir string, name string) (string, bool) {
+	for _, ext := range []string{".start", ".disabled"} {
+		path := filepath.Join(dir, name+ext)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func fileSha256(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func isArchive(source string) bool {
+	return strings.HasSuffix(source, ".tar.gz") || strings.HasSuffix(source, ".tgz")
+}
+
+// stageAddon copies or extracts the source to the staging dir of igo, which is on the file
+// system of the addons dir, so the staged addon is moved in by a rename. An archive can have
+// the addon in its top dir. The files are owned by root and only root can write them, the
+// addons run as root.
+func stageAddon(source string, name string, build bool) (string, string, error) {
+	if err := os.MkdirAll(igoStagingPath, 0700); err != nil {
+		return "", "", err
+	}
+	tmpDir, err := os.MkdirTemp(igoStagingPath, ".extract-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := tmpDir
+	if isArchive(source) {
+		if out, err := exec.Command("tar", "-xzf", source, "-C", tmpDir, "--no-same-owner").CombinedOutput(); err != nil {
+			return "", "", fmt.Errorf("could not extract %s: %s", source, strings.TrimSpace(string(out)))
+		}
+		entries, _ := os.ReadDir(tmpDir)
+		if len(entries) == 1 && entries[0].IsDir() {
+			content = filepath.Join(tmpDir, entries[0].Name())
+			name = getValueOr(name, entries[0].Name())
+		}
+		name = getValueOr(name, strings.TrimSuffix(strings.TrimSuffix(filepath.Base(source), ".tgz"), ".tar.gz"))
+	} else {
+		if info, err := os.Stat(source); err != nil || !info.IsDir() {
+			return "", "", fmt.Errorf("%s is not a dir or a .tar.gz", source)
+		}
+		if out, err := exec.Command("cp", "-a", source+"/.", tmpDir).CombinedOutput(); err != nil {
+			return "", "", fmt.Errorf("could not copy %s: %s", source, strings.TrimSpace(string(out)))
+		}
+		name = getValueOr(name, filepath.Base(filepath.Clean(source)))
+	}
+	if !unitNameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("invalid addon name %s, use letters, digits and @._-", name)
+	}
+	err = filepath.Walk(content, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, 0, 0); err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(path, info.Mode()&^0022)
+	})
+	if err == nil {
+		// the temp dir of a flat archive is only accessible by root
+		err = os.Chmod(content, 0755)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not take the ownership of the addon: %w", err)
+	}
+	if build {
+		fmt.Printf("Building %s ...\n", name)
+		cmd := exec.Command("go", "build", "-o", name+".disabled", ".")
+		cmd.Dir = content
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", "", fmt.Errorf("could not build %s: %w", name, err)
+		}
+	}
+
+	staged := filepath.Join(igoStagingPath, name)
+	os.RemoveAll(staged)
+	if err := os.Rename(content, staged); err != nil {
+		return "", "", err
+	}
+	return staged, name, nil
+}
+
+// validateAddon checks the layout of the staged addon, then igo checks it like the addons it
+// starts.
+func validateAddon(dir string, name string) error {
+	var missing []string
+	for _, file := range []string{"go.mod", unitConfigToLookFor} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			missing = append(missing, file)
+		}
+	}
+	if _, ok := addonExecutable(dir, name); !ok {
+		missing = append(missing, name+".start or "+name+".disabled, build it or use --build")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the addon %s has no %s", name, strings.Join(missing, ", "))
+	}
+	cmd := exec.Command(igoBinPath, "-root", igoRootPath, "check", "-addon", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Print(string(out))
+		return fmt.Errorf("igo check failed for %s", name)
+	}
+	return nil
+}
+
+// replaceDir moves the src to dst, the previous dst is returned in a staging dir. An existing
+// dst is exchanged with the src by renameat2, igo finds either the old or the new addon in a
+// cycle, never a missing one which it would forget.
+func replaceDir(src string, dst string) (string, error) {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return "", os.Rename(src, dst)
+	}
+	if err := exchangeDirs(src, dst); err != nil {
+		return "", &os.LinkError{Op: "exchange", Old: src, New: dst, Err: err}
+	}
+	// the src has the previous version now
+	previous := filepath.Join(igoStagingPath, filepath.Base(dst)+".previous")
+	os.RemoveAll(previous)
+	if err := os.Rename(src, previous); err != nil {
+		return src, nil
+	}
+	return previous, nil
+}
+
+// addonState returns the state of the addon in igo, it is empty if igo does not run it.
+func addonState(states []control.UnitState, name string) string {
+	for _, state := range states {
+		if state.Name != name {
+			continue
+		}
+		switch state.Type {
+		case "addon":
+			return state.State
+		case "origin":
+			return state.State + " (origin)"
+		}
+	}
+	return ""
+}
+
+func findAddonState(name string) string {
+	states, err := fetchUnitStates()
+	if err != nil {
+		return ""
+	}
+	return addonState(states, name)
+}
+
+// installAddon installs a new addon, or with upgrade replaces an installed one. The upgraded
+// addon keeps the .start or .disabled of the installed version, so its enablement is kept, and
+// the installed version becomes the origin igo falls back to if the new one fails.
+func installAddon(args []string, upgrade bool) {
+	args, name, _ := popValue(args, "--name", "-name")
+	args, build := popFlag(args, "--build", "-build")
+	args, noRestart := popFlag(args, "--no-restart", "-no-restart")
+	action, done := "install", "installed"
+	if upgrade {
+		action, done = "upgrade", "upgraded"
+	}
+	if len(args) != 1 {
+		fmt.Printf("Usage: ictl addon %s [--name <name>] [--build] [--no-restart] <dir|tar.gz>\n", action)
+		os.Exit(1)
+	}
+	source, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	staged, name, err := stageAddon(source, name, build)
+	if err != nil {
+		fmt.Printf("Could not %s the addon: %v\n", action, err)
+		os.Exit(1)
+	}
+	fail := func(format string, a ...any) {
+		os.RemoveAll(staged)
+		fmt.Printf(format+"\n", a...)
+		os.Exit(1)
+	}
+	if err := validateAddon(staged, name); err != nil {
+		fail("Could not %s the addon: %v", action, err)
+	}
+
+	addonPath := filepath.Join(igoAddonPath, name)
+	installed, isInstalled := addonExecutable(addonPath, name)
+	switch {
+	case upgrade && !isInstalled:
+		fail("Addon %s is not installed, use ictl addon install", name)
+	case !upgrade && isInstalled:
+		fail("Addon %s is already installed, use ictl addon upgrade", name)
+	}
+	executable, _ := addonExecutable(staged, name)
+	if upgrade && filepath.Ext(executable) != filepath.Ext(installed) {
+		target := filepath.Join(staged, filepath.Base(installed))
+		if err := os.Rename(executable, target); err != nil {
+			fail("Could not %s the addon: %v", action, err)
+		}
+		executable = target
+	}
+	info := installInfo{Source: source, InstalledAt: time.Now(), Sha256: fileSha256(executable)}
+	raw, _ := json.MarshalIndent(info, "", "  ")
+	if err := os.WriteFile(filepath.Join(staged, installInfoName), raw, 0644); err != nil {
+		fail("Could not %s the addon: %v", action, err)
+	}
+
+	previous, err := replaceDir(staged, addonPath)
+	if err != nil {
+		fail("Could not %s the addon: %v", action, err)
+	}
+	if previous != "" {
+		// igo falls back to the origin, the previous version is the last one known to work
+		originPath := filepath.Join(igoOriginPath, name)
+		os.RemoveAll(originPath)
+		if err := os.MkdirAll(igoOriginPath, 0755); err == nil {
+			err = os.Rename(previous, originPath)
+		}
+		if err != nil {
+			fmt.Printf("Could not keep the previous version of %s as origin: %v\n", name, err)
+			os.RemoveAll(previous)
+		} else {
+			fmt.Printf("The previous version of %s is kept as origin: %s\n", name, originPath)
+		}
+	}
+	fmt.Printf("Addon %s %s: %s\n", name, done, addonPath)
+
+	if !upgrade {
+		if filepath.Ext(executable) == ".disabled" {
+			fmt.Printf("It is disabled, enable it with: ictl enable --now %s\n", name)
+		}
+		return
+	}
+	if state := findAddonState(name); state == "" || noRestart {
+		return
+	}
+	fmt.Printf("Restarting %s ...\n", name)
+	resp, err := sendControlRequest(control.Request{Action: control.ActionRestart, Name: name, User: "root"})
+	if err == nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		fmt.Printf("Could not restart %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restarted %s (PID %d)\n", name, resp.Pid)
+}
+
+// removeAddon stops the addon and removes it with its origin and its registry entries. The
+// runtime registry disables it first, so igo does not start it again before it is removed.
+func removeAddon(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: ictl addon remove <name...>")
+		os.Exit(1)
+	}
+	failed := false
+	for _, name := range args {
+		addonPath := filepath.Join(igoAddonPath, name)
+		if _, err := os.Stat(addonPath); err != nil || !unitNameRegexp.MatchString(name) {
+			fmt.Printf("Addon %s is not installed\n", name)
+			failed = true
+			continue
+		}
+		runtimeRegistry := filepath.Join(igoRunPath, registryName)
+		disabled := map[string]RegistryEntry{name: {Enabled: false}}
+		if err := updateRegistry(runtimeRegistry, []string{name}, disabled); err != nil {
+			fmt.Printf("Could not disable %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if findAddonState(name) != "" {
+			fmt.Printf("Stopping %s ...\n", name)
+			resp, err := sendControlRequest(control.Request{Action: control.ActionStop, Name: name, User: "root"})
+			if err == nil && resp.Error != "" {
+				err = errors.New(resp.Error)
+			}
+			if err != nil {
+				fmt.Printf("Could not stop %s: %v\n", name, err)
+				failed = true
+				continue
+			}
+		}
+		removed := filepath.Join(igoStagingPath, name+".removed")
+		os.RemoveAll(removed)
+		err := os.MkdirAll(igoStagingPath, 0700)
+		if err == nil {
+			err = os.Rename(addonPath, removed)
+		}
+		if err != nil {
+			fmt.Printf("Could not remove %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		os.RemoveAll(removed)
+		os.RemoveAll(filepath.Join(igoOriginPath, name))
+		for _, registryPath := range []string{runtimeRegistry, filepath.Join(igoConfigDir, registryName)} {
+			registry := readRegistry(registryPath)
+			if _, ok := registry[name]; !ok {
+				continue
+			}
+			delete(registry, name)
+			if err := writeRegistry(registryPath, registry); err != nil {
+				fmt.Printf("Could not update the registry %s: %v\n", registryPath, err)
+			}
+		}
+		fmt.Printf("Addon %s removed\n", name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// listAddons prints the addons with their state in igo and where they were installed from.
+func listAddons() {
+	entries, err := os.ReadDir(igoAddonPath)
+	if err != nil {
+		fmt.Println("Could not read the addons: ", err)
+		os.Exit(1)
+	}
+	runtimeRegistry := readRegistry(filepath.Join(igoRunPath, registryName))
+	persistentRegistry := readRegistry(filepath.Join(igoConfigDir, registryName))
+	states, _ := fetchUnitStates()
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Println("No addons found.")
+		return
+	}
+	format := "%-16s %-18s %-8s %-17s %-17s %s\n"
+	fmt.Printf(format, "Name", "State", "Enabled", "Installed", "Origin", "Source")
+	fmt.Println(strings.Repeat("-", 100))
+	for _, name := range names {
+		dir := filepath.Join(igoAddonPath, name)
+		executable, ok := addonExecutable(dir, name)
+		if !ok {
+			continue
+		}
+		enabled := filepath.Ext(executable) == ".start"
+		if entry, ok := persistentRegistry[name]; ok {
+			enabled = entry.Enabled
+		}
+		if entry, ok := runtimeRegistry[name]; ok {
+			enabled = entry.Enabled
+		}
+		state := getValueOr(addonState(states, name), "-")
+		installed, source := "image", "-"
+		if info := readInstallInfo(dir); info != nil {
+			installed = info.InstalledAt.Local().Format("2006-01-02 15:04")
+			source = info.Source
+		}
+		origin := "-"
+		if _, ok := addonExecutable(filepath.Join(igoOriginPath, name), name); ok {
+			origin = "image"
+			if info := readInstallInfo(filepath.Join(igoOriginPath, name)); info != nil {
+				origin = info.InstalledAt.Local().Format("2006-01-02 15:04")
+			}
+		}
+		fmt.Printf(format, name, state, strconv.FormatBool(enabled), installed, origin, source)
+	}
+}
+
+// addon manages the addons of igo, they run as root, so only root can install them.
+func addon(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: ictl addon [list|install|upgrade|remove]")
+		os.Exit(1)
+	}
+	if linuxUser.Username != "root" {
+		fmt.Println("Only root can manage the addons")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "list":
+		listAddons()
+	case "install":
+		installAddon(args[1:], false)
+	case "upgrade":
+		installAddon(args[1:], true)
+	case "remove":
+		removeAddon(args[1:])
+	default:
+		fmt.Println("Usage: ictl addon [list|install|upgrade|remove]")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceDir(t *testing.T) {
+	igoStagingPath = t.TempDir()
+	addons := t.TempDir()
+	dst := filepath.Join(addons, "web")
+	src := filepath.Join(igoStagingPath, "web")
+	os.Mkdir(src, 0755)
+	os.WriteFile(filepath.Join(src, "version"), []byte("1"), 0644)
+	if previous, err := replaceDir(src, dst); err != nil || previous != "" {
+		t.Fatalf("the first install should have no previous version, got %q %v", previous, err)
+	}
+
+	os.Mkdir(src, 0755)
+	os.WriteFile(filepath.Join(src, "version"), []byte("2"), 0644)
+	previous, err := replaceDir(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "version")); string(data) != "2" {
+		t.Errorf("the new version should be installed, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(previous, "version")); string(data) != "1" {
+		t.Errorf("the previous version should be returned, got %q", data)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("the staged dir should be moved")
+	}
+}
+
+func TestStageAddon(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the staged files are chowned to root")
+	}
+	igoStagingPath = t.TempDir()
+	source := filepath.Join(t.TempDir(), "web")
+	os.Mkdir(source, 0777)
+	os.WriteFile(filepath.Join(source, "web.start"), []byte("#!/bin/bash\n"), 0777)
+
+	staged, name, err := stageAddon(source, "", false)
+	if err != nil || name != "web" || staged != filepath.Join(igoStagingPath, "web") {
+		t.Fatalf("the name should come from the dir, got %s %s %v", staged, name, err)
+	}
+	if info, err := os.Stat(filepath.Join(staged, "web.start")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("only root should write the staged files, got %v %v", info.Mode(), err)
+	}
+	if path, ok := addonExecutable(staged, "web"); !ok || path != filepath.Join(staged, "web.start") {
+		t.Error("the executable of the addon should be found")
+	}
+
+	// an archive with the addon in its top dir
+	archive := filepath.Join(t.TempDir(), "web-1.2.tgz")
+	if out, err := exec.Command("tar", "-czf", archive, "-C", filepath.Dir(source), "web").CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	if !isArchive(archive) {
+		t.Error("a .tgz should be an archive")
+	}
+	if _, name, err := stageAddon(archive, "", false); err != nil || name != "web" {
+		t.Errorf("the name should come from the top dir of the archive, got %s %v", name, err)
+	}
+	if _, _, err := stageAddon(archive, "../web", false); err == nil {
+		t.Error("an invalid name should be rejected")
+	}
+}
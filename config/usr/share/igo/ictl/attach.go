@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+const defaultDetachKeys = "ctrl-p,ctrl-q"
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	termios := &syscall.Termios{}
+	if err := ioctl(fd, ioctlGetTermios, uintptr(unsafe.Pointer(termios))); err != nil {
+		return nil, err
+	}
+	return termios, nil
+}
+
+func setTermios(fd uintptr, termios *syscall.Termios) error {
+	return ioctl(fd, ioctlSetTermios, uintptr(unsafe.Pointer(termios)))
+}
+
+// makeRaw switches the terminal to raw mode like cfmakeraw, it returns the state to restore.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	old, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func getTermSize(fd uintptr) (uint16, uint16, error) {
+	ws := struct{ Row, Col, X, Y uint16 }{}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return 0, 0, err
+	}
+	return ws.Row, ws.Col, nil
+}
+
+// parseDetachKeys parses a comma separated key list like docker does: a single character,
+// or ctrl-<key> where key is a letter or one of @[\]^_
+func parseDetachKeys(keys string) ([]byte, error) {
+	var seq []byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		switch {
+		case len(key) == 1:
+			seq = append(seq, key[0])
+		case len(key) == 6 && strings.HasPrefix(strings.ToLower(key), "ctrl-"):
+			c := key[5]
+			switch {
+			case c >= 'a' && c <= 'z':
+				seq = append(seq, c-'a'+1)
+			case c >= 'A' && c <= 'Z':
+				seq = append(seq, c-'A'+1)
+			case strings.IndexByte("@[\\]^_", c) >= 0:
+				seq = append(seq, c-'@')
+			default:
+				return nil, fmt.Errorf("invalid detach key: %s", key)
+			}
+		default:
+			return nil, fmt.Errorf("invalid detach key: %s", key)
+		}
+	}
+	return seq, nil
+}
+
+// detachMatcher finds the detach sequence in the input, the keys of an unfinished sequence are
+// held back until it is clear they are input.
+type detachMatcher struct {
+	keys []byte
+	pos  int
+}
+
+// feed returns the bytes to send to the unit and true if the detach sequence was typed.
+func (m *detachMatcher) feed(in []byte) ([]byte, bool) {
+	var out []byte
+	for _, b := range in {
+		if b == m.keys[m.pos] {
+			m.pos++
+			if m.pos == len(m.keys) {
+				return out, true
+			}
+			continue
+		}
+		if m.pos > 0 {
+			out = append(out, m.keys[:m.pos]...)
+			m.pos = 0
+			if b == m.keys[0] {
+				m.pos = 1
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+// attach connects the terminal to a running unit through the control socket of igo.
+func attach(args []string) {
+	readOnly := false
+	detachKeys := defaultDetachKeys
+	var names []string
+	for _, arg := range args {
+		switch {
+		case arg == "--read-only" || arg == "-read-only":
+			readOnly = true
+		case strings.HasPrefix(arg, "--detach-keys="):
+			detachKeys = strings.TrimPrefix(arg, "--detach-keys=")
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) != 1 {
+		fmt.Println("Usage: ictl attach [--read-only] [--detach-keys=" + defaultDetachKeys + "] <unit>")
+		os.Exit(1)
+	}
+	keys, err := parseDetachKeys(detachKeys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		fmt.Println("Could not connect to igo: ", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	req := control.Request{Action: control.ActionAttach, Name: names[0], User: unitOwner, ReadOnly: readOnly}
+	if err := control.WriteMessage(conn, req); err != nil {
+		fmt.Println("Could not send to igo: ", err)
+		os.Exit(1)
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		fmt.Println("No answer from igo: ", err)
+		os.Exit(1)
+	}
+	if resp.Error != "" {
+		fmt.Println("Could not attach to", names[0]+":", resp.Error)
+		os.Exit(1)
+	}
+
+	stdin := os.Stdin.Fd()
+	var oldState *syscall.Termios
+	if !resp.ReadOnly {
+		oldState, err = makeRaw(stdin)
+	}
+	if resp.ReadOnly || err != nil {
+		if !resp.Pty {
+			fmt.Println("[attached read-only to", names[0], "it has no pty, press ctrl-c to detach]")
+		} else {
+			fmt.Println("[attached read-only to", names[0]+", press ctrl-c to detach]")
+		}
+		io.Copy(os.Stdout, reader)
+		return
+	}
+	restore := func() { setTermios(stdin, oldState) }
+	defer restore()
+	fmt.Printf("[attached to %s, detach with %s]\r\n", names[0], detachKeys)
+
+	sendSize := func() {
+		if rows, cols, err := getTermSize(stdin); err == nil {
+			control.WriteFrame(conn, control.FrameResize, control.ResizePayload(rows, cols))
+		}
+	}
+	sendSize()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			sendSize()
+		}
+	}()
+
+	done := make(chan string, 2)
+	go func() {
+		io.Copy(os.Stdout, reader)
+		done <- "the unit exited"
+	}()
+	go func() {
+		matcher := &detachMatcher{keys: keys}
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- "stdin closed"
+				return
+			}
+			out, detach := matcher.feed(buf[:n])
+			if len(out) > 0 {
+				if err := control.WriteFrame(conn, control.FrameInput, out); err != nil {
+					done <- "the unit exited"
+					return
+				}
+			}
+			if detach {
+				done <- "detached"
+				return
+			}
+		}
+	}()
+	reason := <-done
+	restore()
+	fmt.Printf("\r\n[%s from %s]\n", reason, names[0])
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+// unitOwner is the owner of the units restart, stop and attach work on. It is the user by
+// default, the units of others are reached through igo, which checks its policy.
+var unitOwner string
+
+func isDelegated() bool {
+	return unitOwner != linuxUser.Username
+}
+
+// fetchUnitStates returns the units the user can see according to the policy of igo, it is
+// the first update of a watch.
+func fetchUnitStates() ([]control.UnitState, error) {
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to igo: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := control.WriteMessage(conn, control.Request{Action: control.ActionWatch, User: linuxUser.Username}); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	var update control.Update
+	if err := control.ReadMessage(reader, &update); err != nil {
+		return nil, err
+	}
+	return update.Units, nil
+}
+
+// findOwnerUnitNames returns the names of the units of the owner igo knows about.
+func findOwnerUnitNames() []string {
+	states, err := fetchUnitStates()
+	if err != nil {
+		fmt.Println("Could not list the units: ", err)
+		os.Exit(1)
+	}
+	var names []string
+	for _, state := range states {
+		if state.User == unitOwner {
+			names = append(names, state.Name)
+		}
+	}
+	return names
+}
+
+// fetchPermissions returns the permissions of the user on the units of others.
+func fetchPermissions() map[string]bool {
+	perms := make(map[string]bool)
+	resp, err := sendControlRequest(control.Request{Action: control.ActionPermissions})
+	if err != nil {
+		return perms
+	}
+	for _, perm := range resp.Permissions {
+		perms[perm] = true
+	}
+	return perms
+}
+
+// stopThroughIgo stops the units of the owner with the stop-others permission, igo waits for
+// the exit and sends SIGKILL after the timeout.
+func stopThroughIgo(names []string, timeout int, noBlock bool) {
+	if runAll {
+		names = findOwnerUnitNames()
+	}
+	failed := false
+	for _, name := range names {
+		req := control.Request{Action: control.ActionStop, Name: name, User: unitOwner, Timeout: timeout}
+		if noBlock {
+			// igo writes the kill file before it waits, the answer is not needed
+			conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+			if err == nil {
+				err = control.WriteMessage(conn, req)
+				conn.Close()
+			}
+			if err != nil {
+				fmt.Printf("Could not stop %s of %s: %v\n", name, unitOwner, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("Stop requested for %s of %s\n", name, unitOwner)
+			continue
+		}
+		fmt.Printf("Stopping %s of %s ...\n", name, unitOwner)
+		resp, err := sendControlRequest(req)
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Printf("Could not stop %s of %s: %v\n", name, unitOwner, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Stopped %s of %s\n", name, unitOwner)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// delegatedRows returns the units of the other users igo lets the user see, their processes
+// can not be read by the user, the usage comes from igo.
+func delegatedRows() []unitRow {
+	if linuxUser.Username == "root" {
+		return nil
+	}
+	states, err := fetchUnitStates()
+	if err != nil {
+		return nil
+	}
+	var rows []unitRow
+	for _, state := range states {
+		if state.User == linuxUser.Username {
+			continue
+		}
+		row := unitRow{Name: state.Name, User: state.User, Type: state.Type, State: state.State, Pid: state.Pid,
+			Reason: state.Reason, RssBytes: state.RssBytes, Restarts: state.Restarts, fromIgo: true}
+		if state.State == control.StateExited || state.State == control.StateDummy {
+			exitCode := state.ExitCode
+			row.ExitCode = &exitCode
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
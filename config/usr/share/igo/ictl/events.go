@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+func printEvent(e journal.Event, asJson bool) {
+	if asJson {
+		json.NewEncoder(os.Stdout).Encode(e)
+		return
+	}
+	status := "-"
+	if e.ExitCode != nil {
+		status = "exit=" + strconv.Itoa(*e.ExitCode)
+	} else if e.Pid != 0 {
+		status = "pid=" + strconv.Itoa(e.Pid)
+	}
+	fmt.Printf("%-19s %-7s %-12s %-6s %-16s %-10s %-12s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Level, e.User, e.Type, e.Name, e.Event, status, e.Reason)
+}
+
+// events prints the journal of igo, with follow it waits for the new events like tail -f. igo
+// reads the journal, the users see the events of their units, root and the read-logs
+// permission of the policy every event.
+func events(args []string) {
+	args, follow := popFlag(args, "-f", "--follow")
+	args, asJson := popFlag(args, "--json", "-json")
+	args, unit, _ := popValue(args, "--unit", "-unit")
+	if len(args) != 0 {
+		fmt.Println("Usage: ictl events [-f] [--json] [--unit <name>]")
+		os.Exit(1)
+	}
+
+	err := readEvents(control.Request{Action: control.ActionEvents, Name: unit, Follow: follow}, func(e journal.Event) {
+		printEvent(e, asJson)
+	})
+	if err != nil {
+		fmt.Println("Could not read the journal: ", err)
+		os.Exit(1)
+	}
+}
+
+// readEvents calls fn with the events igo sends for the request, until igo closes the stream.
+func readEvents(req control.Request, fn func(journal.Event)) error {
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		return fmt.Errorf("could not connect to igo: %w", err)
+	}
+	defer conn.Close()
+	if err := control.WriteMessage(conn, req); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	for {
+		var e journal.Event
+		if err := control.ReadMessage(reader, &e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fn(e)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+// fetchRunnableEnv returns the env igo starts the start or the stop script of the unit with.
+func fetchRunnableEnv(name string, stopConfig bool) (*control.RunnableEnv, error) {
+	resp, err := sendControlRequest(control.Request{Action: control.ActionEnv, Name: name, User: unitOwner, StopConfig: stopConfig})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Env, nil
+}
+
+func describeId(id int, lookup func(string) (string, error)) string {
+	if name, err := lookup(strconv.Itoa(id)); err == nil {
+		return fmt.Sprintf("%d (%s)", id, name)
+	}
+	return strconv.Itoa(id)
+}
+
+// showEnv prints the effective env of a unit like env does, the rest is in comments above it.
+func showEnv(args []string) {
+	args, stopConfig := popFlag(args, "--stop-config", "-stop-config")
+	args, asJson := popFlag(args, "--json", "-json")
+	if len(args) != 1 {
+		fmt.Println("Usage: ictl show-env [--stop-config] [--json] <unit>")
+		os.Exit(1)
+	}
+	env, err := fetchRunnableEnv(args[0], stopConfig)
+	if err != nil {
+		fmt.Printf("Could not get the env of %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	if asJson {
+		json.NewEncoder(os.Stdout).Encode(env)
+		return
+	}
+	userName := func(uid string) (string, error) {
+		u, err := user.LookupId(uid)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	}
+	groupName := func(gid string) (string, error) {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	}
+	fmt.Printf("# path: %s\n", env.Path)
+	fmt.Printf("# wd:   %s\n", env.Wd)
+	fmt.Printf("# uid:  %s, gid: %s\n", describeId(env.Uid, userName), describeId(env.Gid, groupName))
+	if env.Pid != 0 {
+		namespaces := "of igo"
+		if len(env.Namespaces) != 0 {
+			namespaces = strings.Join(env.Namespaces, ", ")
+		}
+		fmt.Printf("# pid:  %d, namespaces: %s\n", env.Pid, namespaces)
+	} else {
+		fmt.Println("# the unit is not running")
+	}
+	for _, e := range env.Env {
+		fmt.Println(e)
+	}
+}
+
+// execInUnit runs a command through igo in the env, wd, credentials and namespaces of the unit,
+// it exits with the exit code of the command. A terminal gets a pty like ssh.
+func execInUnit(args []string) {
+	var command []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, command = args[:i], args[i+1:]
+			break
+		}
+	}
+	args, stopConfig := popFlag(args, "--stop-config", "-stop-config")
+	args, noTty := popFlag(args, "--no-tty", "-no-tty", "-T")
+	if len(command) == 0 && len(args) > 1 {
+		args, command = args[:1], args[1:]
+	}
+	if len(args) != 1 || len(command) == 0 {
+		fmt.Println("Usage: ictl exec [--stop-config] [--no-tty] <unit> -- <command...>")
+		os.Exit(1)
+	}
+	name := args[0]
+
+	stdin := os.Stdin.Fd()
+	_, inErr := getTermios(stdin)
+	_, outErr := getTermios(os.Stdout.Fd())
+	tty := !noTty && inErr == nil && outErr == nil
+
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		fmt.Println("Could not connect to igo: ", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	req := control.Request{Action: control.ActionExec, Name: name, User: unitOwner, StopConfig: stopConfig,
+		Command: command, Tty: tty, Term: os.Getenv("TERM")}
+	if err := control.WriteMessage(conn, req); err != nil {
+		fmt.Println("Could not send to igo: ", err)
+		os.Exit(1)
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		fmt.Println("No answer from igo: ", err)
+		os.Exit(1)
+	}
+	if resp.Error != "" {
+		fmt.Printf("Could not exec in %s: %s\n", name, resp.Error)
+		os.Exit(1)
+	}
+
+	restore := func() {}
+	if tty {
+		if oldState, err := makeRaw(stdin); err == nil {
+			restore = func() { setTermios(stdin, oldState) }
+		}
+		sendSize := func() {
+			if rows, cols, err := getTermSize(stdin); err == nil {
+				control.WriteFrame(conn, control.FrameResize, control.ResizePayload(rows, cols))
+			}
+		}
+		sendSize()
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		go func() {
+			for range winch {
+				sendSize()
+			}
+		}()
+	}
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if control.WriteFrame(conn, control.FrameInput, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				control.WriteFrame(conn, control.FrameEOF, nil)
+				return
+			}
+		}
+	}()
+
+	exitCode := 255
+	for {
+		typ, data, err := control.ReadFrame(reader)
+		if err != nil {
+			break
+		}
+		if typ == control.FrameExit {
+			exitCode, _ = control.ParseExit(data)
+			break
+		}
+		if typ == control.FrameStderr {
+			os.Stderr.Write(data)
+		} else {
+			os.Stdout.Write(data)
+		}
+	}
+	restore()
+	os.Exit(exitCode)
+}
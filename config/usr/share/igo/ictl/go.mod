@@ -0,0 +1,9 @@
+module github.com/ui3o/codebox/ictl
+
+go 1.23.0
+
+require github.com/ui3o/codebox/igo v0.0.0
+
+require golang.org/x/sys v0.30.0
+
+replace github.com/ui3o/codebox/igo => ../igo
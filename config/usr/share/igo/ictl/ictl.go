@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -12,7 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"time"
+
+	"github.com/ui3o/codebox/igo/control"
 )
 
 var (
@@ -22,9 +27,15 @@ var (
 	unitConfigToLookFor = getEnvString("IGO_UNIT_CONFIG", "config.py")
 	pollTimeout         = getEnvString("IGO_POLL_TIMEOUT", "3")
 	killPatience        = getEnvString("IGO_KILL_PATIENCE", "3")
-	igoRootPath         = getEnvString("IGO_ROOT_PATH", "/home/podman/ss/pilot_zoli/go/goapp/igo") // when igo starts it sets IGO_ROOT_PATH
+	igoRootPath         = getEnvString("IGO_ROOT_PATH", "/usr/share/igo") // when igo starts it sets IGO_ROOT_PATH
 	igoUnitSymlinkPath  = path.Join(igoRootPath, ".runtime/units")
 	igoRunPath          = path.Join(igoRootPath, ".runtime/run")
+	igoAddonPath        = path.Join(igoRootPath, "addons")
+	igoOriginPath       = path.Join(igoRootPath, ".runtime/origins")
+	igoStagingPath      = path.Join(igoRootPath, ".runtime/staging")
+	igoConfigDir        = getEnvString("IGO_CONFIG_DIR", "/etc/igo")
+	registryName        = "enabled.json"
+	igoBinPath          = getEnvString("IGO_BIN", path.Join(igoRootPath, "igo/igo"))
 )
 
 func getEnvString(env string, def string) string {
@@ -35,23 +46,41 @@ func getEnvString(env string, def string) string {
 }
 
 type ProcessInfo struct {
-	PID  int
-	User string
-	Type string
-	Name string
-	Cmd  string
+	PID    int
+	User   string
+	Type   string
+	Name   string
+	Cmd    string
+	Reason string
 }
 
 func findProcessDummies() []ProcessInfo {
-	cmd := exec.Command("find", igoRunPath, "-type", "f", "-name", "*.origin.dummy")
+	return findRunMarkers("*.origin.dummy")
+}
+
+// findProcessSkipped returns the units igo did not start because of a failed condition,
+// the reason is read from the skip file.
+func findProcessSkipped() []ProcessInfo {
+	skipped := findRunMarkers("*.skipped")
+	for i := range skipped {
+		if reason, err := os.ReadFile(skipped[i].Cmd); err == nil {
+			skipped[i].Reason = strings.TrimSpace(string(reason))
+		}
+	}
+	return skipped
+}
+
+// findRunMarkers returns the units that have a marker file matching pattern in igo's run directory.
+func findRunMarkers(pattern string) []ProcessInfo {
+	cmd := exec.Command("find", igoRunPath, "-type", "f", "-name", pattern)
 	output, err := cmd.Output()
 	if err != nil {
-		fmt.Println("No dumy found")
+		fmt.Println("No", pattern, "found")
 		return nil
 	}
 
 	processDummies := []ProcessInfo{}
-	foundDummies := strings.Split(strings.TrimSpace(string(output)), "\n")
+	foundDummies := strings.Fields(string(output))
 	for _, foundUnit := range foundDummies {
 		// Strip igoRunPath prefix
 		relPath := strings.TrimPrefix(foundUnit, igoRunPath)
@@ -65,6 +94,10 @@ func findProcessDummies() []ProcessInfo {
 			unitType = "addon"
 			unitUser = "root"
 			unitName = parts[1]
+		} else if parts[0] == "origins" {
+			unitType = "origin"
+			unitUser = "root"
+			unitName = parts[1]
 		} else {
 			unitType = "unit"
 			unitUser = parts[0]
@@ -166,22 +199,11 @@ func start(units []string) {
 		return
 	}
 
-	userHome := linuxUser.HomeDir
-	// find units in user's home
-	cmd := exec.Command("find", userHome, "-mindepth", "2", "-maxdepth", "2", "-type", "f", "-name", unitConfigToLookFor)
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Println("No units found for user: ", linuxUser.Name, ", make sure the unit is in the root of your home directory: ", userHome)
+	usersUnits := findUserUnits()
+	if usersUnits == nil {
 		return
 	}
 
-	usersUnits := make(map[string]string)
-	foundUnits := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, foundUnit := range foundUnits {
-		unitName := filepath.Base(filepath.Dir(foundUnit))
-		usersUnits[unitName] = filepath.Dir(foundUnit)
-	}
-
 	var unitsToStart []string
 	if runAll {
 		for unit := range usersUnits {
@@ -282,176 +304,312 @@ func getRunDirForProcess(processInfo ProcessInfo) string {
 	return path.Join(igoRunPath, processInfo.User, processInfo.Name)
 }
 
-// kill process by writing a unitname_stop.x file
-func stop(procNames []string) {
+// restart asks igo through the control socket to restart the units, igo keeps them registered
+// and kills the old process tree if it does not exit in time.
+func restart(procNames []string) {
+	procNames, timeoutValue, _ := popValue(procNames, "--timeout", "-timeout", "-t")
+	timeout, err := strconv.Atoi(getValueOr(timeoutValue, killPatience))
+	if err != nil {
+		fmt.Println("Invalid timeout: ", timeoutValue)
+		os.Exit(1)
+	}
 	if !runAll && len(procNames) == 0 {
-		fmt.Println("No units specified, to stop all for the user use the -a=T or -all=T flag")
-		return
+		fmt.Println("No units specified, to restart all for the user use the -a=T or -all=T flag")
+		os.Exit(1)
 	}
-
-	var envsToLookFor []string
-	if len(procNames) > 0 {
-		for _, procName := range procNames {
-			envsToLookFor = append(envsToLookFor, fmt.Sprintf("IGO_PROCESS_NAME=%s", procName))
-		}
-	} else {
-		envsToLookFor = []string{fmt.Sprintf("IGO_PROCESS_USER=%s", linuxUser.Username)}
+	if runAll && isDelegated() {
+		procNames = findOwnerUnitNames()
+	} else if runAll {
+		procNames = findStartedUnitNames()
 	}
 
-	processes := findPIDsByEnvLines(envsToLookFor)
-	for _, process := range processes {
-		procRunDir := getRunDirForProcess(process)
-		if err := writeStopFile(procRunDir); err != nil {
-			println(err)
+	failed := false
+	for _, name := range procNames {
+		fmt.Printf("Restarting %s ...\n", name)
+		resp, err := sendControlRequest(control.Request{Action: control.ActionRestart, Name: name, User: unitOwner, Timeout: timeout})
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
 		}
+		if err != nil {
+			fmt.Printf("Could not restart %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Restarted %s, new PID %d\n", name, resp.Pid)
 	}
+	if failed {
+		os.Exit(1)
+	}
+}
 
-	dummies := findProcessDummies()
-	for _, dummy := range dummies {
-		shouldStop := false
-		if len(procNames) > 0 {
-			for _, name := range procNames {
-				if dummy.Name == name {
-					shouldStop = true
-					break
-				}
-			}
-		} else {
-			// If no names specified, stop all for user
-			if linuxUser.Username == "root" {
-				shouldStop = true
-			} else if dummy.User == linuxUser.Username {
-				shouldStop = true
-			}
-		}
-		if shouldStop {
-			dummyPath := dummy.Cmd
-			if err := os.Remove(dummyPath); err != nil {
-				fmt.Printf("Failed to remove dummy file %s: %v\n", dummyPath, err)
-			} else {
-				fmt.Printf("Removed dummy file for unit %s (%s)\n", dummy.Name, dummyPath)
-			}
+// findStartedUnitNames returns the names of the running, waiting and skipped units of the user.
+func findStartedUnitNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(info ProcessInfo) {
+		if info.User == linuxUser.Username && !seen[info.Name] {
+			seen[info.Name] = true
+			names = append(names, info.Name)
 		}
 	}
+	for _, info := range findPIDsByEnvLines([]string{fmt.Sprintf("IGO_PROCESS_USER=%s", linuxUser.Username)}) {
+		add(info)
+	}
+	for _, info := range append(findProcessDummies(), findProcessSkipped()...) {
+		add(info)
+	}
+	return names
+}
 
-	if len(processes) == 0 {
-		return
+// sendControlRequest sends a request to igo and waits for the response.
+func sendControlRequest(req control.Request) (control.Response, error) {
+	var resp control.Response
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		return resp, fmt.Errorf("could not connect to igo: %w", err)
 	}
+	defer conn.Close()
+	if err := control.WriteMessage(conn, req); err != nil {
+		return resp, err
+	}
+	err = control.ReadMessage(bufio.NewReader(conn), &resp)
+	return resp, err
+}
 
-	timeout, _ := strconv.Atoi(pollTimeout)
-	maxWait, _ := strconv.Atoi(killPatience) // seconds
-
-	// dont hold up the prompt
-	// start a goroutine to check and kill after patience
-	go func(processes []ProcessInfo, timeout, maxWait int) {
-		waited := 0
-		stillRunning := make(map[int]ProcessInfo)
-		time.Sleep(time.Duration(timeout) * time.Second)
-		for _, process := range processes {
-			stillRunning[process.PID] = process
-		}
-		for waited < maxWait && len(stillRunning) > 0 {
-			for pid := range stillRunning {
-				cmd := exec.Command("ps", "-p", fmt.Sprintf("%d", pid))
-				out, err := cmd.Output()
-				if err != nil || !strings.Contains(string(out), fmt.Sprintf("%d", pid)) {
-					// process exited
-					delete(stillRunning, pid)
-				}
-			}
-			if len(stillRunning) == 0 {
-				break
-			}
-			time.Sleep(time.Duration(timeout) * time.Second)
-			waited += timeout
-		}
-		for pid := range stillRunning {
-			fmt.Printf("Process %d did not stop after %d seconds, sending SIGKILL\n", pid, maxWait)
-			syscall.Kill(pid, syscall.SIGKILL)
-		}
-	}(processes, timeout, maxWait)
+type RegistryEntry struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path,omitempty"`
 }
 
-func restart(procNames []string) {
-	fmt.Println("NOT implemented!!")
-	return
-	//stop(procNames)
-	//time.Sleep(1 * time.Second)
-	//start(procNames)
+// Registry is the same enablement registry igo reads, it maps names to their enablement.
+type Registry map[string]RegistryEntry
+
+func readRegistry(registryPath string) Registry {
+	registry := Registry{}
+	raw, err := os.ReadFile(registryPath)
+	if err != nil {
+		return registry
+	}
+	if err := json.Unmarshal(raw, &registry); err != nil {
+		fmt.Println("Could not parse registry: ", registryPath, " err:", err)
+	}
+	return registry
 }
 
-func getProcessStartTime(pid int) string {
-	cmd := exec.Command("ps", "-p", fmt.Sprintf("%d", pid), "-o", "start=")
-	out, err := cmd.Output()
+func writeRegistry(registryPath string, registry Registry) error {
+	raw, err := json.MarshalIndent(registry, "", "  ")
 	if err != nil {
-		return "-"
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(registryPath), 0755); err != nil {
+		return err
 	}
-	return strings.TrimSpace(string(out))
+	// write and rename, so igo never reads a half written registry
+	tmpPath := registryPath + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, registryPath)
 }
 
-func listUnits() {
-	var envsToLookFor []string
-	if linuxUser.Username == "root" {
-		envsToLookFor = []string{"IGO_PROCESS_TYPE=origin", "IGO_PROCESS_TYPE=addon", "IGO_PROCESS_TYPE=unit"}
-	} else {
-		envsToLookFor = []string{fmt.Sprintf("IGO_PROCESS_USER=%s", linuxUser.Username)}
+func updateRegistry(registryPath string, names []string, entries map[string]RegistryEntry) error {
+	registry := readRegistry(registryPath)
+	for _, name := range names {
+		registry[name] = entries[name]
 	}
+	return writeRegistry(registryPath, registry)
+}
 
-	processes := findPIDsByEnvLines(envsToLookFor)
-	dummies := findProcessDummies()
+// isAddon returns true if the name is an addon of igo, only root can manage addons.
+func isAddon(name string) bool {
+	if linuxUser.Username != "root" {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(igoAddonPath, name))
+	return err == nil && fi.IsDir()
+}
 
-	if len(processes) == 0 && len(dummies) == 0 {
-		fmt.Println("No running units found.")
-		return
+/*
+names []string -> addons or units to enable or disable, with the -a | -all flag all units of the user.
+The state is written to the persistent registry: ~/.config/igo/enabled.json for units and
+IGO_CONFIG_DIR/enabled.json for addons, igo applies it at boot.
+With now the change is applied at once: units are started or stopped, for addons the
+runtime registry of igo is updated as well, which igo reads in every poll cycle.
+*/
+func setEnabled(names []string, enabled bool, now bool) {
+	if !runAll && len(names) == 0 {
+		fmt.Println("No units specified, to use all units of the user use the -a=T or -all=T flag")
+		os.Exit(1)
 	}
 
-	// Pretty print
-	fmt.Printf("%-12s %-8s %-12s %-8s %-12s %s\n", "Started", "PID", "User", "Type", "Name", "Cmd")
-	fmt.Println(strings.Repeat("-", 80))
-	for _, proc := range processes {
-		user := proc.User
-		if user == "" {
-			user = "-" //linuxUser.Username
+	var addons, units []string
+	addonEntries := make(map[string]RegistryEntry)
+	unitEntries := make(map[string]RegistryEntry)
+	usersUnits := findUserUnits()
+	if runAll {
+		names = names[:0]
+		for unit := range usersUnits {
+			names = append(names, unit)
 		}
-		typ := proc.Type
-		if typ == "" {
-			typ = "-"
+	}
+	userRegistryPath := filepath.Join(linuxUser.HomeDir, ".config/igo", registryName)
+	userRegistry := readRegistry(userRegistryPath)
+	for _, name := range names {
+		if unitPath, ok := usersUnits[name]; ok {
+			units = append(units, name)
+			unitEntries[name] = RegistryEntry{Enabled: enabled, Path: unitPath}
+		} else if isAddon(name) {
+			addons = append(addons, name)
+			addonEntries[name] = RegistryEntry{Enabled: enabled}
+		} else if entry, ok := userRegistry[name]; ok && !enabled {
+			// the unit is gone from the home, but it can still be disabled
+			units = append(units, name)
+			unitEntries[name] = RegistryEntry{Enabled: enabled, Path: entry.Path}
+		} else {
+			fmt.Printf("Unit %s NOT found for user %s\n", name, linuxUser.Username)
 		}
-		name := proc.Name
-		if name == "" {
-			name = "-"
+	}
+
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	failed := false
+	if len(units) > 0 {
+		if err := updateRegistry(userRegistryPath, units, unitEntries); err != nil {
+			fmt.Println("Failed to update registry: ", userRegistryPath, " err:", err)
+			failed = true
+		} else {
+			fmt.Printf("Units %s: %s\n", state, strings.Join(units, ", "))
 		}
-		cmd := proc.Cmd
-		if len(cmd) > 40 {
-			cmd = cmd[:37] + "..."
+	}
+	if len(addons) > 0 {
+		registryPaths := []string{filepath.Join(igoConfigDir, registryName)}
+		if now {
+			registryPaths = append(registryPaths, filepath.Join(igoRunPath, registryName))
+		}
+		for _, registryPath := range registryPaths {
+			if err := updateRegistry(registryPath, addons, addonEntries); err != nil {
+				fmt.Println("Failed to update registry: ", registryPath, " err:", err)
+				failed = true
+			}
+		}
+		if !failed {
+			fmt.Printf("Addons %s: %s\n", state, strings.Join(addons, ", "))
 		}
-		started := getProcessStartTime(proc.PID)
-		fmt.Printf("%-12s %-8d %-12s %-8s %-12s %s\n", started, proc.PID, user, typ, name, cmd)
 	}
-	// print any found dummies as well.
-	for _, dummy := range dummies {
-		if linuxUser.Username != "root" && linuxUser.Username != dummy.User {
-			continue
+	if failed {
+		os.Exit(1)
+	}
+
+	if now && len(units) > 0 {
+		// start and stop work on the given names only
+		runAll = false
+		if enabled {
+			start(units)
+		} else {
+			stop(units)
 		}
-		user := dummy.User
-		if user == "" {
-			user = "-"
+	}
+}
+
+// check validates the given units of the user with igo check, without names all units of the
+// user are checked, so they can be fixed before ictl start.
+func check(units []string, asJson bool) {
+	usersUnits := findUserUnits()
+	if usersUnits == nil {
+		os.Exit(1)
+	}
+	if len(units) == 0 {
+		for unit := range usersUnits {
+			units = append(units, unit)
+		}
+	}
+	args := []string{"-root", igoRootPath, "check"}
+	if asJson {
+		args = append(args, "-json")
+	}
+	for _, unit := range units {
+		unitPath, ok := usersUnits[unit]
+		if !ok {
+			fmt.Printf("Unit %s NOT found for user %s\n", unit, linuxUser.Username)
+			os.Exit(1)
+		}
+		args = append(args, unitPath)
+	}
+	cmd := exec.Command(igoBinPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Println("Could not run igo check: ", err)
+		os.Exit(1)
+	}
+}
+
+// popFlag removes the flag given after the action from args, flag.Parse stops at the action.
+func popFlag(args []string, names ...string) ([]string, bool) {
+	var rest []string
+	found := false
+	for _, arg := range args {
+		matched := false
+		for _, name := range names {
+			if arg == name {
+				matched = true
+			}
+		}
+		if matched {
+			found = true
+		} else {
+			rest = append(rest, arg)
 		}
-		typ := dummy.Type
-		if typ == "" {
-			typ = "-"
+	}
+	return rest, found
+}
+
+// popValue removes a flag with its value given as "--name value" or "--name=value" from args.
+func popValue(args []string, names ...string) ([]string, string, bool) {
+	var rest []string
+	value, found := "", false
+	for i := 0; i < len(args); i++ {
+		matched := false
+		for _, name := range names {
+			if args[i] == name && i+1 < len(args) {
+				value, found, matched = args[i+1], true, true
+				i++
+			} else if v, ok := strings.CutPrefix(args[i], name+"="); ok {
+				value, found, matched = v, true, true
+			}
+			if matched {
+				break
+			}
 		}
-		name := dummy.Name
-		if name == "" {
-			name = "-"
+		if !matched {
+			rest = append(rest, args[i])
 		}
-		// Mark as dummy, no PID or Cmd
-		fmt.Printf("%-12s %-8s %-12s %-8s %-12s %s\n", "[DUMMY]", "-", user, typ, name, "[DUMMY]")
 	}
+	return rest, value, found
+}
 
+func getValueOr(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
 }
 
-func init() {
+func formatExitCode(code *int) string {
+	if code == nil {
+		return "-"
+	}
+	return strconv.Itoa(*code)
+}
+
+// setup parses the flags and drops the privileges to the target user, it runs in main so the
+// tests of the package do not parse the flags of the test binary.
+func setup() {
 	executingUser, err := user.Current()
 	if err != nil {
 		fmt.Println("Error:", err)
@@ -465,7 +623,7 @@ func init() {
 	flag.BoolVar(&runAll, "a", false, "True if we want to run all units of the user (shorthand) (can be: 1, 0, t, f, T, F, true, false, TRUE, FALSE, True, False)")
 	flag.StringVar(&filter, "filter", "", "Filter for type of unit, possible values: 'origin', 'addon', 'unit'")
 	flag.StringVar(&filter, "f", "", "Filter for type of unit (shorthand), possible values: 'origin', 'addon', 'unit'")
-	// TODO: implement filter by type. Will be usseful for root user only.
+	flag.StringVar(&unitOwner, "owner", "", "The owner of the units to restart, stop, attach to or show the status of, the units of others need a permission in the policy of igo")
 
 	flag.Parse()
 
@@ -474,6 +632,9 @@ func init() {
 		fmt.Println("Invalid user received in flag, fallback to executor: ", executingUser.Username, " ", err)
 		linuxUser = executingUser
 	}
+	if unitOwner == "" {
+		unitOwner = linuxUser.Username
+	}
 
 	// Drop privileges to the target user.
 	gid, _ := strconv.Atoi(linuxUser.Gid)
@@ -490,9 +651,26 @@ func init() {
 
 func help() {
 	fmt.Println("Usage: ictl -u=user -a=T/F [start|stop|restart|list|run]")
+	fmt.Println("       ictl -u=user list [--watch|--available] [--filter <type>] [--user <user>] [--state <state>] [--name <glob>] [-o json|yaml|wide]")
+	fmt.Println("       ictl -u=user -a=T/F stop [--no-block] [--timeout <seconds>] [unit...]")
+	fmt.Println("       ictl -u=user -a=T/F restart [--timeout <seconds>] [unit...]")
+	fmt.Println("       ictl -u=user -a=T/F [enable|disable] [--now] <name...>")
+	fmt.Println("       ictl -u=user check [--json] [unit...]")
+	fmt.Println("       ictl -u=user events [-f] [--json] [--unit <name>]")
+	fmt.Println("       ictl -u=user status [-n <lines>] [--exits <count>] [--json] [unit...]")
+	fmt.Println("       ictl -u=user top")
+	fmt.Println("       ictl -u=user new <name> [--template web|worker|oneshot|timer] [--wd <dir>] [--start] [-- <command...>]")
+	fmt.Println("       ictl -u=user attach [--read-only] [--detach-keys=ctrl-p,ctrl-q] <unit>")
+	fmt.Println("       ictl -u=user exec [--stop-config] [--no-tty] <unit> -- <command...>")
+	fmt.Println("       ictl -u=user show-env [--stop-config] [--json] <unit>")
+	fmt.Println("       ictl addon [install|upgrade] [--name <name>] [--build] [--no-restart] <dir|tar.gz>")
+	fmt.Println("       ictl addon [list|remove <name...>]")
+	fmt.Println("With -owner=user restart, stop and attach work on the units of the user, if the policy of igo allows it")
+	fmt.Println("Units are searched in ~/.config/units, ~/units and the : separated IGO_UNIT_PATH")
 }
 
 func main() {
+	setup()
 	args := flag.Args()
 	if len(args) < 1 {
 		help()
@@ -505,10 +683,30 @@ func main() {
 		stop(args[1:])
 	case "restart":
 		restart(args[1:])
+	case "enable", "disable":
+		names, now := popFlag(args[1:], "--now", "-now")
+		setEnabled(names, action == "enable", now)
+	case "attach":
+		attach(args[1:])
+	case "addon":
+		addon(args[1:])
+	case "exec":
+		execInUnit(args[1:])
+	case "show-env":
+		showEnv(args[1:])
+	case "top":
+		top(args[1:])
+	case "new":
+		newUnit(args[1:])
+	case "events":
+		events(args[1:])
+	case "check":
+		units, asJson := popFlag(args[1:], "--json", "-json")
+		check(units, asJson)
 	case "list":
-		listUnits()
+		list(args[1:])
 	case "status":
-		listUnits()
+		unitStatus(args[1:])
 	default:
 		help()
 		os.Exit(1)
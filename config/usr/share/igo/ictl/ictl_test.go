@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPopFlag(t *testing.T) {
+	rest, found := popFlag([]string{"web", "-w", "--json", "--watch"}, "--watch", "-w")
+	if !found || !reflect.DeepEqual(rest, []string{"web", "--json"}) {
+		t.Errorf("every form of the flag should be removed, got %v %v", rest, found)
+	}
+	if rest, found := popFlag([]string{"web"}, "--watch"); found || !reflect.DeepEqual(rest, []string{"web"}) {
+		t.Errorf("a missing flag should not be found, got %v %v", rest, found)
+	}
+}
+
+func TestPopValue(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		rest  []string
+		value string
+		found bool
+	}{
+		{[]string{"-o", "json", "web"}, []string{"web"}, "json", true},
+		{[]string{"web", "--output=yaml"}, []string{"web"}, "yaml", true},
+		{[]string{"--output="}, nil, "", true},
+		// the last one wins like in the flag package
+		{[]string{"-o", "json", "-output", "wide"}, nil, "wide", true},
+		// a flag without a value is kept as an argument, the caller rejects it
+		{[]string{"web", "-o"}, []string{"web", "-o"}, "", false},
+		{[]string{"--outputs", "x"}, []string{"--outputs", "x"}, "", false},
+	} {
+		rest, value, found := popValue(test.args, "--output", "-output", "-o")
+		if !reflect.DeepEqual(rest, test.rest) || value != test.value || found != test.found {
+			t.Errorf("popValue(%v) = %v %q %v, want %v %q %v", test.args, rest, value, found, test.rest, test.value, test.found)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+// States of the units in the list.
+const (
+	stateRunning = "running"
+	stateDummy   = "dummy"
+	stateSkipped = "skipped"
+)
+
+// unitRow is one unit of ictl list -o json|yaml, the field names are the schema scripts and the
+// admin addon rely on, so fields are only added. The usage fields are 0 for the units without
+// a process. cpuPercent is the usage of the refresh interval, without --watch json and yaml get
+// the average since the start.
+type unitRow struct {
+	Name          string  `json:"name"`
+	User          string  `json:"user"`
+	Type          string  `json:"type"`
+	State         string  `json:"state"`
+	Pid           int     `json:"pid"`
+	Cmd           string  `json:"cmd"`
+	Reason        string  `json:"reason"`
+	UptimeSeconds int64   `json:"uptimeSeconds"`
+	CpuPercent    float64 `json:"cpuPercent"`
+	RssBytes      uint64  `json:"rssBytes"`
+	Threads       int     `json:"threads"`
+	Fds           int     `json:"fds"`
+	ReadBytes     uint64  `json:"readBytes"`
+	WriteBytes    uint64  `json:"writeBytes"`
+	Restarts      int     `json:"restarts"`
+	ExitCode      *int    `json:"exitCode"`
+	// fromIgo is set for the units of others, igo only sends their pid and memory
+	fromIgo bool
+}
+
+// unitList is the document printed by ictl list -o json|yaml.
+type unitList struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Units   []unitRow `json:"units"`
+}
+
+const unitListVersion = 1
+
+type listOptions struct {
+	typ    string
+	user   string
+	state  string
+	name   string
+	output string
+}
+
+func (o listOptions) match(row unitRow) bool {
+	if o.typ != "" && row.Type != o.typ {
+		return false
+	}
+	if o.user != "" && row.User != o.user {
+		return false
+	}
+	if o.state != "" && row.State != o.state {
+		return false
+	}
+	if o.name != "" {
+		if ok, _ := path.Match(o.name, row.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// validate returns an error for the unknown values, a typo should not print an empty list.
+func (o listOptions) validate() error {
+	values := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"filter", o.typ, []string{"origin", "addon", "unit"}},
+		{"state", o.state, []string{stateRunning, stateDummy, stateSkipped}},
+		{"output", o.output, []string{"table", "wide", "json", "yaml"}},
+	}
+	for _, v := range values {
+		if v.value == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range v.allowed {
+			found = found || v.value == allowed
+		}
+		if !found {
+			return fmt.Errorf("invalid %s %q, possible values: %s", v.name, v.value, strings.Join(v.allowed, ", "))
+		}
+	}
+	if _, err := path.Match(o.name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %w", o.name, err)
+	}
+	return nil
+}
+
+func list(args []string) {
+	args, watch := popFlag(args, "--watch", "-w")
+	args, typ, _ := popValue(args, "--filter", "-filter", "-f")
+	args, userName, _ := popValue(args, "--user", "-user")
+	args, state, _ := popValue(args, "--state", "-state")
+	args, name, _ := popValue(args, "--name", "-name")
+	args, output, _ := popValue(args, "--output", "-output", "-o")
+	args, available := popFlag(args, "--available", "-available")
+	options := listOptions{typ: getValueOr(typ, filter), user: userName, state: state, name: name, output: output}
+	if len(args) != 0 {
+		fmt.Println("Unknown arguments: ", strings.Join(args, " "))
+		os.Exit(1)
+	}
+	if err := options.validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if available {
+		if options.state != "" || watch {
+			fmt.Println("--available can not be used with --state and --watch")
+			os.Exit(1)
+		}
+		listAvailable(options)
+		return
+	}
+	listUnits(options, watch)
+}
+
+// listAvailable prints the units in the search paths which are not started.
+func listAvailable(options listOptions) {
+	units := findAvailableUnits(options)
+	switch options.output {
+	case "json":
+		raw, _ := json.Marshal(struct {
+			Version int             `json:"version"`
+			Units   []availableUnit `json:"units"`
+		}{unitListVersion, units})
+		fmt.Println(string(raw))
+	case "yaml":
+		fmt.Printf("version: %d\n", unitListVersion)
+		printYamlList(os.Stdout, "units", units)
+	default:
+		if len(units) == 0 {
+			fmt.Println("No available units found.")
+			return
+		}
+		format := "%-12s %-24s %s\n"
+		fmt.Printf(format, "User", "Name", "Path")
+		fmt.Println(strings.Repeat("-", 80))
+		for _, unit := range units {
+			fmt.Printf(format, unit.User, unit.Name, unit.Path)
+		}
+	}
+}
+
+// listUnits prints the units with the usage of their process trees, with watch it refreshes
+// the list in place until ctrl-c.
+func listUnits(options listOptions, watch bool) {
+	var envsToLookFor []string
+	if linuxUser.Username == "root" {
+		envsToLookFor = []string{"IGO_PROCESS_TYPE=origin", "IGO_PROCESS_TYPE=addon", "IGO_PROCESS_TYPE=unit"}
+	} else {
+		envsToLookFor = []string{fmt.Sprintf("IGO_PROCESS_USER=%s", linuxUser.Username)}
+	}
+	table := options.output == "" || options.output == "table" || options.output == "wide"
+
+	// the cpu usage of an interval needs two samples, the first one is taken a bit before the
+	// list. It is only taken for the cpu column and the watch, json and yaml get the average.
+	sample := watch || table
+	interval := 500 * time.Millisecond
+	sampled := time.Now()
+	var previous map[int]unitUsage
+	if sample {
+		previous = make(map[int]unitUsage)
+		for _, usage := range collectUsage(findPIDsByEnvLines(envsToLookFor), nil, 0) {
+			previous[usage.PID] = usage
+		}
+	}
+	exitCodes := newExitCodeTracker(watch)
+	for {
+		if sample {
+			time.Sleep(interval)
+		}
+		usages := collectUsage(findPIDsByEnvLines(envsToLookFor), previous, time.Since(sampled))
+		sampled = time.Now()
+		previous = make(map[int]unitUsage)
+		for _, usage := range usages {
+			previous[usage.PID] = usage
+		}
+		if watch {
+			interval, _ = time.ParseDuration(pollTimeout + "s")
+			if table {
+				// move to the top left and clear the screen
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("%s, refresh every %s, press ctrl-c to exit\n\n", sampled.Format("15:04:05"), pollTimeout+"s")
+			}
+		}
+		var rows []unitRow
+		for _, row := range collectRows(usages, exitCodes) {
+			if options.match(row) {
+				rows = append(rows, row)
+			}
+		}
+		switch options.output {
+		case "json":
+			// one document per line, so a watch can be read line by line
+			raw, _ := json.Marshal(unitList{Version: unitListVersion, Time: sampled, Units: nonNil(rows)})
+			fmt.Println(string(raw))
+		case "yaml":
+			printYaml(os.Stdout, unitList{Version: unitListVersion, Time: sampled, Units: nonNil(rows)})
+		default:
+			printUnits(rows, options.output == "wide")
+		}
+		if !watch {
+			return
+		}
+	}
+}
+
+// nonNil makes an empty list print as [] instead of null.
+func nonNil(rows []unitRow) []unitRow {
+	if rows == nil {
+		return []unitRow{}
+	}
+	return rows
+}
+
+// collectRows returns the running units, then the dummies and the skipped units of the user,
+// root sees every unit, the users with list-all the units of the others from igo.
+func collectRows(usages []unitUsage, exitCodes *exitCodeTracker) []unitRow {
+	var rows []unitRow
+	for _, usage := range usages {
+		rows = append(rows, unitRow{Name: usage.Name, User: usage.User, Type: usage.Type, State: stateRunning, Pid: usage.PID,
+			Cmd: usage.Cmd, UptimeSeconds: int64(usage.Uptime.Seconds()), CpuPercent: usage.CPU, RssBytes: usage.RssKB * 1024,
+			Threads: usage.Threads, Fds: usage.Fds, ReadBytes: usage.ReadBytes, WriteBytes: usage.WriteBytes,
+			Restarts: usage.Restarts, ExitCode: exitCodes.get(usage.User + "/" + usage.Type + "/" + usage.Name)})
+	}
+	for _, dummy := range findProcessDummies() {
+		if linuxUser.Username != "root" && linuxUser.Username != dummy.User {
+			continue
+		}
+		rows = append(rows, unitRow{Name: dummy.Name, User: dummy.User, Type: dummy.Type, State: stateDummy,
+			Restarts: control.RestartCount(getRunDirForProcess(dummy)), ExitCode: exitCodes.get(dummy.User + "/" + dummy.Type + "/" + dummy.Name)})
+	}
+	// units not started because of a failed condition
+	for _, skip := range findProcessSkipped() {
+		if linuxUser.Username != "root" && linuxUser.Username != skip.User {
+			continue
+		}
+		rows = append(rows, unitRow{Name: skip.Name, User: skip.User, Type: skip.Type, State: stateSkipped, Reason: skip.Reason})
+	}
+	// the units of the others if the policy of igo grants list-all
+	return append(rows, delegatedRows()...)
+}
+
+// printUnits prints the table, wide does not cut the command.
+func printUnits(rows []unitRow, wide bool) {
+	if len(rows) == 0 {
+		fmt.Println("No running units found.")
+		return
+	}
+
+	// Pretty print
+	format := "%-8s %-8s %-12s %-8s %-16s %6s %7s %4s %4s %13s %4s %4s %s\n"
+	fmt.Printf(format, "Uptime", "PID", "User", "Type", "Name", "CPU%", "RSS", "Thr", "FDs", "IO R/W", "Rst", "Exit", "Cmd")
+	fmt.Println(strings.Repeat("-", 120))
+	for _, row := range rows {
+		user := getValueOr(row.User, "-")
+		typ := getValueOr(row.Type, "-")
+		name := getValueOr(row.Name, "-")
+		switch row.State {
+		case stateDummy:
+			// Mark as dummy, no PID or Cmd
+			fmt.Printf(format, "[DUMMY]", "-", user, typ, name, "-", "-", "-", "-", "-", strconv.Itoa(row.Restarts), formatExitCode(row.ExitCode), "[DUMMY]")
+		case stateSkipped:
+			// the reason is shown as cmd
+			fmt.Printf(format, "[SKIPPED]", "-", user, typ, name, "-", "-", "-", "-", "-", "-", "-", row.Reason)
+		case stateRunning:
+			if row.fromIgo {
+				fmt.Printf(format, "-", strconv.Itoa(row.Pid), user, typ, name, "-", formatBytes(row.RssBytes/1024), "-", "-", "-",
+					strconv.Itoa(row.Restarts), formatExitCode(row.ExitCode), "-")
+				continue
+			}
+			cmd := row.Cmd
+			if len(cmd) > 40 && !wide {
+				cmd = cmd[:37] + "..."
+			}
+			io := formatBytes(row.ReadBytes/1024) + "/" + formatBytes(row.WriteBytes/1024)
+			fmt.Printf(format, formatDuration(time.Duration(row.UptimeSeconds)*time.Second), strconv.Itoa(row.Pid), user, typ, name,
+				fmt.Sprintf("%.1f", row.CpuPercent), formatBytes(row.RssBytes/1024), strconv.Itoa(row.Threads), strconv.Itoa(row.Fds),
+				io, strconv.Itoa(row.Restarts), formatExitCode(row.ExitCode), cmd)
+		default:
+			// the other states of igo, like stopping or restarting
+			fmt.Printf(format, "["+strings.ToUpper(row.State)+"]", "-", user, typ, name, "-", "-", "-", "-", "-",
+				strconv.Itoa(row.Restarts), formatExitCode(row.ExitCode), row.Reason)
+		}
+	}
+}
+
+// printYaml prints the list as yaml with the keys of the json schema, the strings are quoted
+// like in json, which is valid yaml.
+func printYaml(w io.Writer, doc unitList) {
+	fmt.Fprintf(w, "version: %d\n", doc.Version)
+	fmt.Fprintf(w, "time: %s\n", strconv.Quote(doc.Time.Format(time.RFC3339Nano)))
+	printYamlList(w, "units", doc.Units)
+}
+
+// printYamlList prints a slice of flat structs as a yaml list under key, the fields which are
+// not in the json are skipped.
+func printYamlList(w io.Writer, key string, items any) {
+	list := reflect.ValueOf(items)
+	if list.Len() == 0 {
+		fmt.Fprintf(w, "%s: []\n", key)
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", key)
+	for i := 0; i < list.Len(); i++ {
+		v := list.Index(i)
+		prefix := "  - "
+		for j := 0; j < v.NumField(); j++ {
+			field := v.Type().Field(j)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, yamlValue(v.Field(j)))
+			prefix = "    "
+		}
+	}
+}
+
+func yamlValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "null"
+		}
+		return yamlValue(v.Elem())
+	case reflect.String:
+		return strconv.Quote(v.String())
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintYaml(t *testing.T) {
+	code := 3
+	doc := unitList{
+		Version: unitListVersion,
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Units: []unitRow{
+			{Name: "web", User: "alice", Type: "unit", State: stateRunning, Pid: 42, Cmd: `python3 -c "print()"`, fromIgo: true},
+			{Name: "db", User: "bob", Type: "unit", State: stateDummy, Restarts: 2, ExitCode: &code},
+		},
+	}
+	var out bytes.Buffer
+	printYaml(&out, doc)
+	got := out.String()
+
+	for _, want := range []string{
+		"version: 1\n",
+		"time: \"2024-05-01T12:00:00Z\"\n",
+		"units:\n  - name: \"web\"\n    user: \"alice\"\n",
+		"    cmd: \"python3 -c \\\"print()\\\"\"\n",
+		"    exitCode: null\n  - name: \"db\"\n",
+		"    restarts: 2\n    exitCode: 3\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "fromIgo") {
+		t.Errorf("the unexported field should not be printed\n%s", got)
+	}
+
+	out.Reset()
+	printYaml(&out, unitList{Version: unitListVersion, Units: nonNil(nil)})
+	if !strings.HasSuffix(out.String(), "units: []\n") {
+		t.Errorf("an empty list should be [], got\n%s", out.String())
+	}
+}
+
+func TestUnitListJson(t *testing.T) {
+	raw, err := json.Marshal(unitList{Version: unitListVersion, Units: []unitRow{{Name: "web", State: stateRunning, fromIgo: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	json.Unmarshal(raw, &doc)
+	unit := doc["units"].([]any)[0].(map[string]any)
+	for _, key := range []string{"name", "user", "type", "state", "pid", "cmd", "reason", "uptimeSeconds", "cpuPercent",
+		"rssBytes", "threads", "fds", "readBytes", "writeBytes", "restarts", "exitCode"} {
+		if _, ok := unit[key]; !ok {
+			t.Errorf("the key %s of the schema is missing in %s", key, raw)
+		}
+	}
+	if len(unit) != 16 || unit["exitCode"] != nil {
+		t.Errorf("unexpected unit %s", raw)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	row := unitRow{Name: "web-1", User: "alice", Type: "unit", State: stateRunning}
+	for options, want := range map[listOptions]bool{
+		{}:                                true,
+		{typ: "unit", user: "alice"}:      true,
+		{typ: "addon"}:                    false,
+		{user: "bob"}:                     false,
+		{state: stateDummy}:               false,
+		{name: "web-*"}:                   true,
+		{name: "db*"}:                     false,
+		{state: stateRunning, name: "*1"}: true,
+	} {
+		if got := options.match(row); got != want {
+			t.Errorf("%+v match = %v, want %v", options, got, want)
+		}
+	}
+	for _, options := range []listOptions{{typ: "units"}, {state: "up"}, {output: "xml"}, {name: "["}} {
+		if options.validate() == nil {
+			t.Errorf("%+v should be rejected", options)
+		}
+	}
+	if err := (listOptions{typ: "origin", state: stateSkipped, output: "wide", name: "a?c"}).validate(); err != nil {
+		t.Error("valid options should be accepted:", err)
+	}
+}
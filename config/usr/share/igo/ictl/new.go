@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// unitTemplate is a built-in template of ictl new.
+type unitTemplate struct {
+	description  string
+	restartCount int
+	envs         map[string]string
+	// command is the default start command, it is shell code, the command line of the user is quoted
+	command string
+	// loop runs the command again after the INTERVAL env seconds
+	loop bool
+}
+
+var unitTemplates = map[string]unitTemplate{
+	"web": {
+		description:  "a long running server, igo restarts it when it fails",
+		restartCount: 3,
+		envs:         map[string]string{"PORT": "8080"},
+		command:      `python3 -m http.server "$PORT"`,
+	},
+	"worker": {
+		description:  "a long running background process, igo restarts it when it fails",
+		restartCount: 5,
+		command:      `sleep infinity`,
+	},
+	"oneshot": {
+		description: "runs once, the unit is removed after a successful exit",
+		command:     `echo "$IGO_PROCESS_NAME done"`,
+	},
+	"timer": {
+		description:  "runs the command every INTERVAL seconds",
+		restartCount: 3,
+		envs:         map[string]string{"INTERVAL": "60"},
+		command:      `date`,
+		loop:         true,
+	},
+}
+
+var (
+	unitNameRegexp  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._-]*$`)
+	shellSafeRegexp = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+)
+
+// shellQuote quotes the arg for bash if it has other than the safe characters.
+func shellQuote(arg string) string {
+	if arg != "" && shellSafeRegexp.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func (t unitTemplate) startScript(name string, templateName string, command string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/bash\n")
+	fmt.Fprintf(&b, "# %s: %s, created by ictl new --template %s\n\n", name, t.description, templateName)
+	if t.loop {
+		b.WriteString("while true; do\n")
+		fmt.Fprintf(&b, "    %s || echo \"%s failed with $?\"\n", command, name)
+		b.WriteString("    sleep \"$INTERVAL\"\n")
+		b.WriteString("done\n")
+	} else {
+		fmt.Fprintf(&b, "exec %s\n", command)
+	}
+	return b.String()
+}
+
+// pyDict formats the envs as a python dict, the json quoting of the strings is valid python.
+func pyDict(envs map[string]string) string {
+	if len(envs) == 0 {
+		return "{}"
+	}
+	var names []string
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var items []string
+	for _, name := range names {
+		items = append(items, strconv.Quote(name)+": "+strconv.Quote(envs[name]))
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+// config returns the config.py of the unit in the shape of the units shipped with the image.
+func (t unitTemplate) config(wd string) string {
+	return fmt.Sprintf(`conf = {
+    "timer": 0,
+    "start": {
+        "restartCount": %d,
+        "wd": %s,
+        "envs": %s,
+        "params": [],
+    },
+    "stop": {
+        "restartCount": 0,
+        "envs": {},
+        "params": [],
+    },
+}
+
+print(conf)
+`, t.restartCount, strconv.Quote(wd), pyDict(t.envs))
+}
+
+// newUnit creates a unit from a template in the first search path of the user. The files are
+// created with the dropped privileges, so they are owned by the user as igo requires.
+func newUnit(args []string) {
+	var command []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, command = args[:i], args[i+1:]
+			break
+		}
+	}
+	args, templateName, _ := popValue(args, "--template", "-template", "-t")
+	args, wd, hasWd := popValue(args, "--wd", "-wd")
+	args, startNow := popFlag(args, "--start", "-start")
+	if len(args) != 1 {
+		fmt.Println("Usage: ictl new <name> [--template web|worker|oneshot|timer] [--wd <dir>] [--start] [-- <command...>]")
+		os.Exit(1)
+	}
+	name := args[0]
+	templateName = getValueOr(templateName, "worker")
+	template, ok := unitTemplates[templateName]
+	if !ok {
+		fmt.Printf("Unknown template %s, possible values: web, worker, oneshot, timer\n", templateName)
+		os.Exit(1)
+	}
+	if !unitNameRegexp.MatchString(name) {
+		fmt.Printf("Invalid unit name %s, use letters, digits and @._-\n", name)
+		os.Exit(1)
+	}
+	if paths, found := scanUnitPaths()[name]; found {
+		fmt.Printf("Unit %s already exists: %s\n", name, strings.Join(paths, ", "))
+		os.Exit(1)
+	}
+
+	startCommand := template.command
+	if len(command) > 0 {
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = shellQuote(arg)
+		}
+		startCommand = strings.Join(quoted, " ")
+		// the command of the user most likely runs in the project it was given in
+		if cwd, err := os.Getwd(); err == nil && !hasWd {
+			wd = cwd
+		}
+	}
+
+	unitPath := filepath.Join(unitSearchPaths()[0], name)
+	if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+		fmt.Println("Failed to create the unit dir: ", err)
+		os.Exit(1)
+	}
+	if err := os.Mkdir(unitPath, 0755); err != nil {
+		fmt.Println("Failed to create the unit dir: ", err)
+		os.Exit(1)
+	}
+	files := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{name + ".start", template.startScript(name, templateName, startCommand), 0755},
+		{unitConfigToLookFor, template.config(wd), 0644},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(unitPath, file.name), []byte(file.content), file.mode); err != nil {
+			fmt.Println("Failed to create the unit: ", err)
+			os.RemoveAll(unitPath)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Unit %s created from the %s template: %s\n", name, templateName, unitPath)
+
+	if startNow {
+		// start works on the new unit only
+		runAll = false
+		start([]string{name})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	for arg, want := range map[string]string{
+		"python3":    "python3",
+		"--port=80":  "--port=80",
+		"":           "''",
+		"a b":        "'a b'",
+		"it's":       `'it'\''s'`,
+		"$HOME":      "'$HOME'",
+		"a;rm -rf /": "'a;rm -rf /'",
+	} {
+		if got := shellQuote(arg); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", arg, got, want)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	for name, template := range unitTemplates {
+		script := template.startScript("demo", name, template.command)
+		if !strings.HasPrefix(script, "#!/bin/bash\n") || !strings.Contains(script, template.command) {
+			t.Errorf("unexpected start script of %s:\n%s", name, script)
+		}
+		if out, err := exec.Command("bash", "-n", "-c", script).CombinedOutput(); err != nil {
+			t.Errorf("the start script of %s is not valid bash: %s\n%s", name, out, script)
+		}
+		config := template.config(`/home/alice/my "project"`)
+		if _, err := exec.LookPath("python3"); err != nil {
+			continue
+		}
+		out, err := exec.Command("python3", "-c", config).CombinedOutput()
+		if err != nil || !strings.Contains(string(out), `'wd': '/home/alice/my "project"'`) {
+			t.Errorf("the config of %s is not valid python: %s %v\n%s", name, out, err, config)
+		}
+	}
+	if got := pyDict(map[string]string{"PORT": "8080", "A": `x"y`}); got != `{"A": "x\"y", "PORT": "8080"}` {
+		t.Errorf("unexpected dict %s", got)
+	}
+}
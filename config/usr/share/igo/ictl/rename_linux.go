@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// exchangeDirs swaps the two paths in one step with renameat2, both exist before and after it.
+func exchangeDirs(a string, b string) error {
+	return unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+}
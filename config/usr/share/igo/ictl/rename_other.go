@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// exchangeDirs fails, renameat2 is only on linux.
+func exchangeDirs(a string, b string) error {
+	return syscall.ENOSYS
+}
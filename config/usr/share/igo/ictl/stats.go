@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+// clockTicks is USER_HZ, the unit of the cpu times in /proc, it is 100 on every linux we run on
+const clockTicks = 100
+
+// procStat is the usage of one process, its stat with the open fds and the io.
+type procStat struct {
+	proc.Stat
+	fds        int
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// unitUsage is the usage of the whole process tree of a running unit.
+type unitUsage struct {
+	ProcessInfo
+	Uptime     time.Duration
+	CPU        float64
+	RssKB      uint64
+	Threads    int
+	Fds        int
+	ReadBytes  uint64
+	WriteBytes uint64
+	Restarts   int
+	cpuTicks   uint64
+}
+
+func readProcStat(pid int) (procStat, error) {
+	stat, err := proc.ReadStat(pid)
+	s := procStat{Stat: stat}
+	if err != nil {
+		return s, err
+	}
+	procPath := filepath.Join("/proc", strconv.Itoa(pid))
+	// fd and io are only readable by the owner of the process and root
+	if fds, err := os.ReadDir(filepath.Join(procPath, "fd")); err == nil {
+		s.fds = len(fds)
+	}
+	if io, err := os.ReadFile(filepath.Join(procPath, "io")); err == nil {
+		for _, line := range strings.Split(string(io), "\n") {
+			if v, ok := strings.CutPrefix(line, "read_bytes: "); ok {
+				s.readBytes, _ = strconv.ParseUint(v, 10, 64)
+			}
+			if v, ok := strings.CutPrefix(line, "write_bytes: "); ok {
+				s.writeBytes, _ = strconv.ParseUint(v, 10, 64)
+			}
+		}
+	}
+	return s, nil
+}
+
+func readBootTime() time.Time {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			sec, _ := strconv.ParseInt(v, 10, 64)
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// exitCodeTracker keeps the exit code of the last exit of every unit, igo sends the events of
+// the units the user can see. The journal is read once, with follow the events stream of igo
+// stays open for the new exits, so a refresh does not read the journal again.
+type exitCodeTracker struct {
+	mu    sync.Mutex
+	codes map[string]int
+	last  time.Time
+}
+
+func newExitCodeTracker(follow bool) *exitCodeTracker {
+	t := &exitCodeTracker{codes: make(map[string]int)}
+	readEvents(control.Request{Action: control.ActionEvents}, t.apply)
+	if follow {
+		// igo sends the journal again before the new events, the ones already read are skipped
+		go readEvents(control.Request{Action: control.ActionEvents, Follow: true}, t.apply)
+	}
+	return t
+}
+
+func (t *exitCodeTracker) apply(e journal.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.Time.Before(t.last) {
+		return
+	}
+	t.last = e.Time
+	if e.ExitCode != nil {
+		t.codes[e.User+"/"+e.Type+"/"+e.Name] = *e.ExitCode
+	}
+}
+
+// get returns the last exit code of the unit, the key is user/type/name.
+func (t *exitCodeTracker) get(key string) *int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if code, ok := t.codes[key]; ok {
+		return &code
+	}
+	return nil
+}
+
+// findUnitRoots returns the first process of every unit, the children inherit the tags of igo,
+// so they are found by findPIDsByEnvLines too.
+func findUnitRoots(processes []ProcessInfo) []ProcessInfo {
+	tagged := make(map[int]string)
+	for _, info := range processes {
+		tagged[info.PID] = info.User + "/" + info.Type + "/" + info.Name
+	}
+	var roots []ProcessInfo
+	for _, info := range processes {
+		stat, err := readProcStat(info.PID)
+		if err != nil {
+			continue
+		}
+		if key, ok := tagged[stat.PPid]; ok && key == tagged[info.PID] {
+			continue
+		}
+		roots = append(roots, info)
+	}
+	return roots
+}
+
+// collectUsage groups the processes of the units and sums the usage of their process trees.
+// The cpu usage is computed from the cpu time used since the previous collection, without a
+// previous collection it is the average since the start like in ps.
+func collectUsage(processes []ProcessInfo, previous map[int]unitUsage, elapsed time.Duration) []unitUsage {
+	children := proc.Children()
+	bootTime := readBootTime()
+	var usages []unitUsage
+	for _, info := range findUnitRoots(processes) {
+		root, err := readProcStat(info.PID)
+		if err != nil {
+			continue
+		}
+		usage := unitUsage{ProcessInfo: info, Restarts: control.RestartCount(getRunDirForProcess(info))}
+		started := bootTime.Add(time.Duration(root.StartTicks) * time.Second / clockTicks)
+		usage.Uptime = time.Since(started).Truncate(time.Second)
+		tree := []int{info.PID}
+		for i := 0; i < len(tree); i++ {
+			s := root
+			if i > 0 {
+				if s, err = readProcStat(tree[i]); err != nil {
+					continue
+				}
+			}
+			tree = append(tree, children[tree[i]]...)
+			usage.cpuTicks += s.CpuTicks
+			usage.RssKB += s.RssBytes / 1024
+			usage.Threads += s.Threads
+			usage.Fds += s.fds
+			usage.ReadBytes += s.readBytes
+			usage.WriteBytes += s.writeBytes
+		}
+		if previous == nil {
+			if lifetime := time.Since(started); lifetime > 0 {
+				usage.CPU = float64(usage.cpuTicks) / clockTicks / lifetime.Seconds() * 100
+			}
+		} else if prev, ok := previous[info.PID]; ok && elapsed > 0 && usage.cpuTicks >= prev.cpuTicks {
+			usage.CPU = float64(usage.cpuTicks-prev.cpuTicks) / clockTicks / elapsed.Seconds() * 100
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+func formatBytes(kb uint64) string {
+	switch {
+	case kb >= 1024*1024:
+		return fmt.Sprintf("%.1fG", float64(kb)/1024/1024)
+	case kb >= 1024:
+		return fmt.Sprintf("%.1fM", float64(kb)/1024)
+	default:
+		return fmt.Sprintf("%dK", kb)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+}
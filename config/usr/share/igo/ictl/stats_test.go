@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+func TestExitCodeTracker(t *testing.T) {
+	now := time.Now()
+	code := func(c int) *int { return &c }
+	tracker := &exitCodeTracker{codes: make(map[string]int)}
+	tracker.apply(journal.Event{Time: now, User: "alice", Type: "unit", Name: "web", ExitCode: code(1)})
+	tracker.apply(journal.Event{Time: now.Add(time.Second), User: "alice", Type: "unit", Name: "web", Pid: 42})
+	tracker.apply(journal.Event{Time: now.Add(2 * time.Second), User: "alice", Type: "unit", Name: "web", ExitCode: code(2)})
+	// the follow stream sends the journal again
+	tracker.apply(journal.Event{Time: now, User: "alice", Type: "unit", Name: "web", ExitCode: code(1)})
+	if got := tracker.get("alice/unit/web"); got == nil || *got != 2 {
+		t.Errorf("the last exit code should be kept, got %v", got)
+	}
+	if tracker.get("alice/unit/db") != nil {
+		t.Error("a unit without an exit should have no exit code")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for kb, want := range map[uint64]string{0: "0K", 1023: "1023K", 1536: "1.5M", 3 * 1024 * 1024: "3.0G"} {
+		if got := formatBytes(kb); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", kb, got, want)
+		}
+	}
+	for d, want := range map[time.Duration]string{
+		42 * time.Second:              "42s",
+		90 * time.Second:              "1m30s",
+		2*time.Hour + 5*time.Minute:   "2h5m",
+		50*time.Hour + 10*time.Minute: "2d2h",
+	} {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+	code := 0
+	if formatExitCode(nil) != "-" || formatExitCode(&code) != "0" {
+		t.Error("an exit code should be printed and a missing one as -")
+	}
+}
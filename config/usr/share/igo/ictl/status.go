@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+// printProcessTree prints the process and its children like pstree.
+func printProcessTree(p control.Process, children map[int][]control.Process, prefix string, branch string) {
+	fmt.Printf("  %s%s%d %s\n", prefix, branch, p.Pid, p.Command)
+	switch branch {
+	case "├─":
+		prefix += "│ "
+	case "└─":
+		prefix += "  "
+	}
+	for i, child := range children[p.Pid] {
+		next := "├─"
+		if i == len(children[p.Pid])-1 {
+			next = "└─"
+		}
+		printProcessTree(child, children, prefix, next)
+	}
+}
+
+func printReport(s *control.UnitStatus) {
+	fmt.Printf("%s (%s of %s)\n", s.Name, s.Type, s.User)
+	state := s.State
+	if s.Pid != 0 {
+		state += fmt.Sprintf(", pid %d", s.Pid)
+		if stat, err := readProcStat(s.Pid); err == nil {
+			since := readBootTime().Add(time.Duration(stat.StartTicks) * time.Second / clockTicks)
+			state += fmt.Sprintf(", since %s (%s)", since.Format("2006-01-02 15:04:05"), formatDuration(time.Since(since)))
+		}
+	} else if s.State == control.StateExited {
+		state += fmt.Sprintf(", exit code %d", s.ExitCode)
+	}
+	fmt.Printf("  %-10s %s\n", "State:", state)
+	if s.Reason != "" {
+		fmt.Printf("  %-10s %s\n", "Reason:", s.Reason)
+	}
+	health := s.Health
+	if s.Restarts > 0 {
+		health += fmt.Sprintf(", %d restarts since the last successful start", s.Restarts)
+	}
+	fmt.Printf("  %-10s %s\n", "Health:", health)
+	runs := "the start script"
+	switch {
+	case s.DummyPath != "":
+		runs = "the dummy, remove " + s.DummyPath + " to start again"
+	case s.OnOrigin:
+		runs = "the origin, the addon failed"
+	}
+	fmt.Printf("  %-10s %s\n", "Runs:", runs)
+	fmt.Printf("  %-10s %s\n", "Start:", s.StartPath)
+	fmt.Printf("  %-10s %s\n", "Stop:", getValueOr(s.StopPath, "-"))
+	fmt.Printf("  %-10s %s\n", "Config:", getValueOr(s.ConfigPath, "-"))
+	if s.OriginStartPath != "" {
+		fmt.Printf("  %-10s %s\n", "Origin:", s.OriginStartPath)
+		fmt.Printf("  %-10s %s\n", "", getValueOr(s.OriginConfigPath, "-"))
+	}
+	c := s.Counters
+	fmt.Printf("  %-10s %d starts, %d restarts, %d stops, %d retries, %d fallbacks\n", "Counters:",
+		c[journal.EventStarted], c[journal.EventRestarting], c[journal.EventStopping], c[journal.EventRetry], c[journal.EventFallback])
+	if s.Pid != 0 {
+		fmt.Printf("  %-10s %.1fs cpu, %s rss\n", "Usage:", float64(s.CpuTicks)/clockTicks, formatBytes(s.RssBytes/1024))
+		fmt.Println("\nProcesses:")
+		children := make(map[int][]control.Process)
+		for _, p := range s.Processes[min(1, len(s.Processes)):] {
+			children[p.Parent] = append(children[p.Parent], p)
+		}
+		if len(s.Processes) != 0 {
+			printProcessTree(s.Processes[0], children, "", "")
+		}
+	}
+
+	fmt.Println("\nLast exits:")
+	if len(s.Exits) == 0 {
+		fmt.Println("  -")
+	}
+	for _, e := range s.Exits {
+		code := "-"
+		if e.ExitCode != nil {
+			code = strconv.Itoa(*e.ExitCode)
+		}
+		fmt.Printf("  %-19s %-6s exit=%-4s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Type, code, e.Reason)
+	}
+
+	fmt.Println("\nConfig of the last start:")
+	var config bytes.Buffer
+	if len(s.Config) == 0 || json.Indent(&config, s.Config, "  ", "  ") != nil {
+		fmt.Println("  only the owner and root can see the config")
+	} else {
+		fmt.Println("  " + config.String())
+	}
+
+	fmt.Println("\nLog:")
+	if len(s.Log) == 0 {
+		fmt.Println("  -")
+	}
+	for _, line := range s.Log {
+		fmt.Println("  " + ansiEscapeRegexp.ReplaceAllString(line, ""))
+	}
+}
+
+// countValue returns the count of a flag, nil if the flag is not given, igo has a default then.
+func countValue(value string, found bool) (*int, error) {
+	if !found {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = errors.New("negative count")
+	}
+	return &n, err
+}
+
+// unitStatus prints the detail of the units, without a unit it lists the units.
+func unitStatus(args []string) {
+	args, asJson := popFlag(args, "--json", "-json")
+	args, linesValue, linesFound := popValue(args, "-n", "--lines")
+	args, exitsValue, exitsFound := popValue(args, "--exits", "-exits")
+	lines, err := countValue(linesValue, linesFound)
+	exits, err2 := countValue(exitsValue, exitsFound)
+	if err != nil || err2 != nil {
+		fmt.Println("Usage: ictl status [-n <lines>] [--exits <count>] [--json] [unit...]")
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		listUnits(listOptions{typ: filter}, false)
+		return
+	}
+
+	failed := false
+	for i, name := range args {
+		resp, err := sendControlRequest(control.Request{Action: control.ActionStatus, Name: name, User: unitOwner, Lines: lines, Exits: exits})
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Printf("Could not get the status of %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if asJson {
+			json.NewEncoder(os.Stdout).Encode(resp.Status)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printReport(resp.Status)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
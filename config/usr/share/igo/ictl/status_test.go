@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestCountValue(t *testing.T) {
+	if n, err := countValue("", false); n != nil || err != nil {
+		t.Error("a missing count should be nil for the default of igo")
+	}
+	if n, err := countValue("0", true); n == nil || *n != 0 || err != nil {
+		t.Error("-n 0 should be sent as 0")
+	}
+	for _, value := range []string{"-1", "x", ""} {
+		if _, err := countValue(value, true); err == nil {
+			t.Errorf("the count %q should be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+// stop writes the kill file of the units, igo stops and unregisters them. Without no-block it
+// waits for the process trees to exit and sends SIGKILL to them after the timeout.
+func stop(procNames []string) {
+	procNames, noBlock := popFlag(procNames, "--no-block", "-no-block")
+	procNames, timeoutValue, _ := popValue(procNames, "--timeout", "-timeout", "-t")
+	timeout, err := strconv.Atoi(getValueOr(timeoutValue, killPatience))
+	if err != nil {
+		fmt.Println("Invalid timeout: ", timeoutValue)
+		os.Exit(1)
+	}
+	if !runAll && len(procNames) == 0 {
+		fmt.Println("No units specified, to stop all for the user use the -a=T or -all=T flag")
+		os.Exit(1)
+	}
+	if isDelegated() {
+		stopThroughIgo(procNames, timeout, noBlock)
+		return
+	}
+
+	var envsToLookFor []string
+	if len(procNames) > 0 {
+		for _, procName := range procNames {
+			envsToLookFor = append(envsToLookFor, fmt.Sprintf("IGO_PROCESS_NAME=%s", procName))
+		}
+	} else {
+		envsToLookFor = []string{fmt.Sprintf("IGO_PROCESS_USER=%s", linuxUser.Username)}
+	}
+
+	var units []ProcessInfo
+	for _, process := range findUnitRoots(findPIDsByEnvLines(envsToLookFor)) {
+		units = append(units, process)
+		if err := writeStopFile(getRunDirForProcess(process)); err != nil {
+			println(err)
+		}
+	}
+
+	dummies := findProcessDummies()
+	stoppedDummies := make(map[string]bool)
+	for _, dummy := range dummies {
+		shouldStop := false
+		if len(procNames) > 0 {
+			for _, name := range procNames {
+				if dummy.Name == name {
+					shouldStop = true
+					break
+				}
+			}
+		} else {
+			// If no names specified, stop all for user
+			if linuxUser.Username == "root" {
+				shouldStop = true
+			} else if dummy.User == linuxUser.Username {
+				shouldStop = true
+			}
+		}
+		if shouldStop {
+			dummyPath := dummy.Cmd
+			if err := os.Remove(dummyPath); err != nil {
+				fmt.Printf("Failed to remove dummy file %s: %v\n", dummyPath, err)
+			} else {
+				stoppedDummies[dummy.Name] = true
+				fmt.Printf("Removed dummy file for unit %s (%s)\n", dummy.Name, dummyPath)
+			}
+		}
+	}
+
+	for _, name := range procNames {
+		found := stoppedDummies[name]
+		for _, unit := range units {
+			found = found || unit.Name == name
+		}
+		if !found {
+			// like a stopped unit, it is not an error
+			fmt.Printf("Unit %s is not running\n", name)
+		}
+	}
+	if noBlock {
+		for _, unit := range units {
+			fmt.Printf("Stop requested for %s (PID %d)\n", unit.Name, unit.PID)
+		}
+		return
+	}
+	if !waitForStop(units, time.Duration(timeout)*time.Second) {
+		os.Exit(1)
+	}
+}
+
+// waitForStop waits for the process trees of the units, igo needs a poll cycle to see the kill
+// file, so the timeout starts after it.
+func waitForStop(units []ProcessInfo, timeout time.Duration) bool {
+	children := proc.Children()
+	trees := make(map[int][]int)
+	for _, unit := range units {
+		trees[unit.PID] = proc.Tree(unit.PID, children)
+		fmt.Printf("Stopping %s (PID %d, %d processes) ...\n", unit.Name, unit.PID, len(trees[unit.PID]))
+	}
+	poll, _ := strconv.Atoi(pollTimeout)
+	deadline := time.Now().Add(time.Duration(poll)*time.Second + timeout)
+	ok := true
+	for _, unit := range units {
+		alive := proc.WaitForExit(trees[unit.PID], time.Until(deadline))
+		if len(alive) == 0 {
+			fmt.Printf("Stopped %s\n", unit.Name)
+			continue
+		}
+		fmt.Printf("%s did not stop in %s, sending SIGKILL to %d processes\n", unit.Name, timeout, len(alive))
+		for _, pid := range alive {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		if alive := proc.WaitForExit(alive, 2*time.Second); len(alive) != 0 {
+			fmt.Printf("Could not stop %s, still running: %v\n", unit.Name, alive)
+			ok = false
+			continue
+		}
+		fmt.Printf("Killed %s\n", unit.Name)
+	}
+	return ok
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+const (
+	// sparkWidth is the count of the samples in the sparklines
+	sparkWidth = 12
+	// topEvents is the count of the last events shown under the units
+	topEvents = 5
+)
+
+var (
+	sparkChars       = []rune("▁▂▃▄▅▆▇█")
+	ansiEscapeRegexp = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07]*\x07|[()][0-9A-Za-z])`)
+)
+
+// topUnit is a unit on the dashboard with the history of its usage.
+type topUnit struct {
+	control.UnitState
+	cpu []float64
+	rss []float64
+	// sampled is the time of the update the cpu ticks are from
+	sampled time.Time
+}
+
+func (u *topUnit) key() string {
+	return u.User + "/" + u.Type + "/" + u.Name
+}
+
+func (u *topUnit) health() string {
+	return u.Health
+}
+
+func pushSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	if len(samples) > sparkWidth {
+		samples = samples[len(samples)-sparkWidth:]
+	}
+	return samples
+}
+
+// sparkline draws the samples scaled to max, or to the largest sample if it is larger.
+func sparkline(samples []float64, max float64) string {
+	for _, v := range samples {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", sparkWidth-len(samples)))
+	for _, v := range samples {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparkChars)-1))
+		}
+		b.WriteRune(sparkChars[i])
+	}
+	return b.String()
+}
+
+// topState is the state of the dashboard, it is only changed by the loop of top.
+type topState struct {
+	units    map[string]*topUnit
+	order    []*topUnit
+	selected string
+	events   []journal.Event
+	status   string
+	// logUnit is the unit of the log pane, logConn streams its output
+	logUnit string
+	logConn net.Conn
+	logs    []string
+	partial string
+}
+
+func (s *topState) apply(update control.Update) {
+	seen := make(map[string]bool)
+	for _, state := range update.Units {
+		u := &topUnit{UnitState: state}
+		if old, ok := s.units[u.key()]; ok {
+			u.cpu, u.rss = old.cpu, old.rss
+			if elapsed := update.Time.Sub(old.sampled).Seconds(); elapsed > 0 && state.Pid == old.Pid && state.CpuTicks >= old.CpuTicks {
+				u.cpu = pushSample(u.cpu, float64(state.CpuTicks-old.CpuTicks)/clockTicks/elapsed*100)
+			}
+		}
+		u.rss = pushSample(u.rss, float64(state.RssBytes))
+		u.sampled = update.Time
+		s.units[u.key()] = u
+		seen[u.key()] = true
+	}
+	for key := range s.units {
+		if !seen[key] {
+			delete(s.units, key)
+		}
+	}
+	// grouped by user and type
+	s.order = s.order[:0]
+	for _, u := range s.units {
+		s.order = append(s.order, u)
+	}
+	sort.Slice(s.order, func(i, j int) bool {
+		a, b := s.order[i], s.order[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+	if update.Event != nil {
+		s.events = append(s.events, *update.Event)
+		if len(s.events) > topEvents {
+			s.events = s.events[len(s.events)-topEvents:]
+		}
+	}
+	if _, ok := s.units[s.selected]; !ok && len(s.order) > 0 {
+		s.selected = s.order[0].key()
+	}
+}
+
+func (s *topState) selectedUnit() *topUnit {
+	return s.units[s.selected]
+}
+
+func (s *topState) move(delta int) {
+	for i, u := range s.order {
+		if u.key() == s.selected {
+			if j := i + delta; j >= 0 && j < len(s.order) {
+				s.selected = s.order[j].key()
+			}
+			return
+		}
+	}
+}
+
+func (s *topState) addLogs(data string) {
+	data = ansiEscapeRegexp.ReplaceAllString(s.partial+data, "")
+	data = strings.ReplaceAll(data, "\r", "")
+	lines := strings.Split(data, "\n")
+	s.partial = lines[len(lines)-1]
+	s.logs = append(s.logs, lines[:len(lines)-1]...)
+	if len(s.logs) > 200 {
+		s.logs = s.logs[len(s.logs)-200:]
+	}
+}
+
+func (s *topState) closeLogs() {
+	if s.logConn != nil {
+		s.logConn.Close()
+	}
+	s.logUnit, s.logConn, s.logs, s.partial = "", nil, nil, ""
+}
+
+// render draws the whole screen, every line is cut to the width of the terminal.
+func (s *topState) render(rows int, cols int) string {
+	var lines []string
+	// the style is added after the line is cut, so the reset is never cut off
+	addStyled := func(style string, format string, a ...any) {
+		line := []rune(fmt.Sprintf(format, a...))
+		if len(line) > cols {
+			line = line[:cols]
+		}
+		if style != "" {
+			lines = append(lines, style+string(line)+"\033[0m")
+		} else {
+			lines = append(lines, string(line))
+		}
+	}
+	add := func(format string, a ...any) { addStyled("", format, a...) }
+	add("ictl top - %s, %d units   [↑/↓] select [s] stop [r] restart [l] logs [q] quit", time.Now().Format("15:04:05"), len(s.order))
+	add("%s", s.status)
+	// the sparklines are at the end, a narrow terminal cuts them first
+	format := "  %-16s %-10s %-8s %3s %-7s %6s %-12s %7s %-12s"
+	add(format, "Name", "State", "Health", "Rst", "PID", "CPU%", "", "RSS", "")
+	group := ""
+	for _, u := range s.order {
+		if g := u.User + " / " + u.Type; g != group {
+			group = g
+			addStyled("\033[1m", "%s", group)
+		}
+		cpu := 0.0
+		if len(u.cpu) > 0 {
+			cpu = u.cpu[len(u.cpu)-1]
+		}
+		pid := "-"
+		if u.Pid != 0 {
+			pid = fmt.Sprint(u.Pid)
+		}
+		style := ""
+		if u.key() == s.selected {
+			style = "\033[7m"
+		}
+		addStyled(style, format, u.Name, u.State, u.health(), fmt.Sprint(u.Restarts), pid, fmt.Sprintf("%.1f", cpu),
+			sparkline(u.cpu, 100), formatBytes(u.RssBytes/1024), sparkline(u.rss, 0))
+	}
+	add("")
+	addStyled("\033[1m", "Events")
+	for _, e := range s.events {
+		add("  %s %-16s %-10s %s", e.Time.Local().Format("15:04:05"), e.Name, e.Event, e.Reason)
+	}
+	if s.logUnit != "" {
+		add("")
+		addStyled("\033[1m", "Logs of %s", s.logUnit)
+		free := rows - len(lines) - 1
+		logs := s.logs
+		if free < 0 {
+			free = 0
+		}
+		if len(logs) > free {
+			logs = logs[len(logs)-free:]
+		}
+		for _, line := range logs {
+			add("  %s", line)
+		}
+	}
+	if len(lines) > rows {
+		lines = lines[:rows]
+	}
+	return "\033[H" + strings.Join(lines, "\033[K\r\n") + "\033[K\033[J"
+}
+
+// watchIgo sends the updates of igo to the channel, it connects again when igo restarts.
+func watchIgo(updates chan<- control.Update, status chan<- string) {
+	for {
+		conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+		if err == nil {
+			reader := bufio.NewReader(conn)
+			var resp control.Response
+			err = control.WriteMessage(conn, control.Request{Action: control.ActionWatch, User: linuxUser.Username})
+			if err == nil {
+				err = control.ReadMessage(reader, &resp)
+			}
+			if err == nil && resp.Error != "" {
+				err = fmt.Errorf("%s", resp.Error)
+			}
+			if err == nil {
+				status <- ""
+				for {
+					var update control.Update
+					if err = control.ReadMessage(reader, &update); err != nil {
+						break
+					}
+					updates <- update
+				}
+			}
+			conn.Close()
+		}
+		status <- fmt.Sprintf("lost the connection to igo: %v, retrying ...", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// openLogs attaches read-only to the unit, the output is sent to the channel until the
+// connection is closed.
+func openLogs(u *topUnit, logs chan<- [2]string) (net.Conn, error) {
+	conn, err := net.Dial("unix", control.SocketPath(igoRootPath))
+	if err != nil {
+		return nil, err
+	}
+	req := control.Request{Action: control.ActionAttach, Name: u.Name, User: u.User, ReadOnly: true}
+	if err := control.WriteMessage(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	key := u.key()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				logs <- [2]string{key, string(buf[:n])}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+// top is a live dashboard of the units, it is updated by the watch stream of igo.
+func top(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: ictl top")
+		os.Exit(1)
+	}
+	stdin := os.Stdin.Fd()
+	oldState, err := makeRaw(stdin)
+	if err != nil {
+		fmt.Println("ictl top needs a terminal: ", err)
+		os.Exit(1)
+	}
+	// alternate screen and hidden cursor, restored on exit
+	fmt.Print("\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		setTermios(stdin, oldState)
+	}()
+
+	updates := make(chan control.Update, 16)
+	status := make(chan string, 4)
+	logs := make(chan [2]string, 64)
+	keys := make(chan []byte)
+	go watchIgo(updates, status)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	state := &topState{units: make(map[string]*topUnit), status: "connecting to igo ..."}
+	defer state.closeLogs()
+	for {
+		rows, cols, err := getTermSize(stdin)
+		if err != nil || rows == 0 {
+			rows, cols = 24, 80
+		}
+		fmt.Print(state.render(int(rows), int(cols)))
+
+		select {
+		case update := <-updates:
+			state.apply(update)
+		case msg := <-status:
+			state.status = msg
+		case chunk := <-logs:
+			if chunk[0] == state.logUnit {
+				state.addLogs(chunk[1])
+			}
+		case <-winch:
+		case <-ticker.C:
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			if !state.handleKey(string(key), logs, status) {
+				return
+			}
+		}
+	}
+}
+
+// handleKey runs the action of the key on the selected unit, it returns false to quit.
+func (s *topState) handleKey(key string, logs chan<- [2]string, status chan<- string) bool {
+	u := s.selectedUnit()
+	switch key {
+	case "q", "\x03":
+		return false
+	case "\x1b[A", "k":
+		s.move(-1)
+	case "\x1b[B", "j":
+		s.move(1)
+	case "s":
+		if u == nil {
+			return true
+		}
+		// through igo, so the units of others can be stopped with the stop-others permission
+		s.status = fmt.Sprintf("stopping %s ...", u.Name)
+		go func(name string, user string) {
+			resp, err := sendControlRequest(control.Request{Action: control.ActionStop, Name: name, User: user})
+			switch {
+			case err != nil:
+				status <- fmt.Sprintf("could not stop %s: %v", name, err)
+			case resp.Error != "":
+				status <- fmt.Sprintf("could not stop %s: %s", name, resp.Error)
+			default:
+				status <- fmt.Sprintf("stopped %s", name)
+			}
+		}(u.Name, u.User)
+	case "r":
+		if u == nil {
+			return true
+		}
+		s.status = fmt.Sprintf("restarting %s ...", u.Name)
+		go func(name string, user string) {
+			resp, err := sendControlRequest(control.Request{Action: control.ActionRestart, Name: name, User: user})
+			switch {
+			case err != nil:
+				status <- fmt.Sprintf("could not restart %s: %v", name, err)
+			case resp.Error != "":
+				status <- fmt.Sprintf("could not restart %s: %s", name, resp.Error)
+			default:
+				status <- fmt.Sprintf("restarted %s, new PID %d", name, resp.Pid)
+			}
+		}(u.Name, u.User)
+	case "l":
+		if s.logUnit != "" || u == nil {
+			s.closeLogs()
+			return true
+		}
+		conn, err := openLogs(u, logs)
+		if err != nil {
+			s.status = fmt.Sprintf("could not open the logs of %s: %v", u.Name, err)
+			return true
+		}
+		s.logUnit, s.logConn = u.key(), conn
+	}
+	return true
+}
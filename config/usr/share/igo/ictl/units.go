@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// unitSearchPaths returns the dirs of the units of the user in the order they are searched,
+// IGO_UNIT_PATH is a : separated list, ~ and the relative paths are in the home of the user.
+func unitSearchPaths() []string {
+	home := linuxUser.HomeDir
+	paths := []string{filepath.Join(home, ".config/units"), filepath.Join(home, "units")}
+	for _, p := range strings.Split(os.Getenv("IGO_UNIT_PATH"), ":") {
+		if p == "" {
+			continue
+		}
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			p = filepath.Join(home, strings.TrimPrefix(p, "~"))
+		} else if !filepath.IsAbs(p) {
+			p = filepath.Join(home, p)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	return paths
+}
+
+// scanUnitPaths returns the dirs of the units by name, a unit is a dir with the unit config in
+// one of the search paths. A name can be found in more than one search path.
+func scanUnitPaths() map[string][]string {
+	units := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, searchPath := range unitSearchPaths() {
+		if seen[searchPath] {
+			continue
+		}
+		seen[searchPath] = true
+		entries, err := os.ReadDir(searchPath)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			unitPath := filepath.Join(searchPath, entry.Name())
+			if fi, err := os.Stat(filepath.Join(unitPath, unitConfigToLookFor)); err != nil || fi.IsDir() {
+				continue
+			}
+			units[entry.Name()] = append(units[entry.Name()], unitPath)
+		}
+	}
+	return units
+}
+
+// findUserUnits returns the unit directories of the user by unit name. The names found in more
+// than one search path are reported and left out, so it is not the order of the paths that
+// decides which one runs.
+func findUserUnits() map[string]string {
+	usersUnits := make(map[string]string)
+	for name, paths := range scanUnitPaths() {
+		if len(paths) > 1 {
+			// on stderr, so the json output of list --available stays valid
+			fmt.Fprintf(os.Stderr, "Unit %s is found in more than one search path, rename or remove all but one: %s\n", name, strings.Join(paths, ", "))
+			continue
+		}
+		usersUnits[name] = paths[0]
+	}
+	if len(usersUnits) == 0 {
+		fmt.Fprintln(os.Stderr, "No units found for user: ", linuxUser.Username, ", make sure the unit is in one of the search paths: ", strings.Join(unitSearchPaths(), ", "))
+		return nil
+	}
+	return usersUnits
+}
+
+// availableUnit is a unit of ictl list --available -o json|yaml.
+type availableUnit struct {
+	Name string `json:"name"`
+	User string `json:"user"`
+	Path string `json:"path"`
+}
+
+// findAvailableUnits returns the units of the user which can be started and are not started yet.
+func findAvailableUnits(options listOptions) []availableUnit {
+	available := []availableUnit{}
+	for name, unitPath := range findUserUnits() {
+		if _, err := os.Lstat(filepath.Join(igoUnitSymlinkPath, linuxUser.Username, name)); err == nil {
+			continue
+		}
+		unit := availableUnit{Name: name, User: linuxUser.Username, Path: unitPath}
+		if options.match(unitRow{Name: name, User: unit.User, Type: "unit"}) {
+			available = append(available, unit)
+		}
+	}
+	sort.Slice(available, func(i, j int) bool { return available[i].Name < available[j].Name })
+	return available
+}
@@ -0,0 +1,292 @@
+// Package control is the protocol of the control socket of igo. ictl sends a Request as one
+// json line, igo answers with a Response json line, then the action specific stream follows.
+package control
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+const (
+	SocketName = "igo.sock"
+	// ActionAttach connects to the output of a unit, and to its pty if it has one.
+	// After the response igo streams the raw output, the client sends frames.
+	ActionAttach = "attach"
+	// ActionRestart restarts a unit without unregistering it, the response has the new pid.
+	ActionRestart = "restart"
+	// ActionWatch streams an Update of the units after every event and every poll of igo.
+	ActionWatch = "watch"
+	// ActionStop stops and unregisters a unit like its kill file, the response is sent after
+	// the process tree exited.
+	ActionStop = "stop"
+	// ActionPermissions returns the permissions of the peer on the units of other users.
+	ActionPermissions = "permissions"
+	// ActionEnv returns the RunnableEnv of the start script of a unit, or of its stop script.
+	ActionEnv = "env"
+	// ActionExec runs the Command with the RunnableEnv in the namespaces of the unit. After the
+	// response igo sends output frames and an exit frame, the client sends frames like on attach.
+	ActionExec = "exec"
+	// ActionStatus returns the UnitStatus of a unit with the last Lines of its output.
+	ActionStatus = "status"
+	// ActionEvents streams the journal.Event lines of the journal the peer can see after the
+	// response, of the unit Name if it is set. With Follow the new events follow until the peer
+	// closes the connection.
+	ActionEvents = "events"
+)
+
+// Permissions the policy of igo grants to groups, the users always have them on their own units.
+const (
+	PermListAll      = "list-all"
+	PermStopOthers   = "stop-others"
+	PermManageAddons = "manage-addons"
+	PermReadLogs     = "read-logs"
+)
+
+// Frame types sent by the client of an attach and an exec.
+const (
+	FrameInput  byte = 'i'
+	FrameResize byte = 'r'
+	// FrameEOF closes the input of an exec.
+	FrameEOF byte = 'c'
+)
+
+// Frame types sent by igo on an exec, the exit frame is the last one.
+const (
+	FrameStdout byte = 'o'
+	FrameStderr byte = 'e'
+	FrameExit   byte = 'x'
+)
+
+// maxFrameSize is the largest payload of a frame, the length is sent on 2 bytes.
+const maxFrameSize = 0xffff
+
+type Request struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// User is the owner of the unit, addons and origins belong to root.
+	User     string `json:"user"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+	// Timeout is the seconds to wait for the exit before SIGKILL.
+	Timeout int `json:"timeout,omitempty"`
+	// StopConfig selects the stop script for ActionEnv and ActionExec.
+	StopConfig bool     `json:"stopConfig,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	// Tty runs the command of an exec on a pty, Term is set as TERM if the unit has none.
+	Tty  bool   `json:"tty,omitempty"`
+	Term string `json:"term,omitempty"`
+	// Lines is the count of the output lines of ActionStatus, Exits the count of its last
+	// exits, igo has a default for nil.
+	Lines *int `json:"lines,omitempty"`
+	Exits *int `json:"exits,omitempty"`
+	// Follow keeps an ActionEvents open for the new events.
+	Follow bool `json:"follow,omitempty"`
+}
+
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// Pty is set if the unit runs on a pty, ReadOnly if the input of the client is ignored.
+	Pty      bool `json:"pty,omitempty"`
+	ReadOnly bool `json:"readOnly,omitempty"`
+	Pid      int  `json:"pid,omitempty"`
+	// Permissions is the answer of ActionPermissions.
+	Permissions []string `json:"permissions,omitempty"`
+	// Env is the answer of ActionEnv.
+	Env *RunnableEnv `json:"env,omitempty"`
+	// Status is the answer of ActionStatus.
+	Status *UnitStatus `json:"status,omitempty"`
+}
+
+// RunnableEnv is the environment igo starts a script of a unit with.
+type RunnableEnv struct {
+	Path string `json:"path"`
+	// Env is sorted by name.
+	Env []string `json:"env"`
+	Wd  string   `json:"wd"`
+	Uid int      `json:"uid"`
+	Gid int      `json:"gid"`
+	// Pid is the running start script, Namespaces are its namespaces which differ from the
+	// namespaces of igo, like mnt and net of a sandbox.
+	Pid        int      `json:"pid,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// States of the units in an Update.
+const (
+	StateRunning    = "running"
+	StateStarting   = "starting"
+	StateDummy      = "dummy"
+	StateSkipped    = "skipped"
+	StateStopping   = "stopping"
+	StateRestarting = "restarting"
+	StateExited     = "exited"
+)
+
+// UnitState is a unit the peer can see, with the usage of its process tree.
+type UnitState struct {
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Type     string `json:"type"`
+	State    string `json:"state"`
+	Pid      int    `json:"pid,omitempty"`
+	Restarts int    `json:"restarts"`
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+	// Health is failed for a unit parked on the dummy or exited with an error, degraded for a
+	// unit running after restarts, ok for a running one and - otherwise.
+	Health string `json:"health"`
+	// CpuTicks is the cpu time of the process tree in clock ticks, the difference of two
+	// updates is the cpu usage between them.
+	CpuTicks uint64 `json:"cpuTicks"`
+	RssBytes uint64 `json:"rssBytes"`
+}
+
+// UnitStatus is the detail of a unit for ictl status.
+type UnitStatus struct {
+	UnitState
+	StartPath  string `json:"startPath"`
+	StopPath   string `json:"stopPath,omitempty"`
+	ConfigPath string `json:"configPath,omitempty"`
+	// OriginStartPath is the origin of an addon, igo falls back to it if the addon fails.
+	OriginStartPath  string `json:"originStartPath,omitempty"`
+	OriginConfigPath string `json:"originConfigPath,omitempty"`
+	OnOrigin         bool   `json:"onOrigin"`
+	// DummyPath is the file which parks the unit, removing it starts the unit again.
+	DummyPath string `json:"dummyPath,omitempty"`
+	// Config is the config read at the last start, only the owner and root get it.
+	Config json.RawMessage `json:"config,omitempty"`
+	// Log is the end of the output, the peer needs the read-logs permission for the others.
+	Log []string `json:"log,omitempty"`
+	// Processes is the process tree of the running unit, its root is the first.
+	Processes []Process `json:"processes,omitempty"`
+	// Counters are the lifecycle events of the unit by event since igo registered it.
+	Counters map[string]int `json:"counters"`
+	// Exits are the last exit events, they need the read-logs permission like the log.
+	Exits []journal.Event `json:"exits,omitempty"`
+}
+
+// Process is a process of the tree of a unit, Parent is 0 for the root.
+type Process struct {
+	Pid     int    `json:"pid"`
+	Parent  int    `json:"parent,omitempty"`
+	Command string `json:"command"`
+}
+
+// Update is a message of a watch, Event is set if the update was sent because of it.
+type Update struct {
+	Time  time.Time      `json:"time"`
+	Event *journal.Event `json:"event,omitempty"`
+	Units []UnitState    `json:"units"`
+}
+
+// SocketPath returns the path of the control socket under the root path of igo.
+func SocketPath(rootPath string) string {
+	return filepath.Join(rootPath, ".runtime/run", SocketName)
+}
+
+var startCountRegexp = regexp.MustCompile(`\.start\.(\d+)$`)
+
+// RestartCount returns the restarts since the last successful start of a runnable, igo counts
+// the starts in the <name>.start.<n> files of its run dir.
+func RestartCount(runDir string) int {
+	entries, _ := os.ReadDir(runDir)
+	count := 0
+	for _, entry := range entries {
+		if m := startCountRegexp.FindStringSubmatch(entry.Name()); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n > count {
+				count = n
+			}
+		}
+	}
+	if count > 0 {
+		count--
+	}
+	return count
+}
+
+// WriteMessage writes v as one json line.
+func WriteMessage(w io.Writer, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
+
+// ReadMessage reads one json line into v. The reader has to be used for the rest of the stream,
+// because it can hold buffered bytes after the line.
+func ReadMessage(r *bufio.Reader, v any) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// WriteFrame writes a frame: the type, the big endian length on 2 bytes and the payload.
+func WriteFrame(w io.Writer, typ byte, data []byte) error {
+	for {
+		chunk := data
+		if len(chunk) > maxFrameSize {
+			chunk = data[:maxFrameSize]
+		}
+		header := []byte{typ, 0, 0}
+		binary.BigEndian.PutUint16(header[1:], uint16(len(chunk)))
+		if _, err := w.Write(append(header, chunk...)); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+func ResizePayload(rows uint16, cols uint16) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, rows)
+	binary.BigEndian.PutUint16(data[2:], cols)
+	return data
+}
+
+func ExitPayload(code int) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(int32(code)))
+	return data
+}
+
+func ParseExit(data []byte) (int, error) {
+	if len(data) != 4 {
+		return 0, errors.New("invalid exit frame")
+	}
+	return int(int32(binary.BigEndian.Uint32(data))), nil
+}
+
+func ParseResize(data []byte) (uint16, uint16, error) {
+	if len(data) != 4 {
+		return 0, 0, errors.New("invalid resize frame")
+	}
+	return binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]), nil
+}
@@ -0,0 +1,175 @@
+// Package journal is the append-only json lines log of the lifecycle events of the runnables.
+// igo writes it and serves it to ictl events.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Events of the lifecycle of a runnable.
+const (
+	EventDiscovered = "discovered"
+	EventStarted    = "started"
+	EventFailed     = "failed"
+	EventExited     = "exited"
+	EventRetry      = "retry"
+	EventFallback   = "fallback"
+	EventKilled     = "killed"
+	EventStopping   = "stopping"
+	EventRestarting = "restarting"
+	EventDummy      = "dummy"
+	EventSkipped    = "skipped"
+	EventRemoved    = "removed"
+	// EventExec is a command ictl exec ran in the environment of the runnable.
+	EventExec = "exec"
+)
+
+type Event struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	// Unit is the id of the runnable, the path of its start script in the units dir.
+	Unit     string `json:"unit"`
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Type     string `json:"type"`
+	Event    string `json:"event"`
+	Pid      int    `json:"pid,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// DefaultPath returns the path of the journal under the root path of igo.
+func DefaultPath(rootPath string) string {
+	return filepath.Join(rootPath, ".runtime", "events.jsonl")
+}
+
+// Read calls fn with the events of the journal from the oldest, the rotated journal first. A
+// missing journal has no events. The lines which are not events are skipped.
+func Read(path string, fn func(Event) error) error {
+	for _, p := range []string{RotatedPath(path), path} {
+		if err := readFile(p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(path string, fn func(Event) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// RotatedPath returns the path of the previous journal, the journal is moved there when it
+// reaches its max size.
+func RotatedPath(path string) string {
+	return path + ".1"
+}
+
+type Writer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	size     int64
+	file     *os.File
+}
+
+// Open opens the journal for appending. It has the commands and the reasons of the units of
+// every user, only the owner of igo can read it, ictl gets the events through igo. When the
+// journal would grow over maxBytes it is rotated, 0 never rotates it.
+func Open(path string, maxBytes int64) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return nil, err
+	}
+	w := &Writer{path: path, maxBytes: maxBytes}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open does not follow a symlink, the dir of the journal can be writable by others. The mode
+// and the owner of a journal of an older igo are fixed.
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		err = file.Chmod(0600)
+	}
+	if err == nil {
+		err = file.Chown(os.Geteuid(), os.Getegid())
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the journal to the rotated path, the previous rotated journal is dropped.
+func (w *Writer) rotate() error {
+	w.file.Close()
+	renameErr := os.Rename(w.path, RotatedPath(w.path))
+	if err := w.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// Append writes the event as one line. A nil writer drops the event.
+func (w *Writer) Append(e Event) error {
+	if w == nil {
+		return nil
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(raw)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(raw)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -1,6 +0,0 @@
-//go:build mac
-
-package main
-
-func zombieInit() {
-}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ui3o/codebox/igo/supervisor"
+)
+
+func getEnvString(env string, def string) string {
+	if val, ok := os.LookupEnv(env); ok {
+		return val
+	}
+	return def
+}
+
+func getEnvInt(env string, def int) int {
+	if val, ok := os.LookupEnv(env); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func main() {
+	config := supervisor.IgoConfig{}
+	var pollTimeout int
+	var journalSize int
+	var verbose bool
+	var logLevel string
+	flag.BoolVar(&verbose, "v", false, "verbose, same as -log-level debug")
+	flag.StringVar(&logLevel, "log-level", getEnvString("IGO_LOG_LEVEL", "info"), "output of igo up to this level: emerg, alert, crit, err, warning, notice, info, debug (env IGO_LOG_LEVEL)")
+	flag.StringVar(&config.JournalPath, "journal", os.Getenv("IGO_JOURNAL"), "json lines journal of the lifecycle events, default is .runtime/events.jsonl in the root path (env IGO_JOURNAL)")
+	flag.IntVar(&journalSize, "journal-size", getEnvInt("IGO_JOURNAL_SIZE", 10), "MiB the journal is rotated at, the previous journal is kept as .1, 0 never rotates (env IGO_JOURNAL_SIZE)")
+	flag.StringVar(&config.RootPath, "root", getEnvString("IGO_ROOT_PATH", "/usr/share/igo"), "root path of igo, it contains the addons and the .runtime dir (env IGO_ROOT_PATH)")
+	flag.StringVar(&config.ConfigDir, "config-dir", getEnvString("IGO_CONFIG_DIR", "/etc/igo"), "dir of the persistent addon registry (env IGO_CONFIG_DIR)")
+	flag.StringVar(&config.Group, "group", getEnvString("IGO_GROUP", "igo"), "group of the started processes, empty keeps the group of igo (env IGO_GROUP)")
+	flag.StringVar(&config.Python, "python", getEnvString("IGO_PYTHON", "python3"), "python interpreter that reads config.py (env IGO_PYTHON)")
+	flag.IntVar(&pollTimeout, "poll", getEnvInt("IGO_POLL_TIMEOUT", 3), "seconds between two find cycles (env IGO_POLL_TIMEOUT)")
+	flag.BoolVar(&config.ReapZombies, "reap", true, "wait for orphaned processes, needed when igo runs as pid 1")
+	flag.Parse()
+	config.PollTimeout = time.Duration(pollTimeout) * time.Second
+	config.JournalMaxBytes = int64(journalSize) << 20
+	level, err := supervisor.ParseLogLevel(logLevel)
+	if err != nil {
+		fmt.Println("[IGO]", err)
+		os.Exit(1)
+	}
+	config.LogLevel = level
+	if verbose {
+		config.LogLevel = supervisor.DEBUG
+	}
+
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "check":
+			os.Exit(check(config, args[1:]))
+		case supervisor.SandboxCommand:
+			// igo runs itself with it to start a sandboxed runnable
+			supervisor.RunSandbox(args[1:])
+			os.Exit(126)
+		default:
+			fmt.Println("Usage: igo [flags] [check [-json] [-addon] [path...]]")
+			os.Exit(1)
+		}
+	}
+
+	if err := supervisor.Init(config); err != nil {
+		fmt.Println("[IGO] Could not start:", err)
+		os.Exit(1)
+	}
+	supervisor.Run()
+}
+
+// check validates the units and addons under the paths without starting them, the exit code is 1 on errors.
+func check(config supervisor.IgoConfig, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the result as json")
+	asAddons := flags.Bool("addon", false, "check the paths as addons, ictl addon install checks the staged addon with it")
+	flags.Usage = func() {
+		fmt.Println("Usage: igo check [-json] [-addon] [path...], the default path is the units dir of igo")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	checkPaths := supervisor.Check
+	if *asAddons {
+		checkPaths = supervisor.CheckAddons
+	}
+	result, err := checkPaths(config, flags.Args()...)
+	if err != nil {
+		fmt.Println("[IGO] Could not check:", err)
+		return 2
+	}
+	if *asJson {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		errors, warnings := 0, 0
+		for _, p := range result.Problems {
+			if p.Severity == supervisor.SeverityError {
+				errors++
+			} else {
+				warnings++
+			}
+			fmt.Printf("%-8s %-16s %s\n         %s\n", p.Severity, p.Unit, p.Message, p.Path)
+		}
+		fmt.Printf("checked %d runnables, %d errors, %d warnings\n", len(result.Checked), errors, warnings)
+	}
+	if result.HasErrors() {
+		return 1
+	}
+	return 0
+}
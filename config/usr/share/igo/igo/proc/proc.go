@@ -0,0 +1,136 @@
+// Package proc reads the process trees and their usage from /proc, igo and ictl share it.
+package proc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stat is the part of /proc/<pid>/stat igo and ictl use.
+type Stat struct {
+	Pid  int
+	PPid int
+	// State is R, S, D, Z, ..., a zombie already exited, it only waits for its parent
+	State string
+	// CpuTicks is the user and system time in clock ticks
+	CpuTicks   uint64
+	StartTicks uint64
+	Threads    int
+	RssBytes   uint64
+}
+
+// ReadStat returns the stat of the pid.
+func ReadStat(pid int) (Stat, error) {
+	s := Stat{Pid: pid}
+	raw, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return s, err
+	}
+	// the command name can contain spaces, the fields start after its closing paren
+	end := strings.LastIndexByte(string(raw), ')')
+	if end < 0 {
+		return s, fmt.Errorf("invalid stat of %d", pid)
+	}
+	fields := strings.Fields(string(raw[end+1:]))
+	if len(fields) < 22 {
+		return s, fmt.Errorf("invalid stat of %d", pid)
+	}
+	// fields[0] is the 3rd field of stat
+	s.State = fields[0]
+	s.PPid, _ = strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	s.CpuTicks = utime + stime
+	s.Threads, _ = strconv.Atoi(fields[17])
+	s.StartTicks, _ = strconv.ParseUint(fields[19], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	s.RssBytes = rss * uint64(os.Getpagesize())
+	return s, nil
+}
+
+// Children returns the children of every process by pid.
+func Children() map[int][]int {
+	children := make(map[int][]int)
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if s, err := ReadStat(pid); err == nil {
+			children[s.PPid] = append(children[s.PPid], pid)
+		}
+	}
+	return children
+}
+
+// Tree returns the pid and the pids of its descendants.
+func Tree(pid int, children map[int][]int) []int {
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// IsAlive returns false for the exited processes, the zombies too.
+func IsAlive(pid int) bool {
+	s, err := ReadStat(pid)
+	return err == nil && s.State != "Z"
+}
+
+// Alive returns the pids which did not exit.
+func Alive(pids []int) []int {
+	var alive []int
+	for _, pid := range pids {
+		if IsAlive(pid) {
+			alive = append(alive, pid)
+		}
+	}
+	return alive
+}
+
+// WaitForExit waits until every pid exited, it returns the pids still alive after the timeout.
+func WaitForExit(pids []int, timeout time.Duration) []int {
+	deadline := time.Now().Add(timeout)
+	for {
+		alive := Alive(pids)
+		if len(alive) == 0 || time.Now().After(deadline) {
+			return alive
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// TreeUsage sums the cpu ticks and the resident memory of the process tree.
+func TreeUsage(pid int, children map[int][]int) (uint64, uint64) {
+	var cpuTicks, rssBytes uint64
+	for _, p := range Tree(pid, children) {
+		if s, err := ReadStat(p); err == nil {
+			cpuTicks += s.CpuTicks
+			rssBytes += s.RssBytes
+		}
+	}
+	return cpuTicks, rssBytes
+}
+
+// Cmdline returns the command line of the pid, the name of the stat in brackets for the
+// kernel threads and the zombies.
+func Cmdline(pid int) string {
+	raw, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(raw) == 0 {
+		stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil {
+			return "?"
+		}
+		if start, end := strings.IndexByte(string(stat), '('), strings.LastIndexByte(string(stat), ')'); start >= 0 && end > start {
+			return "[" + string(stat[start+1:end]) + "]"
+		}
+		return "?"
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(raw), "\x00", " "))
+}
@@ -0,0 +1,146 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+const (
+	// scrollbackSize is the output a new viewer gets on attach
+	scrollbackSize = 64 * 1024
+	// viewerWriteTimeout drops viewers which do not read their connection
+	viewerWriteTimeout = 5 * time.Second
+)
+
+// attachHub fans out the output of a running unit to the attached viewers. Only one viewer
+// can write to the pty of the unit, the others are read-only.
+type attachHub struct {
+	mu         sync.Mutex
+	pty        *os.File
+	scrollback []byte
+	viewers    map[net.Conn]bool
+	writer     net.Conn
+	closed     bool
+}
+
+func newAttachHub(pty *os.File) *attachHub {
+	return &attachHub{pty: pty, viewers: make(map[net.Conn]bool)}
+}
+
+// Write stores the output in the scrollback and sends it to every viewer.
+func (h *attachHub) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scrollback = append(h.scrollback, p...)
+	if over := len(h.scrollback) - scrollbackSize; over > 0 {
+		h.scrollback = append([]byte{}, h.scrollback[over:]...)
+	}
+	for conn := range h.viewers {
+		conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		if _, err := conn.Write(p); err != nil {
+			DebugPrintln("drop viewer: ", err)
+			h.dropViewer(conn)
+		}
+	}
+	return len(p), nil
+}
+
+// tail returns the last lines of the scrollback, an unfinished last line too.
+func (h *attachHub) tail(lines int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	text := strings.ReplaceAll(string(h.scrollback), "\r\n", "\n")
+	all := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(all) == 1 && all[0] == "" {
+		return nil
+	}
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return all
+}
+
+func (h *attachHub) dropViewer(conn net.Conn) {
+	delete(h.viewers, conn)
+	if h.writer == conn {
+		h.writer = nil
+	}
+	conn.Close()
+}
+
+// close disconnects the viewers, it is called when the process exited.
+func (h *attachHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for conn := range h.viewers {
+		h.dropViewer(conn)
+	}
+}
+
+// attach serves one viewer until it detaches or the process exits.
+func (h *attachHub) attach(conn net.Conn, reader *bufio.Reader, readOnly bool) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return errors.New("the unit is not running")
+	}
+	interactive := !readOnly && h.pty != nil
+	if interactive && h.writer != nil {
+		h.mu.Unlock()
+		return errors.New("the unit is already attached interactively, use --read-only")
+	}
+	resp := control.Response{Pty: h.pty != nil, ReadOnly: !interactive}
+	if err := control.WriteMessage(conn, resp); err != nil {
+		h.mu.Unlock()
+		return nil
+	}
+	if _, err := conn.Write(h.scrollback); err != nil {
+		h.mu.Unlock()
+		return nil
+	}
+	h.viewers[conn] = true
+	if interactive {
+		h.writer = conn
+	}
+	h.mu.Unlock()
+
+	for {
+		typ, data, err := control.ReadFrame(reader)
+		if err != nil {
+			break
+		}
+		if !interactive {
+			continue
+		}
+		switch typ {
+		case control.FrameInput:
+			h.pty.Write(data)
+		case control.FrameResize:
+			if rows, cols, err := control.ParseResize(data); err == nil {
+				setPtySize(h.pty, rows, cols)
+			}
+		}
+	}
+	h.mu.Lock()
+	if h.viewers[conn] {
+		h.dropViewer(conn)
+	}
+	h.mu.Unlock()
+	return nil
+}
+
+// runningHub returns the output of the running start script for an attach.
+func (addon *AddonType) runningHub() (*attachHub, error) {
+	if addon.hub == nil || !addon.IsRunning {
+		return nil, errors.New("the unit is not running")
+	}
+	return addon.hub, nil
+}
@@ -0,0 +1,304 @@
+package supervisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is one finding of Check. Path is the file or dir the problem was found at.
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Unit     string   `json:"unit"`
+	Path     string   `json:"path"`
+	Message  string   `json:"message"`
+}
+
+type CheckResult struct {
+	Checked  []string  `json:"checked"`
+	Problems []Problem `json:"problems"`
+}
+
+func (r CheckResult) HasErrors() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type checker struct {
+	result CheckResult
+	// asAddons checks the paths as addons wherever they are, like an addon staged by ictl
+	asAddons bool
+	// stack holds the real paths of the dirs being walked, to find the cycles
+	stack []string
+}
+
+func (c *checker) report(severity Severity, unit string, path string, format string, a ...any) {
+	c.result.Problems = append(c.result.Problems, Problem{Severity: severity, Unit: unit, Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// Check validates the addons and units under the paths the same way findRunnables discovers
+// them, without starting anything. Without paths the units dir of igo is checked.
+func Check(c IgoConfig, paths ...string) (CheckResult, error) {
+	return check(c, false, paths)
+}
+
+// CheckAddons validates the runnables under the paths as addons, they do not have to be in the
+// addons dir yet.
+func CheckAddons(c IgoConfig, paths ...string) (CheckResult, error) {
+	return check(c, true, paths)
+}
+
+func check(c IgoConfig, asAddons bool, paths []string) (CheckResult, error) {
+	if err := configure(c); err != nil {
+		return CheckResult{}, err
+	}
+	if len(paths) == 0 {
+		paths = []string{unitDir}
+	}
+	ch := &checker{asAddons: asAddons}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return CheckResult{}, err
+		}
+		ch.walk(path)
+	}
+	sort.Strings(ch.result.Checked)
+	return ch.result, nil
+}
+
+// walk follows symlinks like find -follow does and checks every runnable it finds.
+func (c *checker) walk(dir string) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		c.report(SeverityError, filepath.Base(dir), dir, "broken symlink: %v", err)
+		return
+	}
+	for i, walked := range c.stack {
+		if walked == realDir {
+			c.reportCycle(dir, realDir, c.stack[i:])
+			return
+		}
+	}
+	c.stack = append(c.stack, realDir)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.report(SeverityError, filepath.Base(dir), dir, "could not read dir: %v", err)
+		return
+	}
+	hasConfig, hasRunnable := false, false
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			if entry.Type()&os.ModeSymlink != 0 {
+				target, _ := os.Readlink(path)
+				c.report(SeverityError, entry.Name(), path, "broken symlink to %s", target)
+			}
+			continue
+		}
+		if info.IsDir() {
+			c.walk(path)
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if entry.Name() == addonConfigName {
+			hasConfig = true
+		}
+		if ext == ".start" || (ext == ".disabled" && c.isAddon(path)) {
+			hasRunnable = true
+			c.checkRunnable(path, info)
+		}
+	}
+	if hasConfig && !hasRunnable {
+		name := filepath.Base(dir)
+		c.report(SeverityError, name, dir, "%s found, but there is no %s.start next to it", addonConfigName, name)
+	}
+}
+
+// reportCycle reports a dir which links back to a dir being walked. igo has no dependencies
+// between the units, they depend on each other if one includes the other by a symlink, igo would
+// find both in each other without end. A cycle within one unit is a symlink cycle.
+func (c *checker) reportCycle(dir string, realDir string, cycle []string) {
+	var units []string
+	for _, walked := range cycle {
+		name := filepath.Base(walked)
+		for _, ext := range []string{".start", ".disabled"} {
+			if _, err := os.Stat(filepath.Join(walked, name+ext)); err == nil {
+				units = append(units, name)
+				break
+			}
+		}
+	}
+	if len(units) > 1 {
+		c.report(SeverityError, units[0], dir, "dependency cycle, the units include each other by symlinks: %s -> %s", strings.Join(units, " -> "), units[0])
+		return
+	}
+	c.report(SeverityError, filepath.Base(dir), dir, "symlink cycle, %s is already walked as %s", dir, realDir)
+}
+
+func (c *checker) isAddon(path string) bool {
+	if c.asAddons || isAddonPath(path) {
+		return true
+	}
+	_, ok := relativeTo(addonDir, path)
+	return ok
+}
+
+func (c *checker) checkRunnable(startPath string, info os.FileInfo) {
+	dir := filepath.Dir(startPath)
+	name := filepath.Base(dir)
+	execName := filepath.Base(startPath)
+	ext := filepath.Ext(execName)
+	c.result.Checked = append(c.result.Checked, startPath)
+
+	if name+ext != execName {
+		c.report(SeverityError, name, startPath, "file name does not match the dir name, igo only starts %s%s", name, ext)
+		return
+	}
+	if info.Mode()&0111 == 0 {
+		c.report(SeverityError, name, startPath, "%s is not executable, igo ignores it", execName)
+	}
+	stopPath := strings.TrimSuffix(startPath, ext) + ".stop"
+	if stopInfo, err := os.Stat(stopPath); err == nil && stopInfo.Mode()&0111 == 0 {
+		c.report(SeverityError, name, stopPath, "%s.stop is not executable", name)
+	}
+
+	if c.isAddon(startPath) {
+		if _, err := os.Stat(originDir); err == nil && isAddonPath(startPath) {
+			if _, err := os.Stat(getOriginPathOfAddon(startPath)); err != nil {
+				c.report(SeverityWarning, name, startPath, "the addon has no origin, it was added after igo started and there is no fallback if it fails")
+			}
+		}
+	} else {
+		c.checkUnitOwner(name, startPath)
+	}
+
+	configPath := filepath.Join(dir, addonConfigName)
+	if _, err := os.Stat(configPath); err == nil {
+		c.checkConfig(name, configPath)
+	}
+}
+
+// getUser returns the user the unit is started with.
+func (c *checker) getUser(startPath string) (*user.User, error) {
+	if _, inUnits := relativeTo(unitDir, startPath); inUnits {
+		return getUnitUser(startPath)
+	}
+	// not started yet, ictl start links it for the current user
+	return user.Current()
+}
+
+func (c *checker) checkUnitOwner(name string, startPath string) {
+	linuxUser, err := c.getUser(startPath)
+	if err != nil {
+		c.report(SeverityError, name, startPath, "could not get the user of the unit: %v", err)
+		return
+	}
+	if err := checkOwner(startPath, linuxUser); err != nil {
+		c.report(SeverityError, name, startPath, "security check fails, igo does not start the unit: %v", err)
+	}
+}
+
+func (c *checker) checkConfig(name string, configPath string) {
+	out, err := os.CreateTemp("", "igo-check-*.json")
+	if err != nil {
+		c.report(SeverityError, name, configPath, "could not create temp file: %v", err)
+		return
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	if err := runConfigPy(filepath.Dir(configPath), out.Name(), Start); err != nil {
+		c.report(SeverityError, name, configPath, "config.py fails: %v", err)
+		return
+	}
+	raw, err := os.ReadFile(out.Name())
+	if err != nil {
+		c.report(SeverityError, name, configPath, "could not read config output: %v", err)
+		return
+	}
+	var conf RunnableConfig
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&conf); err != nil {
+		c.report(SeverityError, name, configPath, "invalid conf: %v", err)
+		return
+	}
+
+	conf = c.expandConfig(name, configPath, conf)
+
+	for _, props := range []struct {
+		phase string
+		props RunnableProps
+	}{{"start", conf.Start}, {"stop", conf.Stop}} {
+		if props.props.Wd == "" {
+			continue
+		}
+		if info, err := os.Stat(props.props.Wd); err != nil || !info.IsDir() {
+			c.report(SeverityWarning, name, configPath, "%s.wd %s is not a directory", props.phase, props.props.Wd)
+		}
+	}
+	for _, glob := range conf.WatchPaths {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			c.report(SeverityError, name, configPath, "invalid watchPaths pattern %q: %v", glob, err)
+		}
+	}
+	for _, err := range conf.RunnableSandbox.validate() {
+		c.report(SeverityError, name, configPath, "invalid sandbox: %v", err)
+	}
+	for _, cond := range append(append([]RunnableCondition{}, conf.Conditions...), conf.Assertions...) {
+		if n := cond.kinds(); n != 1 {
+			c.report(SeverityError, name, configPath, "condition %q has %d checks, it needs exactly one", cond.String(), n)
+		}
+	}
+}
+
+// expandConfig expands the variables of the config like igo does at the start. The env of
+// igo can differ from the env of the check, so a variable which is not set is a warning.
+func (c *checker) expandConfig(name string, configPath string, conf RunnableConfig) RunnableConfig {
+	base := &AddonBase{StartPath: filepath.Join(filepath.Dir(configPath), name+".start")}
+	addon := &AddonType{Name: name, IsAddon: c.isAddon(base.StartPath)}
+	if !addon.IsAddon {
+		addon.User, _ = c.getUser(base.StartPath)
+	}
+	tags := base.getEnvTagForProcess(addon)
+	if tags == nil {
+		return conf
+	}
+	for name, value := range base.getSpecifiers(addon) {
+		tags[name] = value
+	}
+	expanded, err := expandConfig(conf, tags, make(map[string]bool))
+	if errors.Is(err, errVariableNotSet) {
+		c.report(SeverityWarning, name, configPath, "%v", err)
+		return conf
+	}
+	if err != nil {
+		c.report(SeverityError, name, configPath, "invalid variable: %v", err)
+		return conf
+	}
+	return expanded
+}
@@ -1,6 +1,7 @@
-package main
+package supervisor
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -44,6 +45,38 @@ func getAddonPath(addonName string) string {
 	return filepath.Join(addonDir, dir, addonName)
 }
 
+// getRunPath maps a path in the units or the origins dir to the same path in the run dir.
+func getRunPath(path string) string {
+	if rel, ok := relativeTo(originDir, path); ok {
+		return filepath.Join(runDir, "origins", rel)
+	}
+	if rel, ok := relativeTo(unitDir, path); ok {
+		return filepath.Join(runDir, rel)
+	}
+	return path
+}
+
+// getOriginPathOfAddon maps a path of the addons symlink in the units dir to the origins dir.
+func getOriginPathOfAddon(path string) string {
+	if rel, ok := relativeTo(filepath.Join(unitDir, "addons"), path); ok {
+		return filepath.Join(originDir, rel)
+	}
+	return path
+}
+
+func isAddonPath(path string) bool {
+	_, ok := relativeTo(filepath.Join(unitDir, "addons"), path)
+	return ok
+}
+
+func relativeTo(base string, path string) (string, bool) {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
 func getDummyOriginConfigPath() string {
 	return filepath.Join("dummy", addonConfigName)
 }
@@ -64,3 +97,21 @@ const (
 func (ll LogLevel) String() string {
 	return [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}[ll]
 }
+
+func closeFiles(files ...*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// ParseLogLevel returns the level of its name, e.g. "notice".
+func ParseLogLevel(name string) (LogLevel, error) {
+	for ll := EMERG; ll <= DEBUG; ll++ {
+		if ll.String() == name {
+			return ll, nil
+		}
+	}
+	return DEBUG, fmt.Errorf("unknown log level: %s", name)
+}
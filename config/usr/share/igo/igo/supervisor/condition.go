@@ -0,0 +1,167 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// RunnableCondition is one check of the conditions or assertions list in config.py.
+// Only one of Env, PathExists, FileNotEmpty and UserInGroup should be set per entry.
+type RunnableCondition struct {
+	// Env is the name of an env var, it has to be set, or equal to Equals if that is given.
+	Env          string  `json:"env"`
+	Equals       *string `json:"equals"`
+	PathExists   string  `json:"pathExists"`
+	FileNotEmpty string  `json:"fileNotEmpty"`
+	UserInGroup  string  `json:"userInGroup"`
+	Negate       bool    `json:"negate"`
+}
+
+func (c RunnableCondition) String() string {
+	var s string
+	switch {
+	case c.Env != "" && c.Equals != nil:
+		s = fmt.Sprintf("env %s=%s", c.Env, *c.Equals)
+	case c.Env != "":
+		s = fmt.Sprintf("env %s is set", c.Env)
+	case c.PathExists != "":
+		s = fmt.Sprintf("path %s exists", c.PathExists)
+	case c.FileNotEmpty != "":
+		s = fmt.Sprintf("file %s is not empty", c.FileNotEmpty)
+	case c.UserInGroup != "":
+		s = fmt.Sprintf("user is in group %s", c.UserInGroup)
+	default:
+		s = "empty condition"
+	}
+	if c.Negate {
+		return "not " + s
+	}
+	return s
+}
+
+// kinds returns how many checks are set in the condition, igo check reports entries with more or less than one.
+func (c RunnableCondition) kinds() int {
+	n := 0
+	for _, set := range []bool{c.Env != "", c.PathExists != "", c.FileNotEmpty != "", c.UserInGroup != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// check evaluates the condition for the addon. envs are the envs from the config,
+// they take precedence over the env of igo the same way as at the start of the process.
+func (c RunnableCondition) check(addon *AddonType, envs map[string]string) bool {
+	var ok bool
+	switch {
+	case c.Env != "":
+		val, set := envs[c.Env]
+		if !set {
+			val, set = os.LookupEnv(c.Env)
+		}
+		ok = set && (c.Equals == nil || val == *c.Equals)
+	case c.PathExists != "":
+		_, err := addon.statAsUser(c.PathExists)
+		ok = err == nil
+	case c.FileNotEmpty != "":
+		info, err := addon.statAsUser(c.FileNotEmpty)
+		ok = err == nil && info.Mode().IsRegular() && info.Size() > 0
+	case c.UserInGroup != "":
+		ok = isUserInGroup(addon.User, c.UserInGroup)
+	default:
+		ok = true
+	}
+	return ok != c.Negate
+}
+
+// statAsUser stats the path with the credentials of the user of a unit, a unit must not learn
+// about the paths only root can reach. Addons and origins run as root.
+func (addon *AddonType) statAsUser(path string) (info os.FileInfo, err error) {
+	if addon.IsAddon || addon.User == nil || addon.User.Uid == "0" {
+		return os.Stat(path)
+	}
+	if credErr := asUser(addon.User, func() { info, err = os.Stat(path) }); credErr != nil {
+		return nil, credErr
+	}
+	return info, err
+}
+
+func isUserInGroup(u *user.User, groupName string) bool {
+	if u == nil {
+		// addons and origins run as root
+		var err error
+		if u, err = user.Lookup("root"); err != nil {
+			return false
+		}
+	}
+	grp, err := user.LookupGroup(groupName)
+	if err != nil {
+		return false
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, gid := range groupIds {
+		if gid == grp.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConditions returns the reason why the addon must not be started, or an empty
+// string if all conditions and assertions pass.
+func (rc RunnableConfig) checkConditions(addon *AddonType) string {
+	for _, c := range rc.Conditions {
+		if !c.check(addon, rc.Start.Envs) {
+			return "condition failed: " + c.String()
+		}
+	}
+	for _, c := range rc.Assertions {
+		if !c.check(addon, rc.Start.Envs) {
+			return "assertion failed: " + c.String()
+		}
+	}
+	return ""
+}
+
+func (a *AddonBase) getSkipFilePath(addon *AddonType) string {
+	return filepath.Join(filepath.Dir(getRunPath(a.StartPath)), addon.Name+".skipped")
+}
+
+// watchSkipped keeps a skipped addon parked until its conditions pass, its watched files
+// change or the skip file is removed. The skip file holds the reason, so ictl can show it.
+func (a *AddonBase) watchSkipped(addon *AddonType) {
+	addon.IsRunning = true
+	skipPath := a.getSkipFilePath(addon)
+	if err := touchFile(skipPath, addon.User); err == nil {
+		os.WriteFile(skipPath, []byte(addon.SkipReason+"\n"), 0664)
+	}
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go watchFiles(addon.Name, addon.WatchPaths, watchDone, func() {
+		fmt.Println("[IGO] Watched files changed, removing skip file: ", skipPath)
+		os.Remove(skipPath)
+	})
+	for {
+		if _, err := os.Stat(skipPath); err != nil {
+			fmt.Println("[IGO] Skip file removed, checking conditions again: ", addon.Name)
+			break
+		}
+		if addon.Config.checkConditions(addon) == "" {
+			fmt.Println("[IGO] Conditions passed, starting: ", addon.Name)
+			os.Remove(skipPath)
+			break
+		}
+		if !sleepUnlocked(pollTimeout) {
+			return
+		}
+	}
+	addon.SkipReason = ""
+	addon.IsRestarting = true
+	addon.IsRunning = false
+}
@@ -0,0 +1,201 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+// defaultRestartTimeout is the wait for the exit of the old process of a restart before SIGKILL
+const defaultRestartTimeout = 10 * time.Second
+
+var controlListener net.Listener
+
+// startControlServer listens on the control socket, ictl connects to it to attach to,
+// restart, stop, watch, exec in, read the events of and get the status of the units. The peer credentials and the policy decide what is allowed.
+func startControlServer() error {
+	stopControlServer()
+	socketPath := control.SocketPath(igoRootPath)
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0775); err != nil {
+		return err
+	}
+	os.Remove(socketPath)
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	// every user can connect, the peer credentials decide what is allowed
+	if err := os.Chmod(socketPath, 0666); err != nil {
+		l.Close()
+		return err
+	}
+	controlListener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn)
+		}
+	}()
+	return nil
+}
+
+func stopControlServer() {
+	if controlListener != nil {
+		controlListener.Close()
+		controlListener = nil
+	}
+}
+
+func handleControlConn(conn net.Conn) {
+	defer conn.Close()
+	uid, err := getPeerUid(conn)
+	if err != nil {
+		fmt.Println("[IGO] ", ERR, " control connection without credentials: ", err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var req control.Request
+	if err := control.ReadMessage(reader, &req); err != nil {
+		return
+	}
+	DebugPrintln("control request from uid ", uid, ": ", req)
+	perms := peerPermissions(uid)
+	timeout := defaultRestartTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+	switch req.Action {
+	case control.ActionAttach:
+		addonsMu.Lock()
+		var hub *attachHub
+		readOnly := req.ReadOnly
+		addon, err := findAddonForPeer(req.Name, req.User, uid, perms, control.PermReadLogs)
+		if err == nil {
+			// only the owner can write to the unit, the others can read its output
+			readOnly = readOnly || (uid != 0 && fmt.Sprint(uid) != addon.ownerUid())
+			hub, err = addon.runningHub()
+		}
+		addonsMu.Unlock()
+		if err == nil {
+			err = hub.attach(conn, reader, readOnly)
+		}
+		if err != nil {
+			control.WriteMessage(conn, control.Response{Error: err.Error()})
+		}
+	case control.ActionExec:
+		addonsMu.Lock()
+		addon, err := findAddonForPeer(req.Name, req.User, uid, nil, "")
+		addonsMu.Unlock()
+		if err == nil {
+			err = addon.exec(conn, reader, req, uid)
+		}
+		if err != nil {
+			control.WriteMessage(conn, control.Response{Error: err.Error()})
+		}
+	case control.ActionWatch:
+		watchUnits(conn, uid, perms[control.PermListAll], perms[control.PermReadLogs])
+	case control.ActionEvents:
+		// the journal has the reasons and the commands of the units of everyone
+		streamEvents(conn, req, uid, uid == 0 || perms[control.PermReadLogs])
+	default:
+		addonsMu.Lock()
+		resp := controlResponse(req, uid, perms, timeout)
+		addonsMu.Unlock()
+		control.WriteMessage(conn, resp)
+	}
+}
+
+// controlResponse handles the requests with one response, it is called with addonsMu held.
+func controlResponse(req control.Request, uid uint32, perms map[string]bool, timeout time.Duration) control.Response {
+	resp := control.Response{}
+	var err error
+	switch req.Action {
+	case control.ActionRestart:
+		var addon *AddonType
+		if addon, err = findAddonForPeer(req.Name, req.User, uid, perms, control.PermStopOthers); err == nil {
+			resp.Pid, err = addon.restart(timeout)
+		}
+	case control.ActionStop:
+		var addon *AddonType
+		if addon, err = findAddonForPeer(req.Name, req.User, uid, perms, control.PermStopOthers); err == nil {
+			resp.Pid = addon.Pid
+			err = addon.stop(timeout)
+		}
+	case control.ActionEnv:
+		// the env can have secrets, only the owner and root can see it, no permission grants it
+		var addon *AddonType
+		if addon, err = findAddonForPeer(req.Name, req.User, uid, nil, ""); err == nil {
+			var env control.RunnableEnv
+			restartType := Start
+			if req.StopConfig {
+				restartType = Stop
+			}
+			if env, err = addon.runnableEnv(restartType); err == nil {
+				resp.Env = &env
+			}
+		}
+	case control.ActionStatus:
+		// the status is visible like the unit in the list
+		var addon *AddonType
+		addon, err = findAddon(req.Name, req.User)
+		if err == nil && !addon.isVisible(uid, perms[control.PermListAll]) {
+			err = errors.New("permission denied")
+		}
+		if err == nil {
+			lines, exits := defaultStatusLines, defaultStatusExits
+			if req.Lines != nil {
+				lines = *req.Lines
+			}
+			if req.Exits != nil {
+				exits = *req.Exits
+			}
+			status := addon.status(uid, perms, lines, exits)
+			resp.Status = &status
+		}
+	case control.ActionPermissions:
+		resp.Permissions = []string{}
+		for perm := range perms {
+			resp.Permissions = append(resp.Permissions, perm)
+		}
+		sort.Strings(resp.Permissions)
+	default:
+		err = errors.New("unknown action: " + req.Action)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// findAddonForPeer returns the running unit, root can reach every unit, the users their own
+// and the units the policy grants the permission on.
+func findAddonForPeer(name string, userName string, uid uint32, perms map[string]bool, perm string) (*AddonType, error) {
+	addon, err := findAddon(name, userName)
+	if err != nil {
+		return nil, err
+	}
+	if !addon.canReach(uid, perms, perm) {
+		return nil, errors.New("permission denied")
+	}
+	return addon, nil
+}
+
+// findAddon returns the registered unit, it is called with addonsMu held.
+func findAddon(name string, userName string) (*AddonType, error) {
+	for _, addon := range runningAddons {
+		if addon.Name == name && addon.userName() == userName {
+			return addon, nil
+		}
+	}
+	return nil, fmt.Errorf("unit %s of %s is not found", name, userName)
+}
@@ -0,0 +1,136 @@
+package supervisor
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+// eventJournal is opened by Init, every lifecycle event is appended to it
+var eventJournal *journal.Writer
+
+// keptExits is the count of the last exits of an addon kept for ictl status
+const keptExits = 20
+
+func (addon *AddonType) processType() string {
+	switch {
+	case addon.IsAddon && addon.IsOrigin:
+		return "origin"
+	case addon.IsAddon:
+		return "addon"
+	default:
+		return "unit"
+	}
+}
+
+func (addon *AddonType) userName() string {
+	if addon.IsAddon || addon.User == nil {
+		return "root"
+	}
+	return addon.User.Username
+}
+
+// logEvent prints the event if the log level allows it and appends it to the journal. The
+// journal gets every event, the log level only filters the output of igo. It is called with
+// addonsMu held, the addon counts the event for ictl status.
+func (addon *AddonType) logEvent(level LogLevel, event string, format string, a ...any) {
+	reason := fmt.Sprintf(format, a...)
+	if level <= Config.LogLevel {
+		fmt.Printf("[IGO] %s %s %s %s (%s of %s): %s\n", level, addon.Name, event, pidString(addon.Pid), addon.processType(), addon.userName(), reason)
+	}
+	e := journal.Event{
+		Time:   time.Now(),
+		Level:  level.String(),
+		Unit:   addon.Current.Id,
+		Name:   addon.Name,
+		User:   addon.userName(),
+		Type:   addon.processType(),
+		Event:  event,
+		Pid:    addon.Pid,
+		Reason: reason,
+	}
+	if event == journal.EventExited {
+		exitCode := addon.ExitCode
+		e.ExitCode = &exitCode
+		addon.exits = append(addon.exits, e)
+		if len(addon.exits) > keptExits {
+			addon.exits = addon.exits[1:]
+		}
+	}
+	if addon.counters == nil {
+		addon.counters = make(map[string]int)
+	}
+	addon.counters[event]++
+	eventHub.publish(e)
+	if err := eventJournal.Append(e); err != nil {
+		fmt.Println("[IGO] ", ERR, " could not write the journal: ", err)
+	}
+}
+
+func pidString(pid int) string {
+	if pid == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("pid %d", pid)
+}
+
+// streamEvents sends the events of the journal the peer can see, with readAll every event,
+// otherwise the events of its own units. With follow the new events are sent until the peer
+// closes the connection.
+func streamEvents(conn net.Conn, req control.Request, uid uint32, readAll bool) {
+	userName, err := peerUserName(uid)
+	if err != nil {
+		control.WriteMessage(conn, control.Response{Error: err.Error()})
+		return
+	}
+	visible := func(e journal.Event) bool {
+		return (req.Name == "" || e.Name == req.Name) && (readAll || e.User == userName)
+	}
+	// the subscription starts before the read, the events written meanwhile are not lost
+	var events chan journal.Event
+	if req.Follow {
+		events = eventHub.subscribe()
+		defer eventHub.unsubscribe(events)
+	}
+	if err := control.WriteMessage(conn, control.Response{}); err != nil {
+		return
+	}
+	send := func(e journal.Event) error {
+		conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		return control.WriteMessage(conn, e)
+	}
+	var last time.Time
+	err = journal.Read(Config.JournalPath, func(e journal.Event) error {
+		last = e.Time
+		if !visible(e) {
+			return nil
+		}
+		return send(e)
+	})
+	if err != nil || !req.Follow {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-events:
+			// the events of the subscription which were already in the journal
+			if !e.Time.After(last) || !visible(e) {
+				continue
+			}
+			if send(e) != nil {
+				return
+			}
+		}
+	}
+}
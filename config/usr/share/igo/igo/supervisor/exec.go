@@ -0,0 +1,351 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+// namespaces are entered with the nsenter flag by an exec if the unit has its own
+var namespaces = []struct {
+	name string
+	flag string
+}{
+	{"mnt", "-m"},
+	{"net", "-n"},
+	{"ipc", "-i"},
+	{"uts", "-u"},
+	{"pid", "-p"},
+	{"cgroup", "-C"},
+}
+
+// unitNamespaces returns the namespaces of the pid which differ from the namespaces of igo.
+func unitNamespaces(pid int) []string {
+	var names []string
+	for _, ns := range namespaces {
+		own, err := os.Readlink(filepath.Join("/proc/self/ns", ns.name))
+		if err != nil {
+			continue
+		}
+		if other, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", ns.name)); err == nil && other != own {
+			names = append(names, ns.name)
+		}
+	}
+	return names
+}
+
+// readCgroup returns the cgroup v2 path of the pid.
+func readCgroup(pid string) string {
+	raw, err := os.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// joinCgroup moves the pid to the cgroup of the unit if it is not in the cgroup of igo.
+func joinCgroup(pid int, unitPid int) error {
+	cgroup := readCgroup(strconv.Itoa(unitPid))
+	if cgroup == "" || cgroup == readCgroup("self") {
+		return nil
+	}
+	procs := filepath.Join("/sys/fs/cgroup", cgroup, "cgroup.procs")
+	return os.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644)
+}
+
+// runnableEnv returns the environment of the start or the stop script of the addon. The start
+// script got the config of the last start, the stop config is read like before a stop, the
+// config of the running addon is not changed. It is called with addonsMu held.
+func (addon *AddonType) runnableEnv(restartType RestartType) (control.RunnableEnv, error) {
+	env := control.RunnableEnv{Path: addon.Current.StartPath, Gid: igoGrpId}
+	envTags := addon.Current.getEnvTagForProcess(addon)
+	if envTags == nil {
+		return env, errors.New("the user of the unit is not found")
+	}
+	for name, value := range addon.Current.getSpecifiers(addon) {
+		envTags[name] = value
+	}
+	conf := addon.Config.Start
+	if restartType == Stop {
+		base := addon.Current
+		if base.StopPath == "" {
+			return env, errors.New("the unit has no stop script")
+		}
+		env.Path = base.StopPath
+		base.Config = RunnableConfig{}
+		base.readRunnableConfig(base.StopPath, Stop)
+		if err := base.expandRunnableConfig(addon, envTags); err != nil {
+			return env, fmt.Errorf("can not expand the config, %v", err)
+		}
+		conf = base.Config.Stop
+	}
+	env.Env = runnableEnviron(envTags, conf.Envs)
+	if restartType == Start && addon.Config.Pty && !hasEnv(env.Env, "TERM") {
+		env.Env = append(env.Env, "TERM=xterm-256color")
+	}
+	sort.Strings(env.Env)
+
+	env.Wd = conf.Wd
+	if env.Wd == "" {
+		env.Wd, _ = os.Getwd()
+	}
+	if os.Geteuid() != 0 {
+		env.Uid, env.Gid = os.Geteuid(), os.Getegid()
+	} else {
+		cred := addon.runnableCredential()
+		env.Uid, env.Gid = int(cred.Uid), int(cred.Gid)
+	}
+	if addon.IsRunning && addon.Pid != 0 {
+		env.Pid = addon.Pid
+		env.Namespaces = unitNamespaces(addon.Pid)
+	}
+	return env, nil
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func getEnv(env []string, name string) string {
+	value := ""
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, name+"="); ok {
+			value = v
+		}
+	}
+	return value
+}
+
+// lookPathIn finds the file in the PATH of the env, not in the PATH of igo.
+func lookPathIn(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(getEnv(env, "PATH")) {
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not found in the PATH of the unit", file)
+}
+
+// execCmd returns the command in the environment, the namespaces of the unit are entered by
+// nsenter, which drops the privileges after it, a go process can not enter a mount namespace.
+func execCmd(env control.RunnableEnv, command []string) (*exec.Cmd, error) {
+	// the scripts without wd inherit the wd of igo without a chdir, the user of the unit can be
+	// unable to enter it
+	igoWd, _ := os.Getwd()
+	attr := &syscall.SysProcAttr{}
+	var cmd *exec.Cmd
+	if len(env.Namespaces) != 0 {
+		if os.Geteuid() != 0 {
+			return nil, errors.New("the namespaces of the unit can be entered only if igo runs as root")
+		}
+		args := []string{"-t", strconv.Itoa(env.Pid)}
+		for _, ns := range namespaces {
+			for _, name := range env.Namespaces {
+				if name == ns.name {
+					args = append(args, ns.flag)
+				}
+			}
+		}
+		args = append(args, "-S", strconv.Itoa(env.Uid), "-G", strconv.Itoa(env.Gid))
+		if env.Wd != igoWd {
+			args = append(args, "--wd="+env.Wd)
+		}
+		args = append(args, "--")
+		cmd = exec.Command("nsenter", append(args, command...)...)
+	} else {
+		path, err := lookPathIn(command[0], env.Env)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(path, command[1:]...)
+		if env.Wd != igoWd {
+			cmd.Dir = env.Wd
+		}
+		if os.Geteuid() == 0 {
+			attr.Credential = &syscall.Credential{Uid: uint32(env.Uid), Gid: uint32(env.Gid)}
+		}
+	}
+	cmd.Env = env.Env
+	cmd.SysProcAttr = attr
+	return cmd, nil
+}
+
+// exec runs the command of the request in the environment of the addon and streams its
+// output in frames until it exits. The command is killed if the client disconnects. It is
+// called without addonsMu, it holds it only while it reads the addon.
+func (addon *AddonType) exec(conn net.Conn, reader *bufio.Reader, req control.Request, uid uint32) error {
+	if len(req.Command) == 0 {
+		return errors.New("no command is given")
+	}
+	restartType := Start
+	if req.StopConfig {
+		restartType = Stop
+	}
+	addonsMu.Lock()
+	env, err := addon.runnableEnv(restartType)
+	addonsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if req.Tty && req.Term != "" && !hasEnv(env.Env, "TERM") {
+		env.Env = append(env.Env, "TERM="+req.Term)
+	}
+	cmd, err := execCmd(env, req.Command)
+	if err != nil {
+		return err
+	}
+
+	var master, slave *os.File
+	var stdin io.WriteCloser
+	var outputs []io.ReadCloser
+	if req.Tty {
+		if master, slave, err = openPty(); err != nil {
+			return fmt.Errorf("can not open pty, %v", err)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		stdin = master
+		outputs = []io.ReadCloser{master}
+	} else {
+		cmd.SysProcAttr.Setpgid = true
+		var stdout, stderr io.ReadCloser
+		if stdin, err = cmd.StdinPipe(); err == nil {
+			if stdout, err = cmd.StdoutPipe(); err == nil {
+				stderr, err = cmd.StderrPipe()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		outputs = []io.ReadCloser{stdout, stderr}
+	}
+	err = cmd.Start()
+	if slave != nil {
+		slave.Close()
+	}
+	if err != nil {
+		closeFiles(master)
+		return fmt.Errorf("can not run %s, %v", req.Command[0], err)
+	}
+	pid := cmd.Process.Pid
+	if env.Pid != 0 {
+		if err := joinCgroup(pid, env.Pid); err != nil {
+			fmt.Println("[IGO] ", WARNING, " could not move the exec to the cgroup of ", addon.Name, ": ", err)
+		}
+	}
+	config := "start"
+	if req.StopConfig {
+		config = "stop"
+	}
+	addonsMu.Lock()
+	// the arguments can have secrets, the journal only gets the program
+	addon.logEvent(NOTICE, journal.EventExec, "uid %d runs %s with the %s config", uid, req.Command[0], config)
+	addonsMu.Unlock()
+	if err := control.WriteMessage(conn, control.Response{Pid: pid, Pty: req.Tty}); err != nil {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		cmd.Wait()
+		closeFiles(master)
+		return nil
+	}
+
+	var writeMu sync.Mutex
+	writeFrame := func(typ byte, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return control.WriteFrame(conn, typ, data)
+	}
+	exited := make(chan struct{})
+	go func() {
+		for {
+			typ, data, err := control.ReadFrame(reader)
+			if err != nil {
+				// the client is gone, nobody reads the output of the command
+				select {
+				case <-exited:
+				default:
+					syscall.Kill(-pid, syscall.SIGKILL)
+				}
+				return
+			}
+			switch typ {
+			case control.FrameInput:
+				stdin.Write(data)
+			case control.FrameResize:
+				if rows, cols, err := control.ParseResize(data); err == nil && master != nil {
+					setPtySize(master, rows, cols)
+				}
+			case control.FrameEOF:
+				if master != nil {
+					// ctrl-d ends the input of a terminal
+					master.Write([]byte{4})
+				} else {
+					stdin.Close()
+				}
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for i, output := range outputs {
+		typ := control.FrameStdout
+		if i == 1 {
+			typ = control.FrameStderr
+		}
+		readers.Add(1)
+		go func(output io.Reader, typ byte) {
+			defer readers.Done()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := output.Read(buf)
+				if n > 0 {
+					writeFrame(typ, buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(output, typ)
+	}
+	readers.Wait()
+	cmd.Wait()
+	close(exited)
+	closeFiles(master)
+
+	exitCode := -1
+	if state := cmd.ProcessState; state != nil {
+		exitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exitCode = 128 + int(status.Signal())
+		}
+	}
+	writeFrame(control.FrameExit, control.ExitPayload(exitCode))
+	return nil
+}
@@ -0,0 +1,198 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errVariableNotSet = errors.New("variable is not set")
+
+// expand replaces ${VAR} and ${VAR:-default} in s, $$ is a literal $. The default is used when
+// the variable is unset or empty, a variable without default has to be set.
+func expand(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("missing } in %q", s)
+			}
+			expr := s[i+2 : i+2+end]
+			name, def, hasDef := strings.Cut(expr, ":-")
+			if !isVarName(name) {
+				return "", fmt.Errorf("invalid variable ${%s} in %q", expr, s)
+			}
+			val, ok := lookup(name)
+			switch {
+			case ok && (val != "" || !hasDef):
+				b.WriteString(val)
+			case hasDef:
+				b.WriteString(def)
+			default:
+				return "", fmt.Errorf("%w: %s in %q", errVariableNotSet, name, s)
+			}
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+func isVarName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// getSpecifiers returns the variables igo provides for the runnable, they are exported to
+// the process too.
+func (a *AddonBase) getSpecifiers(addonCmd *AddonType) map[string]string {
+	name := addonCmd.Name
+	instance := ""
+	if _, after, ok := strings.Cut(name, "@"); ok {
+		instance = after
+	}
+	home, stateDir := "/root", filepath.Join("/var/lib/igo", name)
+	if !addonCmd.IsAddon && addonCmd.User != nil {
+		home = addonCmd.User.HomeDir
+		stateDir = filepath.Join(home, ".local/state/igo", name)
+	}
+	return map[string]string{
+		"IGO_PROCESS_INSTANCE":  instance,
+		"IGO_PROCESS_HOME":      home,
+		"IGO_PROCESS_RUN_DIR":   getRunPath(filepath.Dir(a.StartPath)),
+		"IGO_PROCESS_STATE_DIR": stateDir,
+	}
+}
+
+// expandConfig expands the variables of the paths, wd, params and envs of the config. The
+// envs can use the env of igo and the tags of the process, the rest can use the envs too.
+func expandConfig(conf RunnableConfig, tags map[string]string, used map[string]bool) (RunnableConfig, error) {
+	var err error
+	lookupEnv := func(envs map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			used[name] = true
+			if val, ok := tags[name]; ok {
+				return val, true
+			}
+			if val, ok := envs[name]; ok {
+				return val, true
+			}
+			return os.LookupEnv(name)
+		}
+	}
+	expandAll := func(values []string, lookup func(string) (string, bool)) ([]string, error) {
+		if values == nil {
+			return nil, nil
+		}
+		result := make([]string, len(values))
+		for i, v := range values {
+			if result[i], err = expand(v, lookup); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	expandProps := func(props RunnableProps) (RunnableProps, error) {
+		result := props
+		if props.Envs != nil {
+			result.Envs = make(map[string]string, len(props.Envs))
+			for name, v := range props.Envs {
+				if result.Envs[name], err = expand(v, lookupEnv(nil)); err != nil {
+					return result, fmt.Errorf("envs.%s: %w", name, err)
+				}
+			}
+		}
+		lookup := lookupEnv(result.Envs)
+		if result.Wd, err = expand(props.Wd, lookup); err != nil {
+			return result, fmt.Errorf("wd: %w", err)
+		}
+		if result.Params, err = expandAll(props.Params, lookup); err != nil {
+			return result, fmt.Errorf("params: %w", err)
+		}
+		return result, nil
+	}
+
+	result := conf
+	if result.Start, err = expandProps(conf.Start); err != nil {
+		return conf, fmt.Errorf("start.%w", err)
+	}
+	if result.Stop, err = expandProps(conf.Stop); err != nil {
+		return conf, fmt.Errorf("stop.%w", err)
+	}
+	lookup := lookupEnv(result.Start.Envs)
+	for _, paths := range []struct {
+		name string
+		dst  *[]string
+	}{
+		{"watchPaths", &result.WatchPaths},
+		{"readOnlyPaths", &result.ReadOnlyPaths},
+		{"inaccessiblePaths", &result.InaccessiblePaths},
+		{"bindPaths", &result.BindPaths},
+	} {
+		if *paths.dst, err = expandAll(*paths.dst, lookup); err != nil {
+			return conf, fmt.Errorf("%s: %w", paths.name, err)
+		}
+	}
+	for _, conds := range []*[]RunnableCondition{&result.Conditions, &result.Assertions} {
+		if *conds == nil {
+			continue
+		}
+		expanded := make([]RunnableCondition, len(*conds))
+		for i, c := range *conds {
+			if c.PathExists, err = expand(c.PathExists, lookup); err != nil {
+				return conf, fmt.Errorf("condition %s: %w", c.String(), err)
+			}
+			if c.FileNotEmpty, err = expand(c.FileNotEmpty, lookup); err != nil {
+				return conf, fmt.Errorf("condition %s: %w", c.String(), err)
+			}
+			expanded[i] = c
+		}
+		*conds = expanded
+	}
+	return result, nil
+}
+
+// expandRunnableConfig expands the config read for the addon and creates the state dir
+// if the config uses it.
+func (a *AddonBase) expandRunnableConfig(addonCmd *AddonType, tags map[string]string) error {
+	used := make(map[string]bool)
+	conf, err := expandConfig(a.Config, tags, used)
+	if err != nil {
+		return err
+	}
+	a.Config = conf
+	if used["IGO_PROCESS_STATE_DIR"] {
+		uid, gid := 0, igoGrpId
+		if addonCmd.User != nil && !addonCmd.IsAddon {
+			uid, _ = strconv.Atoi(addonCmd.User.Uid)
+			gid, _ = strconv.Atoi(addonCmd.User.Gid)
+		}
+		if err := mkdirAllOwned(tags["IGO_PROCESS_STATE_DIR"], uid, gid); err != nil {
+			return fmt.Errorf("could not create state dir: %w", err)
+		}
+	}
+	return nil
+}
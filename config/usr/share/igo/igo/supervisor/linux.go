@@ -0,0 +1,442 @@
+//go:build !mac
+
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func zombieInit() {
+	go func() {
+		for {
+			// Wait for any child process (WNOHANG: don't block if none)
+			var ws syscall.WaitStatus
+			var ru syscall.Rusage
+			for {
+				pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, &ru)
+				if pid <= 0 || err != nil {
+					break
+				}
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}()
+}
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty returns the master and the slave side of a new pty.
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := int32(0)
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func setPtySize(pty *os.File, rows uint16, cols uint16) error {
+	ws := struct{ Row, Col, X, Y uint16 }{Row: rows, Col: cols}
+	return ioctl(pty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// getPeerUid returns the uid of the process on the other side of the control socket.
+func getPeerUid(conn net.Conn) (uint32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
+
+// sandboxCloneflags starts the sandbox helper in the namespaces of the sandbox.
+func sandboxCloneflags(attr *syscall.SysProcAttr, sandbox RunnableSandbox) {
+	attr.Cloneflags = syscall.CLONE_NEWNS
+	if sandbox.PrivateNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+}
+
+// oPath is O_PATH, syscall does not have it. The bind sources are only opened as a reference.
+const oPath = 0x200000
+
+// createBindDst creates the missing dst of a bind, a dir for a dir source, else an empty file.
+func createBindDst(source *os.File, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(dst, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func bindMount(src string, dst string, readOnly bool) error {
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s to %s: %w", src, dst, err)
+	}
+	if readOnly {
+		if err := syscall.Mount("", dst, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// asUnitUser runs f with the file system uid and gid of the unit, the paths f opens are
+// checked like the unit would open them. setfsuid only changes the current thread, runSandbox
+// locked it.
+func asUnitUser(spec sandboxSpec, f func() error) error {
+	if !spec.SetCredential || spec.Uid == 0 {
+		return f()
+	}
+	syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(spec.Gid), 0, 0)
+	syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(spec.Uid), 0, 0)
+	defer func() {
+		syscall.RawSyscall(syscall.SYS_SETFSUID, 0, 0, 0)
+		syscall.RawSyscall(syscall.SYS_SETFSGID, 0, 0, 0)
+	}()
+	// an invalid id returns the current one
+	if fsuid, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(^uint32(0)), 0, 0); int(fsuid) != spec.Uid {
+		return errors.New("can not switch to the file system uid of the unit")
+	}
+	return f()
+}
+
+// asUser runs f on a thread with the file system ids and the groups of the user, for the checks
+// root makes on behalf of a unit. The thread stays locked, it exits with the goroutine and the
+// changed credentials of it are never used by another goroutine.
+func asUser(u *user.User, f func()) error {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	groups := []uint32{}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+	if len(groups) == 0 {
+		groups = append(groups, uint32(gid))
+	}
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		// the raw syscalls change only this thread, syscall.Setgroups would change all of them
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(groups)), uintptr(unsafe.Pointer(&groups[0])), 0); errno != 0 {
+			done <- fmt.Errorf("setgroups: %w", errno)
+			return
+		}
+		syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+		syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+		if fsuid, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(^uint32(0)), 0, 0); uint64(fsuid) != uid {
+			done <- errors.New("can not switch to the file system uid of " + u.Username)
+			return
+		}
+		f()
+		done <- nil
+	}()
+	return <-done
+}
+
+// readableBy returns true if the mode of the file lets the uid and gid read it, the unit has
+// no supplementary groups.
+func readableBy(stat *syscall.Stat_t, uid int, gid int) bool {
+	switch {
+	case int(stat.Uid) == uid:
+		return stat.Mode&0400 != 0
+	case int(stat.Gid) == gid:
+		return stat.Mode&0040 != 0
+	}
+	return stat.Mode&0004 != 0
+}
+
+// openBindSource opens the src of a bind with the credentials of the unit, it has to be
+// readable by the unit.
+func openBindSource(spec sandboxSpec, b bindPath) (*os.File, error) {
+	var source *os.File
+	err := asUnitUser(spec, func() (err error) {
+		source, err = os.OpenFile(b.src, oPath|syscall.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil || !spec.SetCredential || spec.Uid == 0 {
+		return source, err
+	}
+	var stat syscall.Stat_t
+	if err = syscall.Fstat(int(source.Fd()), &stat); err == nil && !readableBy(&stat, spec.Uid, spec.Gid) {
+		err = fmt.Errorf("%s is not readable by the unit", b.src)
+	}
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// openBindTarget opens the dst of a bind with the credentials of the unit, it has to be owned
+// by the unit: a bind can not put a file of the user over a file of root, like /etc/sudoers.
+// The mount uses the opened file, a symlink swapped in meanwhile does not redirect it.
+func openBindTarget(spec sandboxSpec, b bindPath, source *os.File) (*os.File, error) {
+	var target *os.File
+	err := asUnitUser(spec, func() (err error) {
+		// the dst in the empty private tmp is created like the source
+		if spec.PrivateTmp && underPrivateTmp(b.dst) {
+			if err := createBindDst(source, b.dst); err != nil {
+				return err
+			}
+		}
+		target, err = os.OpenFile(b.dst, oPath|syscall.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil || !spec.SetCredential || spec.Uid == 0 {
+		return target, err
+	}
+	var stat syscall.Stat_t
+	if err = syscall.Fstat(int(target.Fd()), &stat); err == nil && int(stat.Uid) != spec.Uid {
+		err = fmt.Errorf("%s is not owned by the unit", b.dst)
+	}
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// applySandbox runs in the new mount namespace of the sandbox helper. The private tmp is
+// mounted before the binds, so they can add paths to it. The bind sources are opened before
+// it, a source under /tmp is not hidden by it.
+func applySandbox(spec sandboxSpec) error {
+	// the mounts must not leak to the container
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	var binds []bindPath
+	var sources []*os.File
+	defer func() { closeFiles(sources...) }()
+	for _, bind := range spec.BindPaths {
+		b, err := parseBindPath(bind)
+		if err != nil {
+			return err
+		}
+		source, err := openBindSource(spec, b)
+		if err != nil {
+			if b.optional && os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("bind %s: %w", b.src, err)
+		}
+		binds, sources = append(binds, b), append(sources, source)
+	}
+	if spec.PrivateTmp {
+		for _, tmp := range privateTmpPaths {
+			if _, err := os.Stat(tmp); err != nil {
+				continue
+			}
+			if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+				return fmt.Errorf("private %s: %w", tmp, err)
+			}
+		}
+	}
+	for i, b := range binds {
+		target, err := openBindTarget(spec, b, sources[i])
+		if err != nil {
+			return fmt.Errorf("bind %s to %s: %w", b.src, b.dst, err)
+		}
+		err = syscall.Mount(fdPath(sources[i]), fdPath(target), "", syscall.MS_BIND|syscall.MS_REC, "")
+		target.Close()
+		if err != nil {
+			return fmt.Errorf("bind %s to %s: %w", b.src, b.dst, err)
+		}
+		// the opened dst is the dir under the new mount, the remount needs the path
+		if b.readOnly {
+			if err := syscall.Mount("", b.dst, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("remount %s read-only: %w", b.dst, err)
+			}
+		}
+	}
+	for _, path := range spec.ReadOnlyPaths {
+		path, optional := strings.CutPrefix(path, "-")
+		if _, err := os.Stat(path); err != nil && optional {
+			continue
+		}
+		if err := bindMount(path, path, true); err != nil {
+			return err
+		}
+	}
+	for _, path := range spec.InaccessiblePaths {
+		path, optional := strings.CutPrefix(path, "-")
+		info, err := os.Stat(path)
+		if err != nil {
+			if optional {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=000")
+		} else {
+			err = bindMount(spec.InaccessibleFile, path, true)
+		}
+		if err != nil {
+			return fmt.Errorf("hide %s: %w", path, err)
+		}
+	}
+	if spec.PrivateNetwork {
+		return setLoopbackUp()
+	}
+	return nil
+}
+
+func fdPath(file *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+}
+
+// setNoNewPrivs keeps the setuid binaries like sudo from gaining privileges in the sandbox.
+// It is inherited by the exec of the current thread.
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS, syscall does not have it.
+const prSetNoNewPrivs = 38
+
+// setLoopbackUp brings up lo in the new network namespace, the other interfaces are missing there.
+func setLoopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	ifr := struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}{}
+	copy(ifr.Name[:], "lo")
+	if err := ioctl(uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		return fmt.Errorf("get flags of lo: %w", err)
+	}
+	ifr.Flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if err := ioctl(uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		return fmt.Errorf("set lo up: %w", err)
+	}
+	return nil
+}
+
+// mkdirAllOwned creates the missing dirs of the path with the owner. igo runs as root and the
+// path is under the home of the user, so it is walked from / with openat and O_NOFOLLOW: a
+// symlink of the user can not redirect the mkdir and the chown. Only the symlinks of root are
+// followed, like a /home linked to another disk.
+func mkdirAllOwned(path string, uid int, gid int) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not absolute", path)
+	}
+	dir, err := syscall.Open("/", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(filepath.Clean(path), "/") {
+		if name == "" {
+			continue
+		}
+		next, err := openDirAt(dir, name)
+		if err == syscall.ENOENT {
+			if err = syscall.Mkdirat(dir, name, 0700); err == nil || err == syscall.EEXIST {
+				next, err = openDirAt(dir, name)
+			}
+			// the chown runs on the opened dir, not on the name which can be replaced meanwhile
+			if err == nil && os.Geteuid() == 0 {
+				if err = syscall.Fchown(next, uid, gid); err != nil {
+					syscall.Close(next)
+				}
+			}
+		}
+		syscall.Close(dir)
+		if err != nil {
+			return fmt.Errorf("%s of %s: %w", name, path, err)
+		}
+		dir = next
+	}
+	syscall.Close(dir)
+	return nil
+}
+
+// openDirAt opens the dir name in the dir without following a symlink, except the symlinks
+// owned by root.
+func openDirAt(dir int, name string) (int, error) {
+	fd, err := syscall.Openat(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != syscall.ELOOP && err != syscall.ENOTDIR {
+		return fd, err
+	}
+	// the lstat of the name in the opened dir, syscall has no fstatat
+	info, statErr := os.Lstat(fmt.Sprintf("/proc/self/fd/%d/%s", dir, name))
+	if statErr != nil || info.Mode()&os.ModeSymlink == 0 || info.Sys().(*syscall.Stat_t).Uid != 0 {
+		return -1, err
+	}
+	return syscall.Openat(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+}
@@ -0,0 +1,48 @@
+//go:build mac
+
+package supervisor
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"syscall"
+)
+
+func zombieInit() {
+}
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pty is not supported")
+}
+
+func setPtySize(pty *os.File, rows uint16, cols uint16) error {
+	return nil
+}
+
+func getPeerUid(conn net.Conn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported")
+}
+
+func sandboxCloneflags(attr *syscall.SysProcAttr, sandbox RunnableSandbox) {
+}
+
+// asUser runs f, igo runs as the user on mac.
+func asUser(u *user.User, f func()) error {
+	f()
+	return nil
+}
+
+func setNoNewPrivs() error {
+	return errors.New("no_new_privs is not supported")
+}
+
+func applySandbox(spec sandboxSpec) error {
+	return errors.New("the sandbox is not supported")
+}
+
+// mkdirAllOwned creates the missing dirs of the path, igo runs as the user on mac.
+func mkdirAllOwned(path string, uid int, gid int) error {
+	return os.MkdirAll(path, 0700)
+}
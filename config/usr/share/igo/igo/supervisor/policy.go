@@ -0,0 +1,114 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ui3o/codebox/igo/control"
+)
+
+var policyName = "policy.json"
+
+// Policy maps group names to the permissions their members get on the units of other users.
+// It is read from the config dir of igo on every control request, so a change needs no restart.
+type Policy struct {
+	Groups map[string][]string `json:"groups"`
+}
+
+func getPolicyPath() string {
+	return filepath.Join(igoConfigDir, policyName)
+}
+
+// readPolicy returns the policy, a policy writable by others than root is ignored because
+// it would let them grant themselves permissions.
+func readPolicy(path string) Policy {
+	policy := Policy{}
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[IGO] Could not read policy: ", path, " err:", err)
+		}
+		return policy
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 && (stat.Uid != 0 || info.Mode().Perm()&0022 != 0) {
+		fmt.Println("[IGO] ", ERR, " policy is ignored, it has to be owned by root and writable only by root: ", path)
+		return policy
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println("[IGO] Could not read policy: ", path, " err:", err)
+		return policy
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		fmt.Println("[IGO] Could not parse policy: ", path, " err:", err)
+	}
+	return policy
+}
+
+// validate returns an error for the unknown permissions of the policy.
+func (p Policy) validate() error {
+	for group, perms := range p.Groups {
+		for _, perm := range perms {
+			switch perm {
+			case control.PermListAll, control.PermStopOthers, control.PermManageAddons, control.PermReadLogs:
+			default:
+				return fmt.Errorf("unknown permission %q of group %s", perm, group)
+			}
+		}
+	}
+	return nil
+}
+
+// peerPermissions returns the permissions of the uid by its groups, root has every permission.
+func peerPermissions(uid uint32) map[string]bool {
+	perms := make(map[string]bool)
+	if uid == 0 {
+		for _, perm := range []string{control.PermListAll, control.PermStopOthers, control.PermManageAddons, control.PermReadLogs} {
+			perms[perm] = true
+		}
+		return perms
+	}
+	policy := readPolicy(getPolicyPath())
+	if len(policy.Groups) == 0 {
+		return perms
+	}
+	u, err := user.LookupId(fmt.Sprint(uid))
+	if err != nil {
+		return perms
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return perms
+	}
+	for _, gid := range gids {
+		group, err := user.LookupGroupId(gid)
+		if err != nil {
+			continue
+		}
+		for _, perm := range policy.Groups[group.Name] {
+			perms[perm] = true
+		}
+	}
+	return perms
+}
+
+// canReach returns true if the peer can use the permission on the addon, the users can do
+// everything with their own units, the addons need manage-addons, their logs read-logs too.
+func (addon *AddonType) canReach(uid uint32, perms map[string]bool, perm string) bool {
+	if uid == 0 {
+		return true
+	}
+	if addon.IsAddon {
+		return perms[control.PermManageAddons] || (perm == control.PermReadLogs && perms[perm])
+	}
+	return fmt.Sprint(uid) == addon.ownerUid() || perms[perm]
+}
+
+// isVisible returns true if the unit is in the list of the peer, with listAll every unit is.
+func (addon *AddonType) isVisible(uid uint32, listAll bool) bool {
+	return listAll || uid == 0 || fmt.Sprint(uid) == addon.ownerUid()
+}
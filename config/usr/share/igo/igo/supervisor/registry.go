@@ -0,0 +1,198 @@
+package supervisor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// igoConfigDir holds the persistent addon registry, it survives container restarts.
+	igoConfigDir string
+	registryName = "enabled.json"
+	// addonRegistry is the runtime registry, it is initialized from the persistent one at boot
+	// and changed by ictl enable/disable --now.
+	addonRegistry Registry
+)
+
+type RegistryEntry struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path,omitempty"`
+}
+
+// Registry maps addon or unit names to their enablement. Names missing from the registry
+// keep their default: addons are enabled by a <name>.start file, units by their symlink.
+type Registry map[string]RegistryEntry
+
+func readRegistry(path string) Registry {
+	registry := Registry{}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[IGO] Could not read registry: ", path, " err:", err)
+		}
+		return registry
+	}
+	if err := json.Unmarshal(raw, &registry); err != nil {
+		fmt.Println("[IGO] Could not parse registry: ", path, " err:", err)
+	}
+	return registry
+}
+
+func (r Registry) isEnabled(name string, def bool) bool {
+	if entry, ok := r[name]; ok {
+		return entry.Enabled
+	}
+	return def
+}
+
+func getPersistentRegistryPath() string {
+	return filepath.Join(igoConfigDir, registryName)
+}
+
+func getRuntimeRegistryPath() string {
+	return filepath.Join(runDir, registryName)
+}
+
+func getUserRegistryPath(u *user.User) string {
+	return filepath.Join(u.HomeDir, ".config/igo", registryName)
+}
+
+// initRuntimeRegistry copies the persistent addon registry to the run dir, which is the
+// one igo reads in every find cycle.
+func initRuntimeRegistry() {
+	raw, err := os.ReadFile(getPersistentRegistryPath())
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(runDir, 0775); err != nil {
+		fmt.Println("[IGO] Could not create rundir :", runDir, " err:", err)
+		return
+	}
+	if err := os.WriteFile(getRuntimeRegistryPath(), raw, 0664); err != nil {
+		fmt.Println("[IGO] Could not write runtime registry err:", err)
+	}
+}
+
+func reloadAddonRegistry() {
+	addonRegistry = readRegistry(getRuntimeRegistryPath())
+}
+
+// readPasswdUsers returns the users of /etc/passwd, the os/user package can not list them.
+func readPasswdUsers() []*user.User {
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		fmt.Println("[IGO] Could not read /etc/passwd err:", err)
+		return nil
+	}
+	defer file.Close()
+	var users []*user.User
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) < 7 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		users = append(users, &user.User{Username: parts[0], Uid: parts[2], Gid: parts[3], Name: parts[4], HomeDir: parts[5]})
+	}
+	return users
+}
+
+// unitNameRegexp matches the unit names of ictl, the names in the registry of a user are
+// checked with it before they are joined to the units dir.
+var unitNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._-]*$`)
+
+// userUnitSearchPaths returns the dirs ictl searches the units of the user in. The
+// IGO_UNIT_PATH of igo is used, a unit in a dir only the env of the user adds is not linked.
+func userUnitSearchPaths(u *user.User) []string {
+	paths := []string{filepath.Join(u.HomeDir, ".config/units"), filepath.Join(u.HomeDir, "units")}
+	for _, p := range strings.Split(os.Getenv("IGO_UNIT_PATH"), ":") {
+		if p == "" {
+			continue
+		}
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			p = filepath.Join(u.HomeDir, strings.TrimPrefix(p, "~"))
+		} else if !filepath.IsAbs(p) {
+			p = filepath.Join(u.HomeDir, p)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	return paths
+}
+
+// resolveUnitPath returns the path of the unit of an enabled entry with the symlinks resolved.
+// The registry is written by the user, so the unit has to be in the search paths of the user
+// and owned by it.
+func resolveUnitPath(u *user.User, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || strconv.FormatUint(uint64(stat.Uid), 10) != u.Uid {
+		return "", fmt.Errorf("%s is not owned by %s", resolved, u.Username)
+	}
+	for _, searchPath := range userUnitSearchPaths(u) {
+		if dir, err := filepath.EvalSymlinks(searchPath); err == nil && resolved != dir && isSubPath(dir, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the unit search paths of %s", resolved, u.Username)
+}
+
+// linkEnabledUnits applies the registries of the users at boot. Enabled units are symlinked
+// to the units dir like ictl start does, the symlink of disabled units is removed.
+func linkEnabledUnits() {
+	for _, u := range readPasswdUsers() {
+		linkUserUnits(u)
+	}
+}
+
+func linkUserUnits(u *user.User) {
+	registryPath := getUserRegistryPath(u)
+	if _, err := os.Stat(registryPath); err != nil {
+		return
+	}
+	for name, entry := range readRegistry(registryPath) {
+		if filepath.Base(name) != name || !unitNameRegexp.MatchString(name) {
+			fmt.Printf("[IGO] %s Unit name %q in the registry of %s is invalid, ignored\n", WARNING, name, u.Username)
+			continue
+		}
+		symlinkPath := filepath.Join(unitDir, u.Username, name)
+		_, err := os.Lstat(symlinkPath)
+		if !entry.Enabled {
+			if err == nil {
+				fmt.Printf("[IGO] %s Unit %s of %s is disabled, removing symlink\n", INFO, name, u.Username)
+				os.Remove(symlinkPath)
+			}
+			continue
+		}
+		if err == nil || entry.Path == "" {
+			continue
+		}
+		unitPath, err := resolveUnitPath(u, entry.Path)
+		if err != nil {
+			fmt.Printf("[IGO] %s Unit %s of %s is not linked: %v\n", WARNING, name, u.Username, err)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(symlinkPath), 0755); err != nil {
+			fmt.Println("[IGO] Could not create unit dir for user: ", u.Username, " err:", err)
+			continue
+		}
+		if err := os.Symlink(unitPath, symlinkPath); err != nil {
+			fmt.Printf("[IGO] Could not link enabled unit %s -> %s: %v\n", symlinkPath, unitPath, err)
+			continue
+		}
+		fmt.Printf("[IGO] %s Unit %s of %s is enabled, symlink created\n", INFO, name, u.Username)
+	}
+}
@@ -0,0 +1,100 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ui3o/codebox/igo/journal"
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+func (a *AddonBase) getDummyPath() string {
+	return getRunPath(a.StartPath) + ".origin.dummy"
+}
+
+// restart stops the process of the addon and starts it again without unregistering it. The
+// old process tree gets SIGKILL if it does not exit in time. A dummy or skip file is removed,
+// so a parked addon starts again. It returns the pid of the new process. It is called with
+// addonsMu held, it is released while it waits.
+func (addon *AddonType) restart(timeout time.Duration) (int, error) {
+	starts := addon.starts
+	addon.logEvent(NOTICE, journal.EventRestarting, "restart requested")
+	addon.Current.resetRestartCount()
+	if addon.Origin.StartPath != "" {
+		addon.Origin.resetRestartCount()
+	}
+	switch {
+	case addon.Pid != 0:
+		oldPid := addon.Pid
+		tree := proc.Tree(oldPid, proc.Children())
+		addon.IsRestarting = true
+		addon.terminate(false)
+		if !waitForExitUnlocked(tree, timeout) {
+			addon.logEvent(WARNING, journal.EventKilled, "the process tree of %d is still running after %s, sending SIGKILL", oldPid, timeout)
+			for _, pid := range tree {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			if !waitForExitUnlocked(tree, 5*time.Second) {
+				return 0, errors.New("the old process tree did not exit")
+			}
+		}
+	case addon.SkipReason != "":
+		os.Remove(addon.Current.getSkipFilePath(addon))
+	default:
+		if err := os.Remove(addon.Current.getDummyPath()); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	// a parked addon is started by the next find cycle
+	deadline := time.Now().Add(timeout + 2*pollTimeout + 10*time.Second)
+	for time.Now().Before(deadline) {
+		if addon.starts != starts {
+			return addon.lastPid, nil
+		}
+		if addon.SkipReason != "" && !addon.IsRunning {
+			return 0, fmt.Errorf("skipped, %s", addon.SkipReason)
+		}
+		unlocked(func() { time.Sleep(100 * time.Millisecond) })
+	}
+	return 0, errors.New("the unit did not start again")
+}
+
+// stop writes the kill file of the addon like ictl stop, so igo stops and unregisters it. The
+// process tree gets SIGKILL if it does not exit in time after igo found the kill file. It is
+// called with addonsMu held, it is released while it waits.
+func (addon *AddonType) stop(timeout time.Duration) error {
+	var tree []int
+	if addon.Pid != 0 {
+		tree = proc.Tree(addon.Pid, proc.Children())
+	}
+	owner := addon.User
+	if addon.IsAddon {
+		owner = nil
+	}
+	if err := touchFile(getKillFilePath(addon), owner); err != nil {
+		return err
+	}
+	if len(tree) == 0 || waitForExitUnlocked(tree, pollTimeout+timeout) {
+		return nil
+	}
+	addon.logEvent(WARNING, journal.EventKilled, "the process tree of %d is still running after %s, sending SIGKILL", tree[0], timeout)
+	for _, pid := range tree {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	if !waitForExitUnlocked(tree, 5*time.Second) {
+		return errors.New("the process tree did not exit")
+	}
+	return nil
+}
+
+// waitForExitUnlocked returns false if a process of the pids is still alive after the timeout,
+// addonsMu is released meanwhile.
+func waitForExitUnlocked(pids []int, timeout time.Duration) bool {
+	var alive []int
+	unlocked(func() { alive = proc.WaitForExit(pids, timeout) })
+	return len(alive) == 0
+}
@@ -0,0 +1,222 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SandboxCommand is the subcommand of igo which runs in the new namespaces of a sandboxed
+// runnable. It mounts the sandbox, drops the privileges and executes the runnable.
+const SandboxCommand = "sandbox"
+
+// RunnableSandbox restricts what a runnable sees from the container. The paths are absolute,
+// a "-" prefix ignores a path which does not exist.
+type RunnableSandbox struct {
+	// PrivateTmp mounts an empty tmpfs to /tmp and /var/tmp before the bind paths, the binds
+	// can add paths to it. The read-only and inaccessible paths under them are resolved in the
+	// private tmp.
+	PrivateTmp        bool     `json:"privateTmp"`
+	ReadOnlyPaths     []string `json:"readOnlyPaths"`
+	InaccessiblePaths []string `json:"inaccessiblePaths"`
+	// BindPaths are "src[:dst[:ro]]" mounts, the dst has to exist, except in the private tmp
+	// where it is created. The src has to be readable by the user of the unit and the dst
+	// owned by it.
+	BindPaths []string `json:"bindPaths"`
+	// PrivateNetwork gives the runnable its own network namespace, only loopback is reachable.
+	PrivateNetwork bool `json:"privateNetwork"`
+}
+
+func (s RunnableSandbox) enabled() bool {
+	return s.PrivateTmp || s.PrivateNetwork || len(s.ReadOnlyPaths) != 0 || len(s.InaccessiblePaths) != 0 || len(s.BindPaths) != 0
+}
+
+// privateTmpPaths are hidden by the tmpfs of PrivateTmp.
+var privateTmpPaths = []string{"/tmp", "/var/tmp"}
+
+// underPrivateTmp returns true for the paths PrivateTmp hides.
+func underPrivateTmp(path string) bool {
+	for _, tmp := range privateTmpPaths {
+		if isSubPath(tmp, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubPath returns true if path is dir or under it.
+func isSubPath(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// checkWd returns an error if the wd is hidden by the private tmp and no bind adds it back.
+// The wd is resolved before the mounts, a symlink to /tmp is found too.
+func (s RunnableSandbox) checkWd(wd string) error {
+	if !s.PrivateTmp {
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = resolved
+	}
+	if !underPrivateTmp(wd) {
+		return nil
+	}
+	for _, bind := range s.BindPaths {
+		if b, err := parseBindPath(bind); err == nil && isSubPath(b.dst, wd) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the wd %s is hidden by privateTmp, add it to the bindPaths", wd)
+}
+
+type sandboxSpec struct {
+	RunnableSandbox
+	SetCredential bool
+	Uid           int
+	Gid           int
+	// InaccessibleFile is mounted over the inaccessible files, dirs get an empty tmpfs.
+	InaccessibleFile string
+}
+
+type bindPath struct {
+	src      string
+	dst      string
+	readOnly bool
+	optional bool
+}
+
+// parseBindPath parses "src[:dst[:ro|rw]]", the "-" prefix makes the bind optional.
+func parseBindPath(bind string) (bindPath, error) {
+	b := bindPath{}
+	if strings.HasPrefix(bind, "-") {
+		b.optional = true
+		bind = bind[1:]
+	}
+	parts := strings.Split(bind, ":")
+	if len(parts) > 3 {
+		return b, fmt.Errorf("invalid bind path %q, use src[:dst[:ro]]", bind)
+	}
+	b.src = parts[0]
+	b.dst = parts[0]
+	if len(parts) > 1 {
+		b.dst = parts[1]
+	}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "ro":
+			b.readOnly = true
+		case "rw":
+		default:
+			return b, fmt.Errorf("invalid bind option %q of %q, use ro or rw", parts[2], bind)
+		}
+	}
+	if !filepath.IsAbs(b.src) || !filepath.IsAbs(b.dst) {
+		return b, fmt.Errorf("bind path %q is not absolute", bind)
+	}
+	return b, nil
+}
+
+// validate returns the problems of the sandbox settings, check reports them.
+func (s RunnableSandbox) validate() []error {
+	var errs []error
+	for _, paths := range [][]string{s.ReadOnlyPaths, s.InaccessiblePaths} {
+		for _, path := range paths {
+			if !filepath.IsAbs(strings.TrimPrefix(path, "-")) {
+				errs = append(errs, fmt.Errorf("sandbox path %q is not absolute", path))
+			}
+		}
+	}
+	for _, bind := range s.BindPaths {
+		if _, err := parseBindPath(bind); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// sandboxCmd returns the path and args which start the runnable through the sandbox helper.
+func (a *AddonType) sandboxCmd(sandbox RunnableSandbox, execPath string, params []string) (string, []string, error) {
+	if os.Geteuid() != 0 {
+		return "", nil, errors.New("the sandbox needs igo running as root")
+	}
+	if errs := sandbox.validate(); len(errs) != 0 {
+		return "", nil, errs[0]
+	}
+	spec := sandboxSpec{RunnableSandbox: sandbox, SetCredential: true, Gid: igoGrpId}
+	if a.User != nil {
+		spec.Uid, _ = strconv.Atoi(a.User.Uid)
+	}
+	spec.InaccessibleFile = filepath.Join(runDir, ".inaccessible")
+	if _, err := os.Stat(spec.InaccessibleFile); err != nil {
+		if err := os.WriteFile(spec.InaccessibleFile, nil, 0000); err != nil {
+			return "", nil, err
+		}
+	}
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	args := append([]string{"igo", SandboxCommand, string(raw), "--", execPath}, params...)
+	return "/proc/self/exe", args, nil
+}
+
+// RunSandbox is the sandbox helper, it only returns on error.
+func RunSandbox(args []string) {
+	if err := runSandbox(args); err != nil {
+		fmt.Fprintln(os.Stderr, "[IGO] ", ERR, " sandbox: ", err)
+		os.Exit(126)
+	}
+}
+
+func runSandbox(args []string) error {
+	if len(args) < 3 || args[1] != "--" {
+		return errors.New("usage: igo sandbox <spec> -- <path> [args...]")
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		return fmt.Errorf("invalid spec: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := spec.checkWd(wd); err != nil {
+		return err
+	}
+	// the binds are checked on this thread with the file system ids of the unit and without
+	// the groups of root, the exec inherits no_new_privs from it
+	runtime.LockOSThread()
+	if spec.SetCredential {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return err
+		}
+	}
+	if err := applySandbox(spec); err != nil {
+		return err
+	}
+	// the wd is entered again in the mounts, like a bind on it
+	if err := os.Chdir(wd); err != nil {
+		return fmt.Errorf("the wd %s is not in the sandbox: %w", wd, err)
+	}
+	if spec.SetCredential {
+		if err := syscall.Setgid(spec.Gid); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(spec.Uid); err != nil {
+			return err
+		}
+	}
+	if spec.SetCredential && spec.Uid != 0 {
+		if err := setNoNewPrivs(); err != nil {
+			return fmt.Errorf("no_new_privs: %w", err)
+		}
+	}
+	return syscall.Exec(args[2], args[2:], os.Environ())
+}
@@ -0,0 +1,78 @@
+package supervisor
+
+import (
+	"encoding/json"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+// defaultStatusLines and defaultStatusExits are the counts of a status request without them
+const (
+	defaultStatusLines = 10
+	defaultStatusExits = 5
+)
+
+// status returns the detail of the addon for ictl status. The config is only for the owner and
+// root like the env, the output, the exits, the reason and the command lines of the processes
+// need the read-logs permission. It is called with addonsMu held.
+func (addon *AddonType) status(uid uint32, perms map[string]bool, lines int, exits int) control.UnitStatus {
+	readLogs := addon.canReach(uid, perms, control.PermReadLogs)
+	s := control.UnitStatus{
+		UnitState:  addon.unitState(),
+		StartPath:  addon.Current.StartPath,
+		StopPath:   addon.Current.StopPath,
+		ConfigPath: addon.Current.ConfigPath,
+		OnOrigin:   addon.IsOrigin,
+		Counters:   make(map[string]int),
+	}
+	if s.Pid != 0 {
+		children := proc.Children()
+		s.CpuTicks, s.RssBytes = proc.TreeUsage(s.Pid, children)
+		s.Processes = processList(s.Pid, children, readLogs)
+	}
+	if addon.IsAddon {
+		s.OriginStartPath = addon.Origin.StartPath
+		s.OriginConfigPath = addon.Origin.ConfigPath
+	}
+	if s.State == control.StateDummy {
+		s.DummyPath = addon.Current.getDummyPath()
+	}
+	if addon.canReach(uid, nil, "") {
+		if raw, err := json.Marshal(addon.Config); err == nil {
+			s.Config = raw
+		}
+	}
+	for event, count := range addon.counters {
+		s.Counters[event] = count
+	}
+	if !readLogs {
+		s.Reason = ""
+	}
+	if readLogs {
+		if lines > 0 && addon.hub != nil {
+			s.Log = addon.hub.tail(lines)
+		}
+		if exits > 0 {
+			s.Exits = append(s.Exits, addon.exits[max(0, len(addon.exits)-exits):]...)
+		}
+	}
+	return s
+}
+
+// processList returns the process tree of the pid, parents first. The command lines are only
+// read with commands, they have the arguments of the processes.
+func processList(pid int, children map[int][]int, commands bool) []control.Process {
+	list := []control.Process{{Pid: pid}}
+	for i := 0; i < len(list); i++ {
+		for _, child := range children[list[i].Pid] {
+			list = append(list, control.Process{Pid: child, Parent: list[i].Pid})
+		}
+	}
+	if commands {
+		for i := range list {
+			list[i].Command = proc.Cmdline(list[i].Pid)
+		}
+	}
+	return list
+}
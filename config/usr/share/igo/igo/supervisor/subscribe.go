@@ -0,0 +1,205 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+// eventBroadcast sends the events of logEvent to the watch connections.
+type eventBroadcast struct {
+	mu   sync.Mutex
+	subs map[chan journal.Event]struct{}
+}
+
+var eventHub = &eventBroadcast{subs: make(map[chan journal.Event]struct{})}
+
+func (b *eventBroadcast) subscribe() chan journal.Event {
+	ch := make(chan journal.Event, 64)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroadcast) unsubscribe(ch chan journal.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// publish never blocks the supervisor, a slow watcher misses the event but gets the states
+// with the next update.
+func (b *eventBroadcast) publish(e journal.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// ownerUid returns the uid of the user the addon runs for, addons and origins belong to root.
+func (addon *AddonType) ownerUid() string {
+	if addon.IsAddon || addon.User == nil {
+		return "0"
+	}
+	return addon.User.Uid
+}
+
+func (addon *AddonType) state() string {
+	switch {
+	case addon.IsStopping:
+		return control.StateStopping
+	case addon.IsRestarting:
+		return control.StateRestarting
+	case addon.SkipReason != "":
+		return control.StateSkipped
+	case addon.IsRunning && addon.Pid != 0:
+		return control.StateRunning
+	case addon.IsRunning:
+		if _, err := os.Stat(addon.Current.getDummyPath()); err == nil {
+			return control.StateDummy
+		}
+		return control.StateStarting
+	default:
+		return control.StateExited
+	}
+}
+
+// unitStates returns the units the uid can see, with listAll every unit. The reasons of the
+// units of others are only kept with readLogs. The states are taken under addonsMu, the usage
+// of their process trees is read after it.
+func unitStates(uid uint32, listAll bool, readLogs bool) []control.UnitState {
+	states := []control.UnitState{}
+	addonsMu.Lock()
+	for _, addon := range runningAddons {
+		if !addon.isVisible(uid, listAll) {
+			continue
+		}
+		state := addon.unitState()
+		if !addon.isVisible(uid, readLogs) {
+			state.Reason = ""
+		}
+		states = append(states, state)
+	}
+	addonsMu.Unlock()
+	children := proc.Children()
+	for i := range states {
+		if states[i].Pid != 0 {
+			states[i].CpuTicks, states[i].RssBytes = proc.TreeUsage(states[i].Pid, children)
+		}
+	}
+	return states
+}
+
+// unitState returns the state of the addon without the usage, it is called with addonsMu held.
+func (addon *AddonType) unitState() control.UnitState {
+	s := control.UnitState{
+		Name:     addon.Name,
+		User:     addon.userName(),
+		Type:     addon.processType(),
+		State:    addon.state(),
+		Pid:      addon.Pid,
+		Restarts: control.RestartCount(filepath.Dir(getRunPath(addon.Current.StartPath))),
+		ExitCode: addon.ExitCode,
+		Reason:   addon.SkipReason,
+	}
+	s.Health = health(s)
+	return s
+}
+
+// health is failed for a unit parked on the dummy or exited with an error, degraded for a
+// unit running after restarts.
+func health(s control.UnitState) string {
+	switch {
+	case s.State == control.StateDummy || (s.State == control.StateExited && s.ExitCode != 0):
+		return "failed"
+	case s.State == control.StateRunning && s.Restarts > 0:
+		return "degraded"
+	case s.State == control.StateRunning:
+		return "ok"
+	default:
+		return "-"
+	}
+}
+
+// peerUserName returns the name of the user of the peer.
+func peerUserName(uid uint32) (string, error) {
+	if uid == 0 {
+		return "root", nil
+	}
+	u, err := user.LookupId(fmt.Sprint(uid))
+	if err != nil {
+		return "", errors.New("unknown user")
+	}
+	return u.Username, nil
+}
+
+// watchUnits streams the states of the units to the peer after every event it can see and
+// every poll, until the peer closes the connection. With listAll it sees the units of everyone,
+// the reasons of their events, which have the commands run by exec, need readLogs too.
+func watchUnits(conn net.Conn, uid uint32, listAll bool, readLogs bool) {
+	userName, err := peerUserName(uid)
+	if err != nil {
+		control.WriteMessage(conn, control.Response{Error: err.Error()})
+		return
+	}
+	events := eventHub.subscribe()
+	defer eventHub.unsubscribe(events)
+	if err := control.WriteMessage(conn, control.Response{}); err != nil {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	send := func(e *journal.Event) error {
+		conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		return control.WriteMessage(conn, control.Update{Time: time.Now(), Event: e, Units: unitStates(uid, listAll, readLogs)})
+	}
+	if send(nil) != nil {
+		return
+	}
+	interval := pollTimeout
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case e := <-events:
+			if uid != 0 && e.User != userName {
+				if !listAll {
+					continue
+				}
+				if !readLogs {
+					e.Reason = ""
+				}
+			}
+			err = send(&e)
+		case <-ticker.C:
+			err = send(nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,1252 @@
+package supervisor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ui3o/codebox/igo/journal"
+	"github.com/ui3o/codebox/igo/proc"
+)
+
+var (
+	// Directories, they are set by Init from Config.RootPath
+	igoRootPath string
+	originDir   string
+	unitDir     string
+	runDir      string
+	addonDir    string
+	// Filenames
+	addonConfigName = getEnvString("IGO_UNIT_CONFIG", "config.py")
+	// Constant
+	pollTimeout   time.Duration
+	runningAddons = make(map[string]*AddonType)
+	igoGrpId      int
+	activeKillers sync.Map
+	Config        IgoConfig
+	// addonsMu guards runningAddons and the state of the addons in it. The find cycle, the
+	// workers and the control connections hold it, the workers release it while they wait for
+	// a process, python or a sleep. The name, the user and the paths of a registered addon
+	// never change, they are read without it.
+	addonsMu sync.Mutex
+	// shutdown is closed by Shutdown, workers are the goroutines it waits for
+	shutdown = make(chan struct{})
+	workers  sync.WaitGroup
+	findLoop sync.WaitGroup
+)
+
+type IgoConfig struct {
+	// LogLevel filters the output of igo, the journal gets every lifecycle event.
+	LogLevel LogLevel
+	// JournalPath is the json lines journal of the lifecycle events, it is exported as IGO_JOURNAL.
+	JournalPath string
+	// JournalMaxBytes is the size the journal is rotated at, 0 never rotates it.
+	JournalMaxBytes int64
+	// RootPath contains the addons and the .runtime dir, it is exported to the processes as IGO_ROOT_PATH.
+	RootPath string
+	// ConfigDir contains the persistent addon registry, it is exported as IGO_CONFIG_DIR.
+	ConfigDir string
+	// Group is set as the group of every started process, empty keeps the group of igo.
+	Group string
+	// Python is the interpreter that runs the config.py of the runnables.
+	Python      string
+	PollTimeout time.Duration
+	// ReapZombies waits for the orphaned processes, it is needed when igo runs as pid 1.
+	ReapZombies bool
+}
+
+type RunnableConfig struct {
+	Timer      int      `json:"timer"`
+	WatchPaths []string `json:"watchPaths"`
+	// Conditions skip the start when they fail, assertions also log it as an error.
+	Conditions []RunnableCondition `json:"conditions"`
+	Assertions []RunnableCondition `json:"assertions"`
+	// Pty runs the start script on a pty, ictl attach can write to it.
+	Pty bool `json:"pty"`
+	// the sandbox settings are on the top level of the config
+	RunnableSandbox
+	Start RunnableProps `json:"start"`
+	Stop  RunnableProps `json:"stop"`
+}
+
+type RunnableProps struct {
+	RestartCount int               `json:"restartCount"`
+	Envs         map[string]string `json:"envs"`
+	Params       []string          `json:"params"`
+	Wd           string            `json:"wd"`
+}
+
+type AddonBase struct {
+	Id         string
+	IsOrigin   bool
+	StartPath  string
+	StopPath   string
+	Timestamp  string
+	ConfigPath string
+	Config     RunnableConfig
+}
+
+type AddonType struct {
+	IsOrigin     bool
+	IsAddon      bool
+	IsRunning    bool
+	IsStopping   bool
+	IsRestarting bool
+	ExitCode     int
+	Pid          int
+	Current      AddonBase
+	Origin       AddonBase
+	User         *user.User
+	Name         string
+	WatchPaths   []string
+	SkipReason   string
+	Config       RunnableConfig // config read at the last start
+	hub          *attachHub     // output of the running start script for ictl attach
+	starts       int            // count of the starts, ictl restart waits for the next one
+	lastPid      int            // pid of the last start, it is kept after the exit
+	counters     map[string]int // lifecycle events by event for ictl status
+	exits        []journal.Event
+}
+
+func DebugPrintln(a ...any) {
+	if Config.LogLevel >= DEBUG {
+		fmt.Println(a...)
+	}
+}
+
+type Addons map[string]*AddonType
+
+// runConfigPy runs the config.py of configPath with python and writes its conf dict as json to configOut.
+func runConfigPy(configPath string, configOut string, restartType RestartType) error {
+	// (done) todo add env to python why to read
+	// Identation is necessary to keep because of python !!!
+	pythonConfigTemplate := fmt.Sprintf(`import sys;
+from pathlib import Path;
+sys.path.insert(0, "%s");
+import config;
+p=Path("%s");
+p.parent.mkdir(parents=True, exist_ok=True);
+import json;
+p.write_text(json.dumps(config.conf))`, configPath, configOut)
+	cmd := exec.Command(Config.Python, "-c", pythonConfigTemplate)
+	// Set IGO_STATE_START env variable based on restartType
+	stateStart := "false"
+	if restartType == Start {
+		stateStart = "true"
+	}
+	cmd.Env = append(os.Environ(), "IGO_STATE_START="+stateStart, "PYTHONDONTWRITEBYTECODE=1")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			lines := strings.Split(msg, "\n")
+			return fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return err
+	}
+	return nil
+}
+
+// readRunnableConfig replaces the config with the output of the config.py, the old config is
+// kept if it can not be read. It is called with addonsMu held, python runs without it.
+func (a *AddonBase) readRunnableConfig(path string, restartType RestartType) {
+	currentConfigPath := filepath.Dir(path)
+	currentConfigOut := filepath.Join(getRunPath(currentConfigPath), "config.json")
+	var err error
+	unlocked(func() { err = runConfigPy(currentConfigPath, currentConfigOut, restartType) })
+	if err != nil {
+		fmt.Println("[IGO] err Could not run config for: ", currentConfigPath, err)
+		return
+	}
+
+	// Read output from .runtime/config
+	rawConfig, err := os.ReadFile(currentConfigOut)
+	if err != nil {
+		fmt.Println("[IGO] err Could not read config output for: ", currentConfigOut, err)
+		return
+	}
+
+	// a fresh config, the maps of the previous one are shared with the running addon
+	var config RunnableConfig
+	if err := json.Unmarshal([]byte(rawConfig), &config); err != nil {
+		fmt.Println("[IGO] err Could not parse config for: ", currentConfigOut, " err:", err)
+		return
+	}
+	a.Config = config
+}
+
+func findRunnables() Addons {
+	var addons Addons = make(map[string]*AddonType)
+	// addons can also be shipped as <name>.disabled, the registry decides whether they run
+	cmd := exec.Command("find", unitDir, "-follow", "-type", "f", "-executable", "(", "-name", "*.start", "-o", "-path", "*/addons/*.disabled", ")")
+	output, err := cmd.Output()
+	DebugPrintln("find output > ", string(output))
+	if err != nil {
+		fmt.Println("[IGO] ERROR findRunnables() could not give find command err:", err)
+		return Addons{}
+	}
+
+	executables := strings.Split(strings.TrimSpace(string(output)), "\n")
+	DebugPrintln("executables > ", executables)
+
+	if len(executables) == 0 {
+		fmt.Println("[IGO] findRunnables() no addon or unit found! unitDir: ", unitDir)
+	}
+
+	for _, execPath := range executables {
+		dirName := filepath.Base(filepath.Dir(execPath))
+		execName := filepath.Base(execPath)
+
+		execExt := filepath.Ext(execName)
+		DebugPrintln("detect execName > ", execName)
+		DebugPrintln("dirName > ", dirName)
+		if dirName+execExt != execName {
+			continue
+		}
+		DebugPrintln("detect execName matched!")
+		if isAddonPath(execPath) {
+			if execExt == ".disabled" {
+				if _, err := os.Stat(strings.TrimSuffix(execPath, execExt) + ".start"); err == nil {
+					continue // the .start file of the addon wins
+				}
+			}
+			if !addonRegistry.isEnabled(dirName, execExt == ".start") {
+				DebugPrintln("addon is disabled > ", dirName)
+				continue
+			}
+		}
+		addon := AddonType{}
+		addon.Name = dirName
+		addonTimestampInfo, err := os.Stat(execPath)
+		if err != nil {
+			continue // removed since find listed it
+		}
+		addonStopPath := strings.TrimSuffix(execPath, execExt) + ".stop"
+		confPath := filepath.Join(filepath.Dir(execPath), addonConfigName)
+		addon.Current.Id = execPath
+		addon.Current.IsOrigin = false
+		addon.Current.StartPath = execPath
+		addon.Current.Timestamp = addonTimestampInfo.ModTime().String()
+
+		if _, err := os.Stat(confPath); err == nil {
+			addon.Current.ConfigPath = confPath
+		}
+		if _, err := os.Stat(addonStopPath); err == nil {
+			addon.Current.StopPath = addonStopPath
+		}
+		addon.IsAddon = isAddonPath(execPath)
+		if addon.IsAddon {
+			DebugPrintln("exec type is addon")
+			originExecPath := getOriginPathOfAddon(execPath)
+			if _, err := os.Stat(originExecPath); err == nil {
+				addonTimestampInfo, _ := os.Stat(originExecPath)
+				addonStopPath := strings.TrimSuffix(originExecPath, execExt) + ".stop"
+				confPath = filepath.Join(filepath.Dir(originExecPath), addonConfigName)
+				addon.Origin.Id = execPath // the id is the same as the Current for a reason, it is used as a lookup in the runningAddons.
+				addon.Origin.IsOrigin = true
+				addon.Origin.StartPath = originExecPath
+				addon.Origin.Timestamp = addonTimestampInfo.ModTime().String()
+				if _, err := os.Stat(confPath); err == nil {
+					addon.Origin.ConfigPath = confPath
+				}
+				if _, err := os.Stat(addonStopPath); err == nil {
+					addon.Origin.StopPath = addonStopPath
+				}
+			}
+		} else {
+			DebugPrintln("exec type is unit")
+			linuxUser, err := getUnitUser(addon.Current.StartPath)
+			if err == nil {
+				// Check file owner matches user
+				if err := checkOwner(addon.Current.StartPath, linuxUser); err != nil {
+					fmt.Printf("[IGO] Security check failed: %v, NOT starting unit. If this is a symlink from /etc, ensure the .start file is owned by root.\n", err)
+					continue
+				}
+				addon.User = linuxUser
+			} else {
+				fmt.Println("[IGO] Could not get user from path: ", addon.Current.StartPath)
+			}
+		}
+		addons[execPath] = &addon
+	}
+	return addons
+}
+
+// getUnitUser returns the user of the unit by the user dir in the units dir, system units belong to root.
+func getUnitUser(startPath string) (*user.User, error) {
+	username := extractUserFromStartPath(startPath)
+	if username == "system" {
+		username = "root"
+	}
+	return user.Lookup(username)
+}
+
+// checkOwner returns an error if the start file of the unit is not owned by the user of the unit.
+func checkOwner(startPath string, linuxUser *user.User) error {
+	fileInfo, err := os.Lstat(startPath)
+	if err != nil {
+		return nil
+	}
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		uid, _ := strconv.Atoi(linuxUser.Uid)
+		if int(stat.Uid) != uid {
+			return fmt.Errorf("owner of %s does not match user %s (uid %d)", startPath, linuxUser.Username, uid)
+		}
+	}
+	return nil
+}
+
+func extractUserFromStartPath(path string) string {
+	const prefix = ".runtime/units/"
+	idx := strings.Index(path, prefix)
+	if idx == -1 {
+		return ""
+	}
+	rest := path[idx+len(prefix):]
+	slashIdx := strings.Index(rest, "/")
+	if slashIdx == -1 {
+		return rest
+	}
+	return rest[:slashIdx]
+}
+
+type RestartType int
+
+const (
+	Start RestartType = iota
+	Stop
+)
+
+func (a AddonBase) getCurrentRestartCount(restartType RestartType) int {
+	var unitPath string
+	var filePostfix string
+	switch restartType {
+	case Start:
+		unitPath = a.StartPath
+		filePostfix = ".start"
+	case Stop:
+		unitPath = a.StopPath
+		filePostfix = ".stop"
+	}
+
+	runPath := filepath.Dir(getRunPath(unitPath))
+
+	cmd := exec.Command("find", runPath, "-type", "f", "-name", "*"+filePostfix+".*")
+	output, err := cmd.Output()
+	if err != nil {
+		fmt.Println("[IGO] ", NOTICE, " did not find status file at: ", runPath, " ", err)
+		return 0
+	}
+
+	lines := strings.Split(string(output), "\n")
+	regexString := fmt.Sprintf("%s%s", filePostfix, `\.(\d+)$`)
+	re := regexp.MustCompile(regexString)
+	var numbers []int
+	for _, line := range lines {
+		matches := re.FindStringSubmatch(line)
+		if len(matches) == 2 {
+			num, err := strconv.Atoi(matches[1])
+			if err == nil {
+				numbers = append(numbers, num)
+			}
+		}
+	}
+
+	if len(numbers) == 0 {
+		return 0
+	}
+
+	sort.Ints(numbers)
+	return numbers[len(numbers)-1]
+}
+
+func (a AddonBase) incrementRestartCount(addon *AddonType, restartType RestartType) {
+	var unitPath string
+	var filePostfix string
+	switch restartType {
+	case Start:
+		unitPath = a.StartPath
+		filePostfix = ".start."
+	case Stop:
+		unitPath = a.StopPath
+		filePostfix = ".stop."
+	}
+
+	if unitPath == "" {
+		return
+	}
+	addonName := filepath.Base(filepath.Dir(unitPath))
+	currentCount := a.getCurrentRestartCount(restartType)
+	newCount := currentCount + 1
+
+	runPath := filepath.Dir(getRunPath(unitPath))
+
+	newFileName := fmt.Sprintf("%s%s%d", addonName, filePostfix, newCount)
+	newFilePath := filepath.Join(runPath, newFileName)
+
+	err := touchFile(newFilePath, addon.User)
+	if err != nil {
+		fmt.Println("[IGO] ", ERR, "Failed to create new restart file:", err)
+	}
+}
+
+func (a AddonBase) resetRestartCount() {
+	var unitPath string
+	if a.StartPath != "" {
+		unitPath = a.StartPath
+	} else if a.StopPath != "" {
+		unitPath = a.StopPath
+	} else {
+		fmt.Println("[IGO] ", ERR, " The unit has no start or stop path, could not resetRestartCount()")
+		return
+	}
+
+	runPath := filepath.Dir(getRunPath(unitPath))
+
+	files, err := os.ReadDir(runPath)
+	if err != nil {
+		return
+	}
+	addonName := filepath.Base(filepath.Dir(unitPath))
+	startPrefix := fmt.Sprintf("%s.start.", addonName)
+	stopPrefix := fmt.Sprintf("%s.stop.", addonName)
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, startPrefix) || strings.HasPrefix(name, stopPrefix) {
+			os.Remove(filepath.Join(runPath, name))
+		}
+	}
+}
+
+// startAndRetry is the worker of a started addon, a is the runnable it starts, the current
+// one or the origin.
+func (a *AddonBase) startAndRetry(addonCmd *AddonType) {
+	for {
+		a.startAddon(addonCmd)
+		// igo is shutting down, the addon is not started again
+		if isShutdown() {
+			break
+		}
+
+		// restarted because watched files changed -> start again without counting a retry
+		if addonCmd.IsRestarting {
+			addonCmd.IsRestarting = false
+			a.resetRestartCount()
+			continue
+		}
+
+		// conditions failed -> the addon is parked by watchSkipped, retry makes no sense
+		if addonCmd.SkipReason != "" {
+			break
+		}
+
+		// no retry then return
+		if a.Config.Start.RestartCount == 0 {
+			break
+		}
+
+		// executed successfully no need to retry
+		if addonCmd.ExitCode == 0 {
+			break
+		}
+
+		// stopping status -> no need to retry
+		if addonCmd.IsStopping {
+			break
+		}
+
+		maxRetry := a.Config.Start.RestartCount
+		currentRetry := a.getCurrentRestartCount(Start)
+		if currentRetry > maxRetry {
+			addonCmd.logEvent(WARNING, journal.EventRetry, "max retry count (%d) exceeded", maxRetry)
+			break
+		}
+		addonCmd.logEvent(NOTICE, journal.EventRetry, "retry %d of %d", currentRetry, maxRetry)
+
+		unlocked(func() { time.Sleep(1 * time.Second) })
+	}
+	if addonCmd.IsStopping && runningAddons[a.Id] == addonCmd {
+		delete(runningAddons, a.Id)
+	}
+	addonCmd.IsRunning = false
+}
+
+func touchFile(path string, user *user.User) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// If its a unit we have to set the owner
+	if user != nil {
+		uid, _ := strconv.Atoi(user.Uid)
+		gid, _ := strconv.Atoi(user.Gid)
+		runUserUnitDir := filepath.Dir(path)       // runUserUnitDir is like .runtime/run/user/unitname
+		runUserDir := filepath.Dir(runUserUnitDir) // runUserDir is like 	 .runtime/run/user
+		//                                            path is like			 .runtime/run/user/unitname/unitname.start.1
+		os.Chown(runUserDir, uid, gid)
+		os.Chown(runUserUnitDir, uid, gid)
+		os.Chown(path, uid, gid)
+	}
+	return file.Close()
+}
+
+// TODO: create an enum for "origin", "addon" and "unit"
+func (a *AddonBase) getEnvTagForProcess(addonCmd *AddonType) map[string]string {
+	envTags := make(map[string]string)
+	if addonCmd.IsAddon {
+		if addonCmd.IsOrigin {
+			envTags["IGO_PROCESS_TYPE"] = "origin"
+		} else {
+			envTags["IGO_PROCESS_TYPE"] = "addon"
+		}
+		envTags["IGO_PROCESS_USER"] = "root"
+	} else {
+		if addonCmd.User == nil {
+			fmt.Println("[IGO] Unit user not found, path:", a.StartPath)
+			return nil
+		}
+		envTags["IGO_PROCESS_USER"] = addonCmd.User.Username
+		envTags["IGO_PROCESS_TYPE"] = "unit"
+	}
+	envTags["IGO_PROCESS_NAME"] = addonCmd.Name
+	return envTags
+}
+
+// runnableEnviron returns the env of a runnable, the env of igo with the tags and the envs of
+// the config, the tags win over the envs.
+func runnableEnviron(envTags map[string]string, envs map[string]string) []string {
+	if envTags == nil {
+		envTags = make(map[string]string)
+	}
+	if len(envs) != 0 {
+		//if we have envs from config we add it to envTags
+		mergeMaps(envs, envTags)
+	}
+	osEnv := os.Environ()
+	for name, value := range envTags {
+		osEnv = append(osEnv, fmt.Sprintf("%s=%s", name, value))
+	}
+	return osEnv
+}
+
+// runnableCredential returns the credential of the runnables of the addon, igo is set as the group.
+func (addonCmd *AddonType) runnableCredential() *syscall.Credential {
+	if addonCmd.User != nil {
+		uid, _ := strconv.Atoi(addonCmd.User.Uid)
+		return &syscall.Credential{Uid: uint32(uid), Gid: uint32(igoGrpId)}
+	}
+	return &syscall.Credential{Gid: uint32(igoGrpId)}
+}
+
+func mergeMaps(src map[string]string, dst map[string]string) map[string]string {
+	result := dst
+	for k, v := range src {
+		//if the key does not already exist in dst add it.
+		if _, ok := result[k]; !ok {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (a *AddonBase) startAddon(addonCmd *AddonType) {
+	DebugPrintln("[IGO] Starting addon: ", a.StartPath, ", ID ", a.Id)
+	addonCmd.IsStopping = false
+	addonCmd.IsRestarting = false
+	addonCmd.SkipReason = ""
+	addonCmd.IsOrigin = a.IsOrigin
+	addonCmd.ExitCode = -1
+	runCmd := func(restartType RestartType) *exec.Cmd {
+		var execPath string
+		var execConf *RunnableProps
+		switch restartType {
+		case Start:
+			execPath = a.StartPath
+			execConf = &a.Config.Start
+		case Stop:
+			execPath = a.StopPath
+			execConf = &a.Config.Stop
+		}
+
+		if len(execPath) == 0 {
+			return nil
+		}
+		cmd := exec.Command(execPath)
+
+		envTags := a.getEnvTagForProcess(addonCmd)
+
+		// read start config
+		a.readRunnableConfig(execPath, restartType)
+		if envTags != nil {
+			for name, value := range a.getSpecifiers(addonCmd) {
+				envTags[name] = value
+			}
+		}
+		if err := a.expandRunnableConfig(addonCmd, envTags); err != nil {
+			addonCmd.logEvent(ERR, journal.EventFailed, "can not expand the config of %s, %v", execPath, err)
+			return nil
+		}
+		if restartType == Start {
+			addonCmd.Config = a.Config
+			addonCmd.WatchPaths = a.resolveWatchPaths()
+			if reason := a.Config.checkConditions(addonCmd); reason != "" {
+				level := NOTICE
+				if strings.HasPrefix(reason, "assertion") {
+					level = ERR
+				}
+				addonCmd.logEvent(level, journal.EventSkipped, "%s", reason)
+				addonCmd.SkipReason = reason
+				return nil
+			}
+		}
+		cmd.Env = runnableEnviron(envTags, execConf.Envs)
+		if len(execConf.Params) != 0 {
+			cmd.Args = append(cmd.Args, execConf.Params...)
+		}
+
+		if len(execConf.Wd) != 0 {
+			cmd.Dir = execConf.Wd
+		}
+
+		// the start script of a pty unit gets the slave as its controlling terminal,
+		// the others get pipes. The output of the start script is kept for ictl attach.
+		var hub *attachHub
+		var stdout, stderr, master, slave *os.File
+		var err error
+		attr := &syscall.SysProcAttr{}
+		if restartType == Start && a.Config.Pty {
+			if master, slave, err = openPty(); err != nil {
+				addonCmd.logEvent(ERR, journal.EventFailed, "can not open pty for %s, %v", execPath, err)
+				return nil
+			}
+			if _, ok := envTags["TERM"]; !ok {
+				cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+			}
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+			attr.Setsid = true
+			attr.Setctty = true
+			stdout = master
+		} else {
+			// Capture standard output and standard error
+			var stdoutWriter, stderrWriter *os.File
+			if stdout, stdoutWriter, err = os.Pipe(); err != nil {
+				fmt.Println("[IGO] ", ERR, "[STDERR] Can not use stdout:", execPath, err)
+				return nil
+			}
+			if stderr, stderrWriter, err = os.Pipe(); err != nil {
+				stdout.Close()
+				stdoutWriter.Close()
+				fmt.Println("[IGO] ", ERR, "[STDERR] Can not use stderr:", execPath, err)
+				return nil
+			}
+			cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
+			defer stdoutWriter.Close()
+			defer stderrWriter.Close()
+		}
+		if restartType == Start {
+			hub = newAttachHub(master)
+		}
+
+		// igo is set as the group of all processes started by igo, only root can change the credentials
+		if os.Geteuid() != 0 {
+			DebugPrintln("igo is not running as root, credentials are not changed for: ", execPath)
+		} else {
+			attr.Credential = addonCmd.runnableCredential()
+		}
+		if a.Config.RunnableSandbox.enabled() {
+			path, args, err := addonCmd.sandboxCmd(a.Config.RunnableSandbox, execPath, cmd.Args[1:])
+			if err != nil {
+				addonCmd.logEvent(ERR, journal.EventFailed, "can not sandbox %s, %v", execPath, err)
+				closeFiles(stdout, stderr, master, slave)
+				return nil
+			}
+			// the sandbox helper drops the privileges after it mounted the sandbox
+			cmd.Path, cmd.Args = path, args
+			attr.Credential = nil
+			sandboxCloneflags(attr, a.Config.RunnableSandbox)
+		}
+		cmd.SysProcAttr = attr
+
+		err = cmd.Start()
+		if slave != nil {
+			slave.Close()
+		}
+		if err != nil {
+			addonCmd.logEvent(ERR, journal.EventFailed, "can not start %s, %v", execPath, err)
+			closeFiles(stdout, stderr, master)
+			return nil
+		}
+
+		pid := cmd.Process.Pid
+		addonCmd.Pid = pid
+		if restartType == Start {
+			addonCmd.starts++
+			addonCmd.lastPid = pid
+			addonCmd.logEvent(NOTICE, journal.EventStarted, "%s", execPath)
+		}
+		if hub != nil {
+			addonCmd.hub = hub
+		}
+
+		// capture and print the output of the executable in separate goroutines, the hub is
+		// closed when the output ended
+		var readers sync.WaitGroup
+		printOutput := func(output *os.File, stream string) {
+			defer readers.Done()
+			defer output.Close()
+			var reader io.Reader = output
+			if hub != nil {
+				reader = io.TeeReader(output, hub)
+			}
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				fmt.Printf("%d [%s] %s\n", pid, stream, strings.TrimRight(scanner.Text(), "\r"))
+			}
+			// the pty returns EIO at the end, keep draining the pipe if a line was too long
+			io.Copy(io.Discard, reader)
+		}
+		if master != nil {
+			readers.Add(1)
+			go printOutput(master, "PTY")
+		} else {
+			readers.Add(2)
+			go printOutput(stdout, "STDOUT")
+			go printOutput(stderr, "STDERR")
+		}
+		if hub != nil {
+			go func() {
+				readers.Wait()
+				hub.close()
+			}()
+		}
+		return cmd
+	}
+	cmd := runCmd(Start)
+	if cmd != nil {
+		addonCmd.IsRunning = true
+		a.incrementRestartCount(addonCmd, Start)
+		watchDone := make(chan struct{})
+		go watchFiles(addonCmd.Name, addonCmd.WatchPaths, watchDone, addonCmd.gracefulRestart)
+		var err error
+		unlocked(func() { err = cmd.Wait() })
+		close(watchDone)
+		// is killfile is found IsStopping will be set. If a unit exited with 0 we have to remove the whole unit symlink, so its not started again.
+		// A restart because of changed watched files or the shutdown of igo keeps the unit.
+		if addonCmd.IsStopping || (!addonCmd.IsAddon && err == nil && !addonCmd.IsRestarting && !isShutdown()) {
+			defer a.removeAddon(addonCmd)
+		}
+		addonCmd.ExitCode = 0
+		a.incrementRestartCount(addonCmd, Stop)
+		cmd := runCmd(Stop)
+		if cmd != nil {
+			unlocked(func() { cmd.Wait() })
+		}
+		addonCmd.Pid = 0
+		if err != nil {
+			if exiterr, ok := err.(*exec.ExitError); ok {
+				addonCmd.ExitCode = exiterr.ExitCode()
+			} else {
+				addonCmd.ExitCode = -1
+			}
+		} else {
+			a.resetRestartCount()
+		}
+		level := NOTICE
+		if addonCmd.ExitCode != 0 && !addonCmd.IsStopping && !addonCmd.IsRestarting && !isShutdown() {
+			level = WARNING
+		}
+		addonCmd.logEvent(level, journal.EventExited, "%s exited with %d", a.StartPath, addonCmd.ExitCode)
+	}
+}
+
+// killFileSuffixes name the file in the run dir which stops the unit, <unit>_kill is written by
+// ictl and igo. Before they agreed igo looked only for <unit>.kill, it is still honored for the
+// scripts which write it.
+var killFileSuffixes = []string{"_kill", ".kill"}
+
+// getKillFilePath returns the path of the file ictl writes to stop the addon, when the addon
+// runs on its origin the file is in the run dir of the origin.
+func getKillFilePath(addon *AddonType) string {
+	return getKillFilePaths(addon)[0]
+}
+
+// getKillFilePaths returns the kill file of every suffix, the one ictl writes is the first.
+func getKillFilePaths(addon *AddonType) []string {
+	var runPath string
+	if addon.IsOrigin {
+		runPath = getRunPath(getOriginPathOfAddon(addon.Current.StartPath))
+	} else {
+		runPath = getRunPath(addon.Current.StartPath)
+	}
+	runPath = filepath.Dir(runPath)
+	unitname := filepath.Base(runPath)
+	var paths []string
+	for _, suffix := range killFileSuffixes {
+		paths = append(paths, filepath.Join(runPath, unitname+suffix))
+	}
+	return paths
+}
+
+// hasKillFile returns true if a kill file of any suffix exists.
+func hasKillFile(addon *AddonType) bool {
+	for _, killFilePath := range getKillFilePaths(addon) {
+		if _, err := os.Stat(killFilePath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func removeKillFile(addon *AddonType) {
+	for _, killFilePath := range getKillFilePaths(addon) {
+		if err := os.Remove(killFilePath); err != nil && !os.IsNotExist(err) {
+			fmt.Println("[IGO] Error could not remove the kill file for unit: ", addon.Name, " err: ", err)
+		}
+	}
+}
+
+func (a *AddonBase) removeAddon(addon *AddonType) {
+	var symlinkPath, userDir, userRunUnitDir, userRunDir string
+	defer removeKillFile(addon)
+
+	// we only want to unlink, and cleanup if its not an addon. If its an addon it should always run, and if it fails the addon's origin should start.
+	if addon.IsAddon {
+		return
+	}
+	if addon.User != nil {
+		// Unit: symlink is in .runtime/units/{username}/{name}
+		symlinkPath = filepath.Join(unitDir, addon.User.Username, addon.Name)
+		userDir = filepath.Join(unitDir, addon.User.Username)
+		userRunUnitDir = filepath.Join(runDir, addon.User.Username, addon.Name)
+		userRunDir = filepath.Join(runDir, addon.User.Username)
+	} else {
+		return
+	}
+
+	// Remove symlink
+	if err := os.Remove(symlinkPath); err == nil {
+		addon.logEvent(NOTICE, journal.EventRemoved, "symlink %s removed", symlinkPath)
+		// Remove user dir if empty
+		entries, err := os.ReadDir(userDir)
+		if err == nil && len(entries) == 0 {
+			os.Remove(userDir)
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("[IGO] Failed to remove symlink for unit %s: %v\n", addon.Name, err)
+	}
+
+	// Remove .runtime/run/username/unit directory
+	if err := os.RemoveAll(userRunUnitDir); err == nil {
+		fmt.Printf("[IGO] Removed run directory: %s\n", userRunUnitDir)
+	}
+
+	// Remove .runtime/run/username if empty
+	runEntries, err := os.ReadDir(userRunDir)
+	if err == nil && len(runEntries) == 0 {
+		os.Remove(userRunDir)
+	}
+}
+
+// sendSIGKILLAfterTimeout waits 30 seconds and sends SIGKILL if the process is still running
+func sendSIGKILLAfterTimeout(pid int) {
+	if _, exists := activeKillers.LoadOrStore(pid, true); exists {
+		return // Already scheduled
+	}
+
+	go func() {
+		defer activeKillers.Delete(pid)
+		time.Sleep(5 * time.Second)
+		_, err := os.FindProcess(pid)
+		if err != nil {
+			return
+		}
+		time.Sleep(10 * time.Second)
+		_, err = os.FindProcess(pid)
+		if err != nil {
+			return
+		}
+		time.Sleep(15 * time.Second)
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return
+		}
+
+		// Check if the process is still alive
+		if err := proc.Signal(syscall.Signal(0)); err == nil {
+			fmt.Println("[IGO] Process still alive after 30s, sending SIGKILL:", pid)
+			if err := proc.Signal(syscall.SIGKILL); err != nil {
+				fmt.Println("[IGO] Failed to send SIGKILL to process:", pid)
+			} else {
+				fmt.Println("[IGO] SIGKILL sent to process:", pid)
+			}
+		} else {
+			fmt.Println("[IGO] Process already exited before SIGKILL:", pid)
+		}
+	}()
+}
+
+// terminate sends SIGTERM to the addon's process and SIGKILL if it does not exit in time.
+// If stopping is set the addon is unregistered after the exit, otherwise it is started again.
+func (addon *AddonType) terminate(stopping bool) {
+	addon.IsStopping = stopping
+	if addon.Pid == 0 {
+		return // waiting on a dummy or skip file, there is no process
+	}
+	procToTerm, err := os.FindProcess(addon.Pid)
+	if err != nil {
+		fmt.Println("[IGO] Failed to find process: ", addon.Pid, " this can happen if the process was forcefully terminated (kill)")
+		return
+	}
+	err = procToTerm.Signal(syscall.SIGTERM)
+	if err != nil {
+		fmt.Println("[IGO] Failed to terminate process: ", addon.Pid, " this can happen if the process was forcefully terminated (kill)")
+	}
+	sendSIGKILLAfterTimeout(addon.Pid)
+}
+
+// stopDisabledAddons stops the running addons which were disabled in the registry.
+func stopDisabledAddons(runnables Addons) {
+	for k, addon := range runningAddons {
+		if _, found := runnables[k]; found || !addon.IsAddon || !addon.IsRunning || addon.IsStopping {
+			continue
+		}
+		if addonRegistry.isEnabled(addon.Name, true) {
+			continue
+		}
+		addon.logEvent(NOTICE, journal.EventStopping, "the addon is disabled")
+		addon.terminate(true)
+	}
+}
+
+func (a *AddonBase) watchDummy(addon *AddonType) {
+	addon.IsRunning = true
+	dummyPath := a.getDummyPath()
+	touchFile(dummyPath, addon.User)
+	addon.logEvent(WARNING, journal.EventDummy, "origin was empty, remove %s to start again the addon", dummyPath)
+	// a change in the watched files removes the dummy, so a fixed unit starts again on save
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go watchFiles(addon.Name, addon.WatchPaths, watchDone, func() {
+		fmt.Println("[IGO] Watched files changed, removing dummy: ", dummyPath)
+		os.Remove(dummyPath)
+	})
+	for {
+		if _, err := os.Stat(dummyPath); err != nil {
+			fmt.Println("[IGO] Dummy removed, initiating addon restart ...")
+			break
+		}
+		if !sleepUnlocked(1 * time.Second) {
+			return
+		}
+	}
+	addon.Current.resetRestartCount()
+	addon.IsRestarting = true
+	addon.IsRunning = false
+	addon.ExitCode = 0 // so it will try to run the addon again and not fallback to the origin that does not exist.
+}
+
+func copyAddonToOrigin() error {
+	cmd := exec.Command("cp", "-rf", addonDir+"/.", originDir)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not copy addons: %s to origins %s: %w", addonDir, originDir, err)
+	}
+	return nil
+}
+
+func symlinkAddonToRuntimeUnits() {
+	symlinkPath := filepath.Join(unitDir, "addons")
+	targetPath := addonDir
+
+	// Check if symlink exists and points to the correct target
+	info, err := os.Lstat(symlinkPath)
+	if err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			dest, err := os.Readlink(symlinkPath)
+			if err == nil && dest == targetPath {
+				return // Symlink exists and is correct
+			}
+		}
+	}
+	// Create the symlink
+	err = os.Symlink(targetPath, symlinkPath)
+	if err != nil {
+		fmt.Printf("[IGO] Could not create symlink %s -> %s: %v\n", symlinkPath, targetPath, err)
+	}
+}
+
+func emptyOrigin() error {
+	if err := os.RemoveAll(originDir); err != nil {
+		return fmt.Errorf("could not empty origin: %s err: %w", originDir, err)
+	}
+	return nil
+}
+
+func cleanRunFiles() error {
+	if err := os.RemoveAll(runDir); err != nil {
+		return fmt.Errorf("could not empty rundir: %s err: %w", runDir, err)
+	}
+	return nil
+}
+
+func setIgoGrpId() error {
+	if Config.Group == "" {
+		igoGrpId = os.Getgid()
+		return nil
+	}
+	igoGrp, err := user.LookupGroup(Config.Group)
+	if err != nil {
+		return fmt.Errorf("could not find %s group, create it or set another one with -group: %w", Config.Group, err)
+	}
+	gid, err := strconv.Atoi(igoGrp.Gid)
+	if err != nil {
+		return fmt.Errorf("could not parse %s group id: %s err: %w", Config.Group, igoGrp.Gid, err)
+	}
+	igoGrpId = gid
+	return nil
+}
+
+// configure sets the dirs of igo from the config without touching the file system.
+func configure(c IgoConfig) error {
+	Config = c
+	if Config.RootPath == "" {
+		return errors.New("the root path of igo is not set")
+	}
+	if Config.Python == "" {
+		Config.Python = "python3"
+	}
+	igoRootPath = Config.RootPath
+	originDir = filepath.Join(igoRootPath, ".runtime/origins")
+	unitDir = filepath.Join(igoRootPath, ".runtime/units")
+	runDir = filepath.Join(igoRootPath, ".runtime/run")
+	addonDir = filepath.Join(igoRootPath, "addons")
+	igoConfigDir = Config.ConfigDir
+	pollTimeout = Config.PollTimeout
+	return nil
+}
+
+// Init prepares the runtime dirs of igo under the root path of the config, it has to be
+// called before Run.
+func Init(c IgoConfig) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	addonsMu.Lock()
+	runningAddons = make(map[string]*AddonType)
+	addonsMu.Unlock()
+	shutdown = make(chan struct{})
+	// the processes and ictl started by them find igo with these
+	os.Setenv("IGO_ROOT_PATH", igoRootPath)
+	os.Setenv("IGO_CONFIG_DIR", igoConfigDir)
+
+	if Config.JournalPath == "" {
+		Config.JournalPath = journal.DefaultPath(igoRootPath)
+	}
+	eventJournal.Close()
+	var err error
+	if eventJournal, err = journal.Open(Config.JournalPath, Config.JournalMaxBytes); err != nil {
+		return fmt.Errorf("could not open the journal: %w", err)
+	}
+	os.Setenv("IGO_JOURNAL", Config.JournalPath)
+
+	DebugPrintln("debug mode enabled!")
+	fmt.Println("[IGO] Starting ...")
+	if Config.ReapZombies {
+		zombieInit()
+	}
+	if _, err := exec.LookPath(Config.Python); err != nil {
+		fmt.Println("[IGO] ", WARNING, " python not found, config.py of the units can not be read: ", Config.Python)
+	}
+	for _, dir := range []string{addonDir, unitDir} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+	}
+	if err := emptyOrigin(); err != nil {
+		return err
+	}
+	if err := copyAddonToOrigin(); err != nil {
+		return err
+	}
+	symlinkAddonToRuntimeUnits()
+	if err := cleanRunFiles(); err != nil {
+		return err
+	}
+	if err := startControlServer(); err != nil {
+		return err
+	}
+	// the policy is read on every control request, a broken one only denies the permissions
+	if err := readPolicy(getPolicyPath()).validate(); err != nil {
+		fmt.Println("[IGO] ", ERR, " invalid policy: ", err)
+	}
+	initRuntimeRegistry()
+	linkEnabledUnits()
+	return setIgoGrpId()
+}
+
+func isShutdown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepUnlessShutdown sleeps d and returns false if igo started to shut down meanwhile.
+func sleepUnlessShutdown(d time.Duration) bool {
+	select {
+	case <-shutdown:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// sleepUnlocked is sleepUnlessShutdown for the holders of addonsMu, it is released meanwhile.
+func sleepUnlocked(d time.Duration) bool {
+	slept := false
+	unlocked(func() { slept = sleepUnlessShutdown(d) })
+	return slept
+}
+
+// unlocked runs f without addonsMu, its holder waits in f for a process or a sleep.
+func unlocked(f func()) {
+	addonsMu.Unlock()
+	defer addonsMu.Lock()
+	f()
+}
+
+// goWorker runs f for the addon on a goroutine with addonsMu held, Shutdown waits for it to
+// return. The addon is marked as running before, so the next find cycle does not handle it
+// again until f sets it back.
+func goWorker(addon *AddonType, f func(*AddonType)) {
+	addon.IsRunning = true
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		addonsMu.Lock()
+		defer addonsMu.Unlock()
+		f(addon)
+	}()
+}
+
+// Shutdown stops the find cycle and terminates every process started by igo. The units
+// stay registered, so they are started again by the next Run. It returns when every process
+// exited, the process trees still running after the timeout get SIGKILL.
+func Shutdown(timeout time.Duration) {
+	close(shutdown)
+	findLoop.Wait()
+	stopControlServer()
+	addonsMu.Lock()
+	for _, addon := range runningAddons {
+		if addon.IsRunning {
+			addon.terminate(false)
+		}
+	}
+	addonsMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+		fmt.Println("[IGO] Shutdown timeout, sending SIGKILL to the processes still running")
+	}
+	// the workers return when their process exited, Init must not find them running
+	children := proc.Children()
+	addonsMu.Lock()
+	for _, addon := range runningAddons {
+		if addon.Pid != 0 {
+			for _, pid := range proc.Tree(addon.Pid, children) {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+	addonsMu.Unlock()
+	<-done
+}
+
+// Run starts the find cycle of igo, it returns when Shutdown is called.
+func Run() {
+	findLoop.Add(1)
+	defer findLoop.Done()
+	for {
+		DebugPrintln("find runnable cycle run..")
+		reloadAddonRegistry()
+		runnables := findRunnables()
+		addonsMu.Lock()
+		for k, v := range runnables {
+			// a worker can remove its unit while find runs without the lock
+			if _, err := os.Stat(k); err != nil {
+				continue
+			}
+			if _, ok := runningAddons[k]; !ok {
+				runningAddons[k] = v
+				v.logEvent(INFO, journal.EventDiscovered, "%s", k)
+				goWorker(v, v.Current.startAndRetry)
+			} else {
+				addon := runningAddons[k]
+				if !addon.IsRunning {
+					if addon.SkipReason != "" {
+						goWorker(addon, addon.Current.watchSkipped)
+						continue
+					}
+					// (done) todo how many retry
+					// (done) todo is addon and has origin?
+					if v.Current.Timestamp != addon.Current.Timestamp || (addon.ExitCode == 0 && addon.IsOrigin) || addon.IsRestarting {
+						goWorker(addon, v.Current.startAndRetry)
+					} else if addon.IsOrigin {
+						goWorker(addon, v.Current.startAndRetry)
+					} else {
+						// (done) todo touch origin file
+						if reflect.DeepEqual(v.Origin, AddonBase{}) {
+							goWorker(addon, v.Current.watchDummy)
+						} else {
+							addon.logEvent(WARNING, journal.EventFallback, "fallback to the origin %s", v.Origin.Id)
+							v.Origin.resetRestartCount()
+							v.Current.resetRestartCount()
+							goWorker(addon, v.Origin.startAndRetry)
+						}
+					}
+					addon.Current.Timestamp = v.Current.Timestamp
+					addon.Origin.Timestamp = v.Origin.Timestamp
+				} else {
+					if !hasKillFile(addon) {
+						continue
+					}
+					addon.logEvent(NOTICE, journal.EventKilled, "kill file found")
+					// edge case, if its a unit, and we are killing the dummy origin, then we dont want to remove the whole unit, just kill the dummy, and restart the addon.
+					addon.terminate(!(addon.IsAddon && addon.IsOrigin))
+				}
+			}
+		}
+		stopDisabledAddons(runnables)
+		addonsMu.Unlock()
+		if !sleepUnlessShutdown(pollTimeout) {
+			return
+		}
+	}
+}
@@ -0,0 +1,1253 @@
+package supervisor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ui3o/codebox/igo/control"
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+// TestMain runs the sandbox helper when the supervisor starts the test binary as igo.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxCommand {
+		RunSandbox(os.Args[2:])
+		os.Exit(126)
+	}
+	os.Exit(m.Run())
+}
+
+// testEnv is a hermetic igo root in a temp dir. The units are shell scripts which append a
+// line to a log file in the out dir on every start.
+type testEnv struct {
+	t    *testing.T
+	root string
+	out  string
+	home string
+	user *user.User
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal("could not get current user:", err)
+	}
+	base := t.TempDir()
+	env := &testEnv{
+		t:    t,
+		root: filepath.Join(base, "igo"),
+		out:  filepath.Join(base, "out"),
+		home: filepath.Join(base, "home"),
+		user: u,
+	}
+	for _, dir := range []string{env.root, env.out, env.home} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env
+}
+
+func requirePython(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to read config.py")
+	}
+}
+
+// script returns a start script which logs its start with the given word and then runs body.
+func (env *testEnv) script(name string, word string, body string) string {
+	return fmt.Sprintf("#!/bin/sh\necho %s $IGO_PROCESS_TYPE $IGO_PROCESS_NAME >> %s\n%s\n", word, env.logPath(name), body)
+}
+
+func (env *testEnv) writeRunnable(dir string, name string, script string, conf string) {
+	env.t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		env.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".start"), []byte(script), 0755); err != nil {
+		env.t.Fatal(err)
+	}
+	if conf != "" {
+		if err := os.WriteFile(filepath.Join(dir, "config.py"), []byte("conf = "+conf+"\n"), 0644); err != nil {
+			env.t.Fatal(err)
+		}
+	}
+}
+
+// addUnit creates the unit in the home dir and symlinks it to the units dir like ictl start.
+func (env *testEnv) addUnit(name string, script string, conf string) {
+	env.t.Helper()
+	unitPath := filepath.Join(env.home, name)
+	env.writeRunnable(unitPath, name, script, conf)
+	symlinkPath := env.unitSymlinkPath(name)
+	if err := os.MkdirAll(filepath.Dir(symlinkPath), 0755); err != nil {
+		env.t.Fatal(err)
+	}
+	if err := os.Symlink(unitPath, symlinkPath); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+func (env *testEnv) addAddon(name string, script string, conf string) {
+	env.t.Helper()
+	env.writeRunnable(filepath.Join(env.root, "addons", name), name, script, conf)
+}
+
+func (env *testEnv) unitSymlinkPath(name string) string {
+	return filepath.Join(env.root, ".runtime/units", env.user.Username, name)
+}
+
+func (env *testEnv) unitRunPath(name string) string {
+	return filepath.Join(env.root, ".runtime/run", env.user.Username, name)
+}
+
+func (env *testEnv) logPath(name string) string {
+	return filepath.Join(env.out, name+".log")
+}
+
+func (env *testEnv) logLines(name string) []string {
+	raw, err := os.ReadFile(env.logPath(name))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(raw)), "\n")
+}
+
+func (env *testEnv) init() {
+	env.t.Helper()
+	err := Init(IgoConfig{
+		RootPath:    env.root,
+		ConfigDir:   filepath.Join(env.root, "etc"),
+		Python:      "python3",
+		PollTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		env.t.Fatal("init failed:", err)
+	}
+}
+
+func (env *testEnv) run() {
+	go Run()
+	env.t.Cleanup(func() { Shutdown(10 * time.Second) })
+}
+
+func (env *testEnv) start() {
+	env.t.Helper()
+	env.init()
+	env.run()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for:", what)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestUnitStart(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("web", env.script("web", "started", "echo $IGO_ROOT_PATH >> "+env.logPath("web")+"\nexec sleep 30"), "")
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("web")) == 2 })
+	lines := env.logLines("web")
+	if lines[0] != "started unit web" {
+		t.Error("unexpected process tags:", lines[0])
+	}
+	if lines[1] != env.root {
+		t.Error("IGO_ROOT_PATH is not exported, got:", lines[1])
+	}
+}
+
+func TestUnitRemovedOnExitZero(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("oneshot", env.script("oneshot", "started", "exit 0"), "")
+	env.start()
+
+	waitFor(t, "unit symlink removal", func() bool { return !exists(env.unitSymlinkPath("oneshot")) })
+	waitFor(t, "run dir removal", func() bool { return !exists(env.unitRunPath("oneshot")) })
+	if lines := env.logLines("oneshot"); len(lines) != 1 {
+		t.Error("unit should run once, runs:", len(lines))
+	}
+}
+
+func TestUnitCrashWaitsOnDummy(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("crash", env.script("crash", "started", "exit 3"), "")
+	env.start()
+
+	dummyPath := filepath.Join(env.unitRunPath("crash"), "crash.start.origin.dummy")
+	waitFor(t, "dummy file", func() bool { return exists(dummyPath) })
+	if !exists(env.unitSymlinkPath("crash")) {
+		t.Fatal("a crashed unit should stay registered")
+	}
+	if lines := env.logLines("crash"); len(lines) != 1 {
+		t.Fatal("crashed unit without restartCount should run once, runs:", len(lines))
+	}
+
+	if err := os.Remove(dummyPath); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "start after dummy removal", func() bool { return len(env.logLines("crash")) == 2 })
+}
+
+func TestUnitRetry(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	env.addUnit("flaky", env.script("flaky", "started", "exit 1"), `{"start": {"restartCount": 2}}`)
+	env.start()
+
+	dummyPath := filepath.Join(env.unitRunPath("flaky"), "flaky.start.origin.dummy")
+	waitFor(t, "dummy file after the retries", func() bool { return exists(dummyPath) })
+	// the first start and two retries
+	if lines := env.logLines("flaky"); len(lines) != 3 {
+		t.Error("unit should be started 3 times, started:", len(lines))
+	}
+}
+
+func TestWatchFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	globs := []string{filepath.Join(dir, "src"), filepath.Join(dir, "*.conf")}
+	empty := watchFingerprint(globs)
+
+	// the globs match nothing yet, the files appear later
+	if err := os.MkdirAll(filepath.Join(dir, "src/pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	created := watchFingerprint(globs)
+	if created == empty {
+		t.Fatal("the created dir is not detected")
+	}
+	steps := []struct {
+		what   string
+		change func() error
+	}{
+		{"a new file in a subdir", func() error { return os.WriteFile(filepath.Join(dir, "src/pkg/a.go"), []byte("a"), 0644) }},
+		{"a new match of a glob", func() error { return os.WriteFile(filepath.Join(dir, "app.conf"), []byte("x"), 0644) }},
+		{"a changed size", func() error { return os.WriteFile(filepath.Join(dir, "src/pkg/a.go"), []byte("ab"), 0644) }},
+		{"a changed mtime", func() error {
+			return os.Chtimes(filepath.Join(dir, "app.conf"), time.Now(), time.Now().Add(-time.Hour))
+		}},
+		{"a removed file", func() error { return os.Remove(filepath.Join(dir, "src/pkg/a.go")) }},
+	}
+	previous := created
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		current := watchFingerprint(globs)
+		if current == previous {
+			t.Error("the change is not detected:", step.what)
+		}
+		if current != watchFingerprint(globs) {
+			t.Error("the fingerprint changed without a change after:", step.what)
+		}
+		previous = current
+	}
+	// a file outside of the globs is not watched
+	if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if watchFingerprint(globs) != previous {
+		t.Error("a file outside of the globs should not change the fingerprint")
+	}
+}
+
+func TestWatchPathsRestart(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	env.addUnit("web", env.script("web", "started", "exec sleep 30"), `{"watchPaths": ["data/*"]}`)
+	env.start()
+	waitFor(t, "unit start", func() bool { return len(env.logLines("web")) == 1 })
+
+	dataDir := filepath.Join(env.home, "web/data")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "restart after the change", func() bool { return len(env.logLines("web")) == 2 })
+	if !exists(env.unitSymlinkPath("web")) {
+		t.Error("a unit restarted for its watched files should stay registered")
+	}
+	restarting := false
+	for _, event := range env.events("web") {
+		if event.Event == journal.EventRestarting && strings.Contains(event.Reason, "watched files changed") {
+			restarting = true
+		}
+	}
+	if !restarting {
+		t.Error("the restart of the watched files is not in the journal")
+	}
+}
+
+func TestKillFile(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("daemon", env.script("daemon", "started", "exec sleep 30"), "")
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("daemon")) == 1 })
+	waitFor(t, "running state", func() bool { return exists(env.unitRunPath("daemon")) })
+	killPath := filepath.Join(env.unitRunPath("daemon"), "daemon_kill")
+	if err := os.WriteFile(killPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "unit symlink removal", func() bool { return !exists(env.unitSymlinkPath("daemon")) })
+	waitFor(t, "kill file removal", func() bool { return !exists(killPath) })
+	if lines := env.logLines("daemon"); len(lines) != 1 {
+		t.Error("killed unit should not be started again, runs:", len(lines))
+	}
+}
+
+func TestLegacyKillFile(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("daemon", env.script("daemon", "started", "exec sleep 30"), "")
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("daemon")) == 1 })
+	waitFor(t, "running state", func() bool { return exists(env.unitRunPath("daemon")) })
+	// the name igo looked for before it agreed on the one of ictl
+	killPath := filepath.Join(env.unitRunPath("daemon"), "daemon.kill")
+	if err := os.WriteFile(killPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "unit symlink removal", func() bool { return !exists(env.unitSymlinkPath("daemon")) })
+	waitFor(t, "kill file removal", func() bool { return !exists(killPath) })
+}
+
+func TestAddonFallbackToOrigin(t *testing.T) {
+	env := newTestEnv(t)
+	env.addAddon("proxy", env.script("proxy", "good", "exec sleep 30"), "")
+	// the origin is copied from the good version, then the addon breaks
+	env.init()
+	env.addAddon("proxy", env.script("proxy", "broken", "exit 1"), "")
+	env.run()
+
+	waitFor(t, "origin start", func() bool { return len(env.logLines("proxy")) == 2 })
+	lines := env.logLines("proxy")
+	if lines[0] != "broken addon proxy" {
+		t.Error("the addon should run first, got:", lines[0])
+	}
+	if lines[1] != "good origin proxy" {
+		t.Error("the origin should run after the addon failed, got:", lines[1])
+	}
+}
+
+func TestAddonDummyWithoutOrigin(t *testing.T) {
+	env := newTestEnv(t)
+	env.addAddon("broken", env.script("broken", "started", "exit 1"), "")
+	env.init()
+	if err := os.RemoveAll(filepath.Join(env.root, ".runtime/origins/broken")); err != nil {
+		t.Fatal(err)
+	}
+	env.run()
+
+	dummyPath := filepath.Join(env.root, ".runtime/run/addons/broken/broken.start.origin.dummy")
+	waitFor(t, "dummy file", func() bool { return exists(dummyPath) })
+	if lines := env.logLines("broken"); len(lines) != 1 {
+		t.Fatal("broken addon should run once, runs:", len(lines))
+	}
+}
+
+func TestGroupMissing(t *testing.T) {
+	env := newTestEnv(t)
+	err := Init(IgoConfig{RootPath: env.root, Group: "igo-test-group-does-not-exist", PollTimeout: time.Second})
+	if err == nil {
+		t.Fatal("Init should fail without the group instead of starting processes with a wrong group")
+	}
+}
+
+func (env *testEnv) attach(name string, readOnly bool) (net.Conn, *bufio.Reader, control.Response) {
+	env.t.Helper()
+	conn, err := net.Dial("unix", control.SocketPath(env.root))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	env.t.Cleanup(func() { conn.Close() })
+	req := control.Request{Action: control.ActionAttach, Name: name, User: env.user.Username, ReadOnly: readOnly}
+	if err := control.WriteMessage(conn, req); err != nil {
+		env.t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil {
+		env.t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestAttachPty(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	env.addUnit("repl", env.script("repl", "started", "echo ready\nread line\necho got $line >> "+env.logPath("repl")+"\nexec sleep 30"), `{"pty": True}`)
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("repl")) == 1 })
+	conn, reader, resp := env.attach("repl", false)
+	if resp.Error != "" || !resp.Pty || resp.ReadOnly {
+		t.Fatal("unexpected attach response:", resp)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ready" {
+		t.Fatal("the scrollback should contain the output before the attach, got:", line, err)
+	}
+	if _, _, resp := env.attach("repl", false); resp.Error == "" {
+		t.Error("a second interactive attach should fail")
+	}
+	_, viewer, resp := env.attach("repl", true)
+	if resp.Error != "" || !resp.ReadOnly {
+		t.Fatal("a read-only viewer should attach, got:", resp)
+	}
+	viewer.ReadString('\n')
+
+	if err := control.WriteFrame(conn, control.FrameInput, []byte("world\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "input on the pty", func() bool { return len(env.logLines("repl")) == 2 })
+	if lines := env.logLines("repl"); lines[1] != "got world" {
+		t.Error("unexpected input of the unit:", lines[1])
+	}
+	// the pty echoes the input to every viewer
+	if line, err := viewer.ReadString('\n'); err != nil || strings.TrimSpace(line) != "world" {
+		t.Error("the read-only viewer should see the echo, got:", line, err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	requirePython(t)
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox needs root")
+	}
+	env := newTestEnv(t)
+	// privateTmp hides the test env if it is under /tmp, the bind adds it back
+	base := filepath.Dir(env.root)
+	readOnly := filepath.Join(env.home, "readonly")
+	hidden := filepath.Join(env.home, "hidden")
+	for _, dir := range []string{readOnly, hidden} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(hidden, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpMarker := filepath.Join("/tmp", filepath.Base(env.root)+"-"+filepath.Base(filepath.Dir(env.root)))
+	log := env.logPath("boxed")
+	body := fmt.Sprintf(`touch %s
+touch %s/file 2>/dev/null && echo writable >> %s || echo readonly >> %s
+cat %s/secret >> %s 2>/dev/null || echo hidden >> %s
+ip -o link 2>/dev/null | grep -c ': ' >> %s || echo 0 >> %s
+exec sleep 30`, tmpMarker, readOnly, log, log, hidden, log, log, log, log)
+	conf := fmt.Sprintf(`{"privateTmp": True, "privateNetwork": True, "bindPaths": ["%s"], "readOnlyPaths": ["%s"], "inaccessiblePaths": ["%s", "-/does/not/exist"]}`, base, readOnly, hidden)
+	env.addUnit("boxed", env.script("boxed", "started", body), conf)
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("boxed")) == 4 })
+	lines := env.logLines("boxed")
+	if lines[1] != "readonly" {
+		t.Error("the read-only path should not be writable, got:", lines[1])
+	}
+	if lines[2] != "hidden" {
+		t.Error("the inaccessible path should be hidden, got:", lines[2])
+	}
+	if _, err := exec.LookPath("ip"); err == nil && lines[3] != "1" {
+		t.Error("only loopback should be in the private network, links:", lines[3])
+	}
+	if exists(tmpMarker) {
+		os.Remove(tmpMarker)
+		t.Error("the unit should write to its private tmp")
+	}
+}
+
+// runSandboxHelper runs the command through the sandbox helper as nobody in a new mount namespace.
+func runSandboxHelper(t *testing.T, dir string, bindPaths []string, command string) (string, error) {
+	t.Helper()
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+	sandbox := RunnableSandbox{BindPaths: bindPaths}
+	spec, _ := json.Marshal(sandboxSpec{RunnableSandbox: sandbox, SetCredential: true, Uid: uid, Gid: gid})
+	cmd := exec.Command("/proc/self/exe", SandboxCommand, string(spec), "--", "/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	sandboxCloneflags(cmd.SysProcAttr, sandbox)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func TestSandboxBindOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox needs root")
+	}
+	// nobody has to reach the files, the temp dir of the test is only open for root
+	dir, err := os.MkdirTemp("", "igo-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	public, secret, own, rootOwned := filepath.Join(dir, "public"), filepath.Join(dir, "secret"), filepath.Join(dir, "own"), filepath.Join(dir, "root")
+	for path, mode := range map[string]os.FileMode{public: 0644, secret: 0600, own: 0644, rootOwned: 0644} {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chown(own, uid, -1)
+
+	out, err := runSandboxHelper(t, dir, []string{public + ":" + own}, "cat "+own+"; echo; grep NoNewPrivs /proc/self/status")
+	if err != nil || !strings.HasPrefix(out, "public\n") || !strings.HasSuffix(out, "NoNewPrivs:\t1") {
+		t.Fatal("the bind over the own file should run with no_new_privs:", err, out)
+	}
+	if out, err := runSandboxHelper(t, dir, []string{secret + ":" + own}, "cat "+own); err == nil || !strings.Contains(out, "not readable") {
+		t.Error("a src the unit can not read should be refused:", out)
+	}
+	if out, err := runSandboxHelper(t, dir, []string{public + ":" + rootOwned}, "cat "+rootOwned); err == nil || !strings.Contains(out, "not owned") {
+		t.Error("a dst of root should be refused:", out)
+	}
+	if out, err := runSandboxHelper(t, dir, []string{public + ":/etc/passwd"}, "true"); err == nil {
+		t.Error("a bind over /etc/passwd should be refused:", out)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"NAME": "web", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		val, ok := vars[name]
+		return val, ok
+	}
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"plain", "plain", false},
+		{"${NAME}.log", "web.log", false},
+		{"${MISSING:-fallback}", "fallback", false},
+		{"${EMPTY:-fallback}", "fallback", false},
+		{"${EMPTY}", "", false},
+		{"$$HOME and $HOME", "$HOME and $HOME", false},
+		{"${MISSING}", "", true},
+		{"${NAME", "", true},
+		{"${1X}", "", true},
+	} {
+		got, err := expand(tc.in, lookup)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("expand(%q) = %q, %v, want %q, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestUnitExpandedConfig(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	log := env.logPath("expanded")
+	env.addUnit("expanded", env.script("expanded", "started", `echo "$1 $2 $GREETING" >> `+log+"\npwd >> "+log+"\nexec sleep 30"),
+		`{"start": {"params": ["${IGO_PROCESS_NAME}", "${IGO_TEST_UNSET:-fallback}"], "envs": {"GREETING": "hello ${IGO_PROCESS_USER}"}, "wd": "${IGO_PROCESS_STATE_DIR}"}}`)
+	env.addUnit("unresolved", env.script("unresolved", "started", "exec sleep 30"), `{"start": {"params": ["${IGO_TEST_UNSET}"]}}`)
+	// the state dir is in the real home of the user
+	t.Cleanup(func() { os.RemoveAll(filepath.Join(env.user.HomeDir, ".local/state/igo/expanded")) })
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("expanded")) == 3 })
+	lines := env.logLines("expanded")
+	if want := "expanded fallback hello " + env.user.Username; lines[1] != want {
+		t.Errorf("unexpected params and envs, got %q, want %q", lines[1], want)
+	}
+	if want := filepath.Join(env.user.HomeDir, ".local/state/igo/expanded"); lines[2] != want {
+		t.Errorf("the wd should be the created state dir, got %q, want %q", lines[2], want)
+	}
+	dummyPath := filepath.Join(env.unitRunPath("unresolved"), "unresolved.start.origin.dummy")
+	waitFor(t, "dummy of the unresolved unit", func() bool { return exists(dummyPath) })
+	if lines := env.logLines("unresolved"); len(lines) != 0 {
+		t.Error("a unit with an unresolved variable should not start")
+	}
+}
+
+func TestStateDirSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the owner can only be set by root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+	base := t.TempDir()
+	target := filepath.Join(base, "target")
+	state := filepath.Join(base, "home", ".local", "state")
+	for _, dir := range []string{target, state} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the user links its state dir to a dir of root
+	link := filepath.Join(state, "igo")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	os.Lchown(link, uid, gid)
+	if err := mkdirAllOwned(filepath.Join(link, "unit"), uid, gid); err == nil {
+		t.Error("the symlink of the user should not be followed")
+	}
+	if exists(filepath.Join(target, "unit")) {
+		t.Error("the dir should not be created through the symlink of the user")
+	}
+
+	os.Lchown(link, 0, 0)
+	if err := mkdirAllOwned(filepath.Join(link, "unit", "data"), uid, gid); err != nil {
+		t.Fatal("the symlink of root should be followed:", err)
+	}
+	for _, dir := range []string{filepath.Join(target, "unit"), filepath.Join(target, "unit", "data")} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); int(st.Uid) != uid || info.Mode().Perm() != 0700 {
+			t.Errorf("unexpected owner %d or mode %v of %s", st.Uid, info.Mode().Perm(), dir)
+		}
+	}
+	if info, _ := os.Stat(target); info.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Error("the existing dirs should keep their owner")
+	}
+}
+
+func (env *testEnv) events(name string) []journal.Event {
+	raw, err := os.ReadFile(journal.DefaultPath(env.root))
+	if err != nil {
+		return nil
+	}
+	var events []journal.Event
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var e journal.Event
+		if err := json.Unmarshal([]byte(line), &e); err == nil && e.Name == name {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestJournal(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("oneshot", env.script("oneshot", "started", "exit 0"), "")
+	env.start()
+
+	waitFor(t, "removed event", func() bool {
+		events := env.events("oneshot")
+		return len(events) > 0 && events[len(events)-1].Event == journal.EventRemoved
+	})
+	var names []string
+	for _, e := range env.events("oneshot") {
+		names = append(names, e.Event)
+		if e.User != env.user.Username || e.Type != "unit" {
+			t.Error("unexpected user or type of the event:", e)
+		}
+		if e.Event == journal.EventStarted && e.Pid == 0 {
+			t.Error("the started event should have the pid")
+		}
+		if e.Event == journal.EventExited && (e.ExitCode == nil || *e.ExitCode != 0) {
+			t.Error("the exited event should have the exit code 0:", e.ExitCode)
+		}
+	}
+	want := []string{journal.EventDiscovered, journal.EventStarted, journal.EventExited, journal.EventRemoved}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected events %v, want %v", names, want)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	// an older igo created the journal readable by everyone
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := journal.Open(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := w.Append(journal.Event{Name: fmt.Sprint("unit", i), Event: journal.EventStarted}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	for _, p := range []string{path, journal.RotatedPath(path)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 || info.Size() > 400 {
+			t.Errorf("unexpected mode %v or size %d of %s", info.Mode().Perm(), info.Size(), p)
+		}
+	}
+	var names []string
+	journal.Read(path, func(e journal.Event) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if len(names) < 2 || names[len(names)-1] != "unit5" || names[len(names)-2] != "unit4" {
+		t.Errorf("the events should be read in order, got %v", names)
+	}
+
+	link := filepath.Join(t.TempDir(), "link.jsonl")
+	os.Symlink(path, link)
+	if _, err := journal.Open(link, 0); err == nil {
+		t.Error("a symlink should not be opened as the journal")
+	}
+}
+
+func (env *testEnv) request(req control.Request) control.Response {
+	env.t.Helper()
+	conn, err := net.Dial("unix", control.SocketPath(env.root))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	defer conn.Close()
+	req.User = env.user.Username
+	if err := control.WriteMessage(conn, req); err != nil {
+		env.t.Fatal(err)
+	}
+	var resp control.Response
+	if err := control.ReadMessage(bufio.NewReader(conn), &resp); err != nil {
+		env.t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRestart(t *testing.T) {
+	env := newTestEnv(t)
+	// the first start ignores SIGTERM, so the restart has to kill it
+	ignoreTerm := fmt.Sprintf("if [ $(wc -l < %s) -eq 1 ]; then trap '' TERM; fi\nexec sleep 30", env.logPath("stubborn"))
+	env.addUnit("stubborn", env.script("stubborn", "started", ignoreTerm), "")
+	env.addUnit("crash", env.script("crash", "started", "exit 3"), "")
+	env.start()
+
+	waitFor(t, "unit start", func() bool { return len(env.logLines("stubborn")) == 1 })
+	resp := env.request(control.Request{Action: control.ActionRestart, Name: "stubborn", Timeout: 1})
+	if resp.Error != "" || resp.Pid == 0 {
+		t.Fatal("restart failed:", resp)
+	}
+	waitFor(t, "second start", func() bool { return len(env.logLines("stubborn")) == 2 })
+	if !exists(env.unitSymlinkPath("stubborn")) {
+		t.Error("a restarted unit should stay registered")
+	}
+
+	dummyPath := filepath.Join(env.unitRunPath("crash"), "crash.start.origin.dummy")
+	waitFor(t, "dummy file", func() bool { return exists(dummyPath) })
+	resp = env.request(control.Request{Action: control.ActionRestart, Name: "crash", Timeout: 1})
+	if resp.Error != "" {
+		t.Error("restart of the crashed unit failed:", resp)
+	}
+	waitFor(t, "start of the crashed unit", func() bool { return len(env.logLines("crash")) == 2 })
+
+	if resp := env.request(control.Request{Action: control.ActionRestart, Name: "missing"}); resp.Error == "" {
+		t.Error("restart of a missing unit should fail")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("daemon", env.script("daemon", "started", "exec sleep 30"), "")
+	env.start()
+	waitFor(t, "unit start", func() bool { return len(env.logLines("daemon")) == 1 })
+
+	conn, err := net.Dial("unix", control.SocketPath(env.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := control.WriteMessage(conn, control.Request{Action: control.ActionWatch}); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil || resp.Error != "" {
+		t.Fatal("watch failed:", err, resp)
+	}
+	var update control.Update
+	if err := control.ReadMessage(reader, &update); err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Units) != 1 || update.Units[0].Name != "daemon" || update.Units[0].State != control.StateRunning {
+		t.Fatal("unexpected units:", update.Units)
+	}
+	if update.Units[0].RssBytes == 0 {
+		t.Error("the usage of the unit is missing")
+	}
+
+	go env.request(control.Request{Action: control.ActionRestart, Name: "daemon", Timeout: 1})
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if err := control.ReadMessage(reader, &update); err != nil {
+			t.Fatal("no restarting event:", err)
+		}
+		if update.Event != nil && update.Event.Event == journal.EventRestarting {
+			break
+		}
+	}
+	if update.Event.Reason == "" {
+		t.Error("the reason should be sent to root")
+	}
+
+	// list-all without read-logs gets the units and events of others without the reasons
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		watchUnits(server, uint32(uid), true, false)
+		server.Close()
+	}()
+	reader = bufio.NewReader(client)
+	if err := control.ReadMessage(reader, &resp); err != nil || resp.Error != "" {
+		t.Fatal("watch failed:", err, resp)
+	}
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	go env.request(control.Request{Action: control.ActionRestart, Name: "daemon", Timeout: 1})
+	for {
+		update = control.Update{}
+		if err := control.ReadMessage(reader, &update); err != nil {
+			t.Fatal("no restarting event:", err)
+		}
+		if len(update.Units) != 1 {
+			t.Fatal("list-all should see the unit of root:", update.Units)
+		}
+		if update.Event != nil && update.Event.Event == journal.EventRestarting {
+			break
+		}
+	}
+	if update.Event.Reason != "" {
+		t.Error("the reason should not be sent without read-logs:", update.Event.Reason)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUnit("daemon", env.script("daemon", "started", "exec sleep 30"), "")
+	env.addUnit("other", env.script("other", "started", "exec sleep 30"), "")
+	env.start()
+	waitFor(t, "unit start", func() bool { return len(env.logLines("daemon")) == 1 })
+
+	conn, err := net.Dial("unix", control.SocketPath(env.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := control.WriteMessage(conn, control.Request{Action: control.ActionEvents, Name: "daemon", Follow: true}); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	var resp control.Response
+	if err := control.ReadMessage(reader, &resp); err != nil || resp.Error != "" {
+		t.Fatal("events failed:", err, resp)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var e journal.Event
+	if err := control.ReadMessage(reader, &e); err != nil || e.Event != journal.EventDiscovered {
+		t.Fatal("the journal should start with the discovery:", err, e)
+	}
+	go env.request(control.Request{Action: control.ActionRestart, Name: "daemon", Timeout: 1})
+	for e.Event != journal.EventRestarting {
+		if err := control.ReadMessage(reader, &e); err != nil {
+			t.Fatal("no restarting event:", err)
+		}
+		if e.Name != "daemon" {
+			t.Fatal("the event of another unit was sent:", e)
+		}
+	}
+
+	// the users without read-logs only get the events of their own units
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		streamEvents(server, control.Request{Action: control.ActionEvents}, uint32(uid), false)
+		server.Close()
+	}()
+	reader = bufio.NewReader(client)
+	if err := control.ReadMessage(reader, &resp); err != nil || resp.Error != "" {
+		t.Fatal("events failed:", err, resp)
+	}
+	if err := control.ReadMessage(reader, &e); err == nil {
+		t.Error("the events of others should not be sent:", e)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	group, err := user.LookupGroupId(nobody.Gid)
+	if err != nil {
+		t.Skip("no group of nobody:", err)
+	}
+	defer func(dir string) { igoConfigDir = dir }(igoConfigDir)
+	igoConfigDir = t.TempDir()
+	policy := fmt.Sprintf(`{"groups": {%q: [%q, %q]}}`, group.Name, control.PermListAll, control.PermReadLogs)
+	if err := os.WriteFile(getPolicyPath(), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	perms := peerPermissions(uint32(uid))
+	if !perms[control.PermListAll] || !perms[control.PermReadLogs] || perms[control.PermStopOthers] {
+		t.Fatal("unexpected permissions:", perms)
+	}
+	other := &AddonType{User: &user.User{Uid: "12345", Username: "other"}}
+	if !other.canReach(uint32(uid), perms, control.PermReadLogs) || other.canReach(uint32(uid), perms, control.PermStopOthers) {
+		t.Error("the policy should allow reading the logs and deny stopping the units of others")
+	}
+	addon := &AddonType{IsAddon: true}
+	if addon.canReach(uint32(uid), perms, control.PermStopOthers) {
+		t.Error("an addon needs manage-addons")
+	}
+
+	if os.Geteuid() == 0 {
+		os.Chmod(getPolicyPath(), 0666)
+		if perms := peerPermissions(uint32(uid)); len(perms) != 0 {
+			t.Error("a policy writable by others should be ignored:", perms)
+		}
+	}
+	if err := (Policy{Groups: map[string][]string{"g": {"fly"}}}).validate(); err == nil {
+		t.Error("an unknown permission should be reported")
+	}
+}
+
+func TestLinkUserUnits(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	defer func(dir string) { unitDir = dir }(unitDir)
+	unitDir = t.TempDir()
+	home := t.TempDir()
+	u := &user.User{Uid: strconv.Itoa(os.Geteuid()), Username: "alice", HomeDir: home}
+	units := filepath.Join(home, ".config/units")
+	for _, name := range []string{"web", "foreign"} {
+		if err := os.MkdirAll(filepath.Join(units, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	if err := os.Chown(filepath.Join(units, "foreign"), uid, -1); err != nil {
+		t.Skip("cannot chown:", err)
+	}
+	victim := filepath.Join(unitDir, "victim")
+	if err := os.Symlink(home, victim); err != nil {
+		t.Fatal(err)
+	}
+	registry := fmt.Sprintf(`{"web": {"enabled": true, "path": %q}, "../escape": {"enabled": true, "path": %q},
+		"../victim": {"enabled": false}, "outside": {"enabled": true, "path": %q},
+		"foreign": {"enabled": true, "path": %q}, "units": {"enabled": true, "path": %q}}`,
+		filepath.Join(units, "web"), filepath.Join(units, "web"), t.TempDir(), filepath.Join(units, "foreign"), units)
+	if err := os.MkdirAll(filepath.Dir(getUserRegistryPath(u)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getUserRegistryPath(u), []byte(registry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	linkUserUnits(u)
+
+	if target, err := os.Readlink(filepath.Join(unitDir, "alice", "web")); err != nil || target != filepath.Join(units, "web") {
+		t.Error("the unit in the search paths should be linked:", target, err)
+	}
+	if !exists(victim) || exists(filepath.Join(unitDir, "escape")) {
+		t.Error("a name with a path should be ignored")
+	}
+	for _, name := range []string{"outside", "foreign", "units"} {
+		if exists(filepath.Join(unitDir, "alice", name)) {
+			t.Errorf("%s should not be linked", name)
+		}
+	}
+}
+
+func TestConditionAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the conditions of the units of others need root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	public, secret := t.TempDir(), t.TempDir()
+	os.Chmod(filepath.Dir(public), 0755)
+	os.Chmod(public, 0755)
+	os.Chmod(secret, 0700)
+	for _, dir := range []string{public, secret} {
+		if err := os.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unit := &AddonType{User: nobody}
+	addon := &AddonType{IsAddon: true}
+	for _, tc := range []struct {
+		addon     *AddonType
+		condition RunnableCondition
+		want      bool
+	}{
+		{unit, RunnableCondition{FileNotEmpty: filepath.Join(public, "file")}, true},
+		{unit, RunnableCondition{PathExists: filepath.Join(secret, "file")}, false},
+		{unit, RunnableCondition{FileNotEmpty: filepath.Join(secret, "file")}, false},
+		{unit, RunnableCondition{PathExists: filepath.Join(secret, "file"), Negate: true}, true},
+		{addon, RunnableCondition{PathExists: filepath.Join(secret, "file")}, true},
+	} {
+		if got := tc.condition.check(tc.addon, nil); got != tc.want {
+			t.Errorf("%s for %s: got %v", tc.condition, tc.addon.userName(), got)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	env.addUnit("shell", env.script("shell", "started", "exec sleep 30"),
+		fmt.Sprintf(`{"start": {"envs": {"GREETING": "hello ${IGO_PROCESS_USER}"}, "wd": "%s"}, "stop": {"envs": {"PHASE": "stop"}}}`, env.out))
+	if err := os.WriteFile(filepath.Join(env.home, "shell", "shell.stop"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env.start()
+	waitFor(t, "unit start", func() bool { return len(env.logLines("shell")) == 1 })
+
+	resp := env.request(control.Request{Action: control.ActionEnv, Name: "shell"})
+	if resp.Error != "" || resp.Env == nil {
+		t.Fatal("env failed:", resp)
+	}
+	vars := strings.Join(resp.Env.Env, "\n")
+	for _, want := range []string{"GREETING=hello " + env.user.Username, "IGO_PROCESS_NAME=shell", "IGO_PROCESS_TYPE=unit"} {
+		if !strings.Contains(vars, want+"\n") {
+			t.Errorf("the env should have %s", want)
+		}
+	}
+	if resp.Env.Wd != env.out || resp.Env.Pid == 0 {
+		t.Error("unexpected wd or pid:", resp.Env.Wd, resp.Env.Pid)
+	}
+	resp = env.request(control.Request{Action: control.ActionEnv, Name: "shell", StopConfig: true})
+	if resp.Error != "" || !strings.Contains(strings.Join(resp.Env.Env, "\n"), "PHASE=stop") {
+		t.Error("the stop env should have the stop envs:", resp)
+	}
+
+	conn, err := net.Dial("unix", control.SocketPath(env.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := control.Request{Action: control.ActionExec, Name: "shell", User: env.user.Username,
+		Command: []string{"sh", "-c", `echo "$GREETING"; pwd; cat; exit 3`}}
+	if err := control.WriteMessage(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if err := control.ReadMessage(reader, &resp); err != nil || resp.Error != "" {
+		t.Fatal("exec failed:", err, resp)
+	}
+	control.WriteFrame(conn, control.FrameInput, []byte("input\n"))
+	control.WriteFrame(conn, control.FrameEOF, nil)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var stdout strings.Builder
+	for {
+		typ, data, err := control.ReadFrame(reader)
+		if err != nil {
+			t.Fatal("no exit frame:", err)
+		}
+		if typ == control.FrameStdout {
+			stdout.Write(data)
+		}
+		if typ == control.FrameExit {
+			if code, _ := control.ParseExit(data); code != 3 {
+				t.Error("unexpected exit code:", code)
+			}
+			break
+		}
+	}
+	if want := fmt.Sprintf("hello %s\n%s\ninput\n", env.user.Username, env.out); stdout.String() != want {
+		t.Errorf("unexpected output %q, want %q", stdout.String(), want)
+	}
+	for _, e := range env.events("shell") {
+		if e.Event == journal.EventExec && e.Reason != fmt.Sprintf("uid %d runs sh with the start config", os.Getuid()) {
+			t.Error("the journal should only get the program of the exec:", e.Reason)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	script := "#!/bin/sh\n"
+	env.writeRunnable(filepath.Join(env.home, "good"), "good", script, `{"start": {"restartCount": 2}}`)
+	env.writeRunnable(filepath.Join(env.home, "mismatch"), "other", script, "")
+	env.writeRunnable(filepath.Join(env.home, "unknown"), "unknown", script, `{"start": {"restartCont": 2}}`)
+	env.writeRunnable(filepath.Join(env.home, "types"), "types", script, `{"timer": "soon"}`)
+	env.writeRunnable(filepath.Join(env.home, "fails"), "fails", script, `undefined_name`)
+	env.writeRunnable(filepath.Join(env.home, "noexec"), "noexec", script, "")
+	os.Chmod(filepath.Join(env.home, "noexec", "noexec.start"), 0644)
+	os.Symlink(filepath.Join(env.home, "missing"), filepath.Join(env.home, "broken"))
+	// a unit which links to its own dir, and two units which include each other
+	env.writeRunnable(filepath.Join(env.home, "loop"), "loop", script, "")
+	os.Symlink(filepath.Join(env.home, "loop"), filepath.Join(env.home, "loop", "self"))
+	env.writeRunnable(filepath.Join(env.home, "a"), "a", script, "")
+	env.writeRunnable(filepath.Join(env.home, "a", "b"), "b", script, "")
+	os.Symlink(filepath.Join(env.home, "a"), filepath.Join(env.home, "a", "b", "a"))
+
+	result, err := Check(IgoConfig{RootPath: env.root, Python: "python3"}, env.home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(map[string]string)
+	for _, p := range result.Problems {
+		messages[p.Unit] += string(p.Severity) + ": " + p.Message + "\n"
+	}
+	for unit, want := range map[string]string{
+		"mismatch": "error: file name does not match the dir name",
+		"unknown":  `unknown field "restartCont"`,
+		"types":    "cannot unmarshal string",
+		"fails":    "config.py fails",
+		"noexec":   "noexec.start is not executable",
+		"broken":   "broken symlink",
+		"self":     "symlink cycle, " + filepath.Join(env.home, "loop", "self") + " is already walked",
+		"a":        "dependency cycle, the units include each other by symlinks: a -> b -> a",
+	} {
+		if !strings.Contains(messages[unit], want) {
+			t.Errorf("%s should report %q, got %q", unit, want, messages[unit])
+		}
+	}
+	if messages["good"] != "" || messages["b"] != "" {
+		t.Errorf("the valid units should have no problem, got %v", messages)
+	}
+	if !result.HasErrors() || len(result.Checked) != 9 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestCheckAddons(t *testing.T) {
+	env := newTestEnv(t)
+	staged := filepath.Join(env.out, "staging", "proxy")
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staged, "proxy.disabled"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := IgoConfig{RootPath: env.root, Python: "python3"}
+	result, err := Check(config, staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Checked) != 0 {
+		t.Error("a .disabled outside of the addons dir is not a runnable:", result.Checked)
+	}
+	if result, err = CheckAddons(config, staged); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Checked) != 1 || result.HasErrors() {
+		t.Error("the staged addon should be checked as an addon:", result)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	requirePython(t)
+	env := newTestEnv(t)
+	env.addUnit("web", env.script("web", "started", "echo one\necho two\necho three\nexec sleep 30"), `{"start": {"restartCount": 2}}`)
+	env.start()
+	waitFor(t, "unit start", func() bool { return len(env.logLines("web")) == 1 })
+
+	var resp control.Response
+	lines := 2
+	waitFor(t, "output", func() bool {
+		resp = env.request(control.Request{Action: control.ActionStatus, Name: "web", Lines: &lines})
+		return resp.Status != nil && len(resp.Status.Log) == 2
+	})
+	status := resp.Status
+	if status.State != control.StateRunning || status.Pid == 0 || status.OnOrigin || status.Health != "ok" {
+		t.Error("unexpected state:", status.UnitState)
+	}
+	if len(status.Processes) == 0 || status.Processes[0].Pid != status.Pid || !strings.Contains(status.Processes[0].Command, "sleep 30") {
+		t.Error("unexpected process tree:", status.Processes)
+	}
+	if status.Counters[journal.EventStarted] != 1 {
+		t.Error("unexpected counters:", status.Counters)
+	}
+	if strings.Join(status.Log, ",") != "two,three" {
+		t.Error("unexpected log:", status.Log)
+	}
+	if status.StartPath != filepath.Join(env.unitSymlinkPath("web"), "web.start") {
+		t.Error("unexpected start path:", status.StartPath)
+	}
+	if !strings.Contains(string(status.Config), `"restartCount":2`) {
+		t.Error("the owner should get the config:", string(status.Config))
+	}
+	lines = 0
+	if resp = env.request(control.Request{Action: control.ActionStatus, Name: "web", Lines: &lines}); resp.Status == nil || len(resp.Status.Log) != 0 {
+		t.Error("no lines should be sent for 0:", resp.Status)
+	}
+	if resp = env.request(control.Request{Action: control.ActionStatus, Name: "missing"}); resp.Error == "" {
+		t.Error("a missing unit should fail")
+	}
+
+	// list-all without read-logs gets the process tree of others without the command lines
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user:", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	var other control.UnitStatus
+	addonsMu.Lock()
+	for _, addon := range runningAddons {
+		if addon.Name == "web" {
+			other = addon.status(uint32(uid), map[string]bool{control.PermListAll: true}, 2, 1)
+		}
+	}
+	addonsMu.Unlock()
+	if len(other.Processes) == 0 || other.Processes[0].Pid == 0 {
+		t.Error("the process tree should be sent:", other.Processes)
+	}
+	for _, p := range other.Processes {
+		if p.Command != "" {
+			t.Error("the command lines should not be sent without read-logs:", p.Command)
+		}
+	}
+	if len(other.Log) != 0 || len(other.Config) != 0 {
+		t.Error("the log and the config should not be sent to others:", other.Log, string(other.Config))
+	}
+}
@@ -0,0 +1,125 @@
+package supervisor
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ui3o/codebox/igo/journal"
+)
+
+var (
+	watchInterval time.Duration = getEnvInt64("IGO_WATCH_INTERVAL", 1)
+	watchDebounce time.Duration = getEnvInt64("IGO_WATCH_DEBOUNCE", 2)
+)
+
+// resolveWatchPaths returns the glob list watched for the runnable. The config.py
+// of the runnable is always watched, relative globs are resolved to the unit directory.
+func (a *AddonBase) resolveWatchPaths() []string {
+	var globs []string
+	if a.ConfigPath != "" {
+		globs = append(globs, a.ConfigPath)
+	}
+	unitPath := filepath.Dir(a.StartPath)
+	for _, p := range a.Config.WatchPaths {
+		if len(p) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(unitPath, p)
+		}
+		globs = append(globs, p)
+	}
+	return globs
+}
+
+// watchFingerprint builds a string from the path, size and mtime of every file matched
+// by the globs. Matched directories are walked, so adding or removing a file is detected too.
+func watchFingerprint(globs []string) string {
+	var entries []string
+	add := func(path string, info fs.FileInfo) {
+		entries = append(entries, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			DebugPrintln("[IGO] invalid watch pattern: ", glob, " err:", err)
+			continue
+		}
+		for _, match := range matches {
+			filepath.Walk(match, func(path string, info fs.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				add(path, info)
+				return nil
+			})
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, "\n")
+}
+
+// watchFiles polls the watched files of the addon until done is closed. When the files
+// changed and then stayed untouched for the debounce time onChange is called once with
+// addonsMu held.
+//
+// It polls instead of using inotify like the find cycle does: a glob can match files and
+// dirs which do not exist yet, a walked dir would need a watch for every subdir and the
+// homes can be on network or fuse mounts which send no events. The fingerprint is cheap
+// for the few files of a unit and igo stays without dependencies.
+func watchFiles(name string, watchPaths []string, done <-chan struct{}, onChange func()) {
+	if len(watchPaths) == 0 {
+		return
+	}
+	baseline := watchFingerprint(watchPaths)
+	pending := ""
+	var changedAt time.Time
+	ticker := time.NewTicker(watchInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		current := watchFingerprint(watchPaths)
+		if current == baseline {
+			pending = ""
+			continue
+		}
+		if current != pending {
+			pending = current
+			changedAt = time.Now()
+			DebugPrintln("[IGO] change detected for: ", name, " waiting for debounce")
+			continue
+		}
+		if time.Since(changedAt) < watchDebounce*time.Second {
+			continue
+		}
+		baseline = current
+		pending = ""
+		addonsMu.Lock()
+		select {
+		case <-done:
+			// the worker stopped watching while it waited for the lock
+		default:
+			onChange()
+		}
+		addonsMu.Unlock()
+	}
+}
+
+// gracefulRestart terminates the running process of the addon. The exit is handled by
+// startAndRetry, which starts the addon again instead of counting a retry or removing the unit.
+func (addon *AddonType) gracefulRestart() {
+	if !addon.IsRunning || addon.IsStopping || addon.Pid == 0 {
+		return
+	}
+	addon.logEvent(NOTICE, journal.EventRestarting, "watched files changed")
+	addon.IsRestarting = true
+	addon.terminate(false)
+}